@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/logger"
+	"github.com/johnshiver/rocky/server"
+)
+
+func main() {
+	configPath := flag.String("config", "config.toml", "path of the TOML config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config path] [check-config]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "check-config validates the config file and exits without serving.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "":
+		run(*configPath)
+	case "check-config":
+		checkConfig(*configPath)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// checkConfig reports every problem with the config file, exiting with
+// status 1 if there is any.
+func checkConfig(path string) {
+	if _, err := config.Load(path); err != nil {
+		fail(err)
+	}
+	fmt.Printf("%s is valid\n", path)
+}
+
+// fail reports an error rocky cannot go on after on stderr and exits with
+// status 1. The log file is no place for it, whoever started rocky is
+// waiting to hear why it stopped.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func run(path string) {
+	pLogger := logger.GetLogInstance()
+
+	settings, err := config.Load(path)
+	if err != nil {
+		fail(err)
+	}
+	srv, err := server.New(*settings)
+	if err != nil {
+		fail(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				// clients stay connected, and a config file with problems
+				// changes nothing
+				if err := srv.Reload(); err != nil {
+					pLogger.Printf("reload failed: %s\n", err)
+				}
+				continue
+			}
+			pLogger.Printf("received %s, shutting down\n", sig)
+			srv.Close()
+			return
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != nil {
+		fail(err)
+	}
+}
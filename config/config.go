@@ -1,15 +1,130 @@
 package config
 
 import (
+	"fmt"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/johnshiver/rocky/logger"
 	"github.com/spf13/viper"
 )
 
-var c RockyProxySettings
+const (
+	DEFAULT_CAPACITY = 5
+	DEFAULT_WEIGHT   = 1
 
-const DEFAULT_CAPACITY = 5
+	// pool defaults, in seconds
+	DEFAULT_IDLE_TIMEOUT = 600
+	DEFAULT_MAX_LIFETIME = 3600
+	DEFAULT_POOL_TIMEOUT = 120
+
+	DEFAULT_MAX_PREPARED_STATEMENTS = 100
+
+	DEFAULT_SERVER_RESET_QUERY = "DISCARD ALL"
+	DEFAULT_SERVER_CHECK_QUERY = "select 1"
+	// in seconds
+	DEFAULT_SERVER_CHECK_DELAY = 30
+
+	// in seconds
+	DEFAULT_HEALTH_CHECK_INTERVAL = 0
+	DEFAULT_HEALTH_CHECK_QUERY    = "select 1"
+	DEFAULT_HEALTH_CHECK_RISE     = 2
+	DEFAULT_HEALTH_CHECK_FALL     = 3
+)
+
+// PoolMode controls how long a client keeps the backend connection it was
+// given.
+type PoolMode string
+
+const (
+	// the connection is held until the client disconnects
+	SessionPooling PoolMode = "session"
+	// the connection is returned as soon as the client is outside a
+	// transaction
+	TransactionPooling PoolMode = "transaction"
+	// the connection is returned after every statement, transactions are
+	// not allowed
+	StatementPooling PoolMode = "statement"
+)
+
+// Balance is how a logical database spreads work over its replicas.
+type Balance string
+
+const (
+	// replicas take turns
+	BalanceRoundRobin Balance = "round_robin"
+	// the replica with the fewest connections in use
+	BalanceLeastActive Balance = "least_active"
+	// a random replica, more often the higher its weight
+	BalanceWeightedRandom Balance = "weighted_random"
+	// a client address always gets the same replica while the set of
+	// healthy replicas stays the same
+	BalanceHashAddress Balance = "hash_address"
+	// as hash_address, by user name
+	BalanceHashUser Balance = "hash_user"
+)
+
+// AuthType is how rocky authenticates clients.
+type AuthType string
+
+const (
+	// relay the client's login to the backend, as a check only
+	AuthBackend AuthType = "backend"
+	// accept any user in the auth file without a password
+	AuthTrust AuthType = "trust"
+	// md5 password challenge against the auth file
+	AuthMD5 AuthType = "md5"
+	// SASL SCRAM-SHA-256 exchange against the auth file
+	AuthSCRAM AuthType = "scram-sha-256"
+)
+
+// ClientCertMode is whether clients connecting with TLS must present a
+// certificate signed by the configured CA.
+type ClientCertMode string
+
+const (
+	// client certificates are not requested
+	ClientCertNone ClientCertMode = "none"
+	// a certificate is verified if the client sends one
+	ClientCertOptional ClientCertMode = "optional"
+	// clients without a valid certificate are rejected
+	ClientCertRequire ClientCertMode = "require"
+)
+
+// ClientTLSSetting configures TLS between clients and rocky. TLS is offered
+// to clients when CertFile and KeyFile are set.
+type ClientTLSSetting struct {
+	CertFile string
+	KeyFile  string
+	// CA used to verify client certificates
+	CAFile     string
+	ClientCert ClientCertMode
+	// reject clients that do not upgrade to TLS
+	Require bool
+}
+
+// Enabled reports whether rocky accepts TLS connections from clients.
+func (t ClientTLSSetting) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// SSLMode is how rocky secures its connection to a backend, with the same
+// meaning as libpq's sslmode. The zero value disables TLS, config files
+// default to prefer.
+type SSLMode string
+
+const (
+	// plaintext only
+	SSLDisable SSLMode = "disable"
+	// TLS if the backend supports it, without verifying its certificate
+	SSLPrefer SSLMode = "prefer"
+	// TLS without verifying the backend's certificate
+	SSLRequire SSLMode = "require"
+	// TLS with a backend certificate signed by SSLRootCert
+	SSLVerifyCA SSLMode = "verify-ca"
+	// as verify-ca, and the certificate must match the backend host name
+	SSLVerifyFull SSLMode = "verify-full"
+)
 
 type BackendHostSetting struct {
 	// DB settings
@@ -22,73 +137,465 @@ type BackendHostSetting struct {
 	// Proxy settings
 	ProxyPort int
 	Capacity  int
+	// Most clients connected to the backend at once, 0 for no limit
+	ConnectionMax int
+	// Share of the work given to the backend as a replica under
+	// weighted_random balancing
+	Weight int
+
+	// Pool settings
+	// MinIdle connections are kept open even when no client needs them,
+	// MaxIdle caps how many unused connections are kept around (0 means
+	// Capacity). A timeout or lifetime of 0 disables it.
+	MinIdle     int
+	MaxIdle     int
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// How long a client waits for a connection once Capacity is reached
+	// before getting an error, 0 waits forever
+	PoolTimeout time.Duration
+	PoolMode    PoolMode
+	// Outside of session mode clients' named prepared statements are
+	// recreated on whichever connection serves them, with at most
+	// MaxPreparedStatements kept per connection. 0 disables this.
+	MaxPreparedStatements int
+	// ServerResetQuery runs on connections returned to the pool to clear
+	// what the client left behind. Outside of session mode it is skipped
+	// unless ServerResetQueryAlways is set, since transactions do not leave
+	// much behind. Empty disables it.
+	ServerResetQuery       string
+	ServerResetQueryAlways bool
+	// ServerCheckQuery runs on idle connections that have not been used for
+	// ServerCheckDelay before they are handed out, those failing it are
+	// closed. Empty disables it.
+	ServerCheckQuery string
+	ServerCheckDelay time.Duration
+	// Every HealthCheckInterval a new connection is opened to run
+	// HealthCheckQuery, and pg_is_in_recovery() if HealthCheckRole is set.
+	// The backend is marked down after HealthCheckFall checks in a row
+	// failed and up again after HealthCheckRise passed. An interval of 0, the
+	// default, disables health checks.
+	HealthCheckInterval time.Duration
+	HealthCheckQuery    string
+	HealthCheckRole     bool
+	HealthCheckRise     int
+	HealthCheckFall     int
 
-	// TODO: add options for the startup message
+	// Run-time parameters sent in the startup message of every connection
+	// to the backend, like search_path or statement_timeout. Parameters
+	// clients send in their own startup message are applied on top.
 	Options map[string]string
+
+	// TLS settings
+	// SSLRootCert is the CA for verify-ca and verify-full, SSLCert and SSLKey
+	// are the client certificate presented to the backend
+	SSLMode     SSLMode
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+}
+
+// DatabaseSetting is a logical database made of a primary backend and
+// replicas that read-only work can be sent to, each referring to a
+// backend_* section by name.
+type DatabaseSetting struct {
+	Name      string
+	ProxyPort int
+	// Most clients connected to the database at once, 0 for no limit
+	ConnectionMax int
+	Primary       string
+	// Backends that can be promoted to primary. When set rocky follows
+	// whichever of them is the writable primary according to its health
+	// checks, starting with Primary or else the first candidate.
+	Candidates []string
+	Replicas   []string
+	Balance    Balance
+	// Replicas further behind the primary than MaxReplicaLag, or whose lag
+	// is not known, are not given reads. 0 disables this.
+	MaxReplicaLag time.Duration
+	// How long a session keeps reading from the primary after writing to
+	// it, so it sees its own writes. 0 disables this and a negative value
+	// keeps the session on the primary for good.
+	StickyPrimary time.Duration
+}
+
+// RouteSetting sends clients of the HostPort listener asking for Database as
+// User to Target, a backend or logical database. Database and User are
+// matched as shell patterns, "*" matching any. Every backend and logical
+// database is routed to by its own name without a route.
+type RouteSetting struct {
+	Name     string
+	Database string
+	User     string
+	Target   string
 }
 
 type RockyProxySettings struct {
-	// Port that Rocky Proxy will bind to
-	HostPort     string
+	// Port that Rocky Proxy will bind to, clients connecting to it are
+	// routed by database and user
+	HostPort string
+	// Most clients connected at once, and most connected as any one user.
+	// 0 means no limit. Admin console clients are not counted.
+	ConnectionMax     int
+	UserConnectionMax int
+
 	BackendHosts []*BackendHostSetting
+	// Logical databases splitting reads and writes between backends
+	Databases []*DatabaseSetting
+	Routes    []*RouteSetting
+
+	// Largest message in bytes rocky will relay, 0 uses the protocol default
+	MaxMessageSize int
+
+	// How clients are authenticated, and the userlist file holding their
+	// passwords for every AuthType but AuthBackend
+	AuthType AuthType
+	AuthFile string
+
+	ClientTLS ClientTLSSetting
+
+	// Users allowed to connect to the admin console, the virtual "rocky"
+	// database. Nobody can while it is empty.
+	AdminUsers []string
+
+	// host:port serving Prometheus metrics at /metrics, disabled when empty
+	MetricsAddress string
+
+	// The file the settings were loaded from, empty if they were not
+	Path string
+}
+
+// ValidationError lists everything wrong with a config file.
+type ValidationError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	name := e.Path
+	if name == "" {
+		name = "config"
+	}
+	return fmt.Sprintf("%s has %d problem(s):\n  %s", name, len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// Load reads the TOML config file at path and validates it. Instead of
+// stopping at the first problem, every problem found is reported at once in a
+// *ValidationError.
+func Load(path string) (*RockyProxySettings, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+
+	l := &loader{v: v, read: make(map[string]bool)}
+	settings := l.settings()
+	l.unknownKeys()
+	problems := l.problems
+	if err := settings.Validate(); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Path: path, Problems: problems}
+	}
+	settings.Path = path
+	return settings, nil
+}
+
+// loader turns the keys of a config file into settings, noting values of the
+// wrong type and keys that are never read.
+type loader struct {
+	v *viper.Viper
+	// keys looked at, whether set or not
+	read     map[string]bool
+	problems []string
+}
+
+func (l *loader) problem(key, format string, args ...interface{}) {
+	l.problems = append(l.problems, key+": "+fmt.Sprintf(format, args...))
 }
 
-func init() {
-
-	pLogger := logger.GetLogInstance()
-
-	// TODO: create some config validation, checking for things like ports defined multiple times
-	// TODO: eventually set config to database and only draw from toml if nothing is in the db or some override
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
-	if err != nil {
-		pLogger.Println(err)
-	}
-
-	rockyHostPort := viper.GetString("rocky_proxy_settings.host_port")
-
-	var backendHosts []*BackendHostSetting
-	c = RockyProxySettings{
-		HostPort:     rockyHostPort,
-		BackendHosts: backendHosts,
-	}
-
-	settings := viper.AllSettings()
-	for setting, _ := range settings {
-		if strings.HasPrefix(setting, "backend_") {
-			backendHostPort := viper.GetString(setting + ".host_port")
-			username := viper.GetString(setting + ".username")
-			password := viper.GetString(setting + ".password")
-			database := viper.GetString(setting + ".database")
-			proxyPort := viper.GetInt(setting + ".proxy_port")
-			c.BackendHosts = append(c.BackendHosts, &BackendHostSetting{
-				Name:      strings.TrimLeft(setting, "backend_"),
-				Port:      backendHostPort,
-				Username:  username,
-				Password:  password,
-				Database:  database,
-				ProxyPort: proxyPort,
-				Capacity:  DEFAULT_CAPACITY,
-			})
+func (l *loader) settings() *RockyProxySettings {
+	const top = "rocky_proxy_settings."
+	settings := &RockyProxySettings{
+		HostPort:          l.getString(top+"host_port", ""),
+		ConnectionMax:     l.getInt(top+"connection_max", 0),
+		UserConnectionMax: l.getInt(top+"user_connection_max", 0),
+		MaxMessageSize:    l.getInt(top+"max_message_size", 0),
+		AuthType:          l.getAuthType(top + "auth_type"),
+		AuthFile:          l.getString(top+"auth_file", ""),
+		ClientTLS: ClientTLSSetting{
+			CertFile:   l.getString(top+"client_tls_cert_file", ""),
+			KeyFile:    l.getString(top+"client_tls_key_file", ""),
+			CAFile:     l.getString(top+"client_tls_ca_file", ""),
+			ClientCert: l.getClientCertMode(top + "client_tls_client_cert"),
+			Require:    l.getBool(top + "require_tls"),
+		},
+		AdminUsers:     l.getStrings(top + "admin_users"),
+		MetricsAddress: l.getString(top+"metrics_address", ""),
+	}
+
+	// sorted so settings and problems come out in the same order every time
+	var sections []string
+	for section := range l.v.AllSettings() {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		switch {
+		case strings.HasPrefix(section, "backend_"):
+			settings.BackendHosts = append(settings.BackendHosts, l.backend(section))
+		case strings.HasPrefix(section, "database_"):
+			settings.Databases = append(settings.Databases, l.database(section))
+		case strings.HasPrefix(section, "route_"):
+			settings.Routes = append(settings.Routes, l.route(section))
 		}
 	}
+	return settings
 }
 
-func GetConfig() RockyProxySettings {
-	return c
+func (l *loader) backend(section string) *BackendHostSetting {
+	key := func(name string) string {
+		return section + "." + name
+	}
+	return &BackendHostSetting{
+		Name:                   strings.TrimPrefix(section, "backend_"),
+		Port:                   l.getString(key("host_port"), ""),
+		Username:               l.getString(key("username"), ""),
+		Password:               l.getString(key("password"), ""),
+		Database:               l.getString(key("database"), ""),
+		ProxyPort:              l.getInt(key("proxy_port"), 0),
+		Capacity:               l.getInt(key("capacity"), DEFAULT_CAPACITY),
+		ConnectionMax:          l.getInt(key("connection_max"), 0),
+		Weight:                 l.getInt(key("weight"), DEFAULT_WEIGHT),
+		MinIdle:                l.getInt(key("min_idle"), 0),
+		MaxIdle:                l.getInt(key("max_idle"), 0),
+		IdleTimeout:            l.getSeconds(key("idle_timeout"), DEFAULT_IDLE_TIMEOUT),
+		MaxLifetime:            l.getSeconds(key("max_lifetime"), DEFAULT_MAX_LIFETIME),
+		PoolTimeout:            l.getSeconds(key("pool_timeout"), DEFAULT_POOL_TIMEOUT),
+		PoolMode:               l.getPoolMode(key("pool_mode")),
+		MaxPreparedStatements:  l.getInt(key("max_prepared_statements"), DEFAULT_MAX_PREPARED_STATEMENTS),
+		ServerResetQuery:       l.getString(key("server_reset_query"), DEFAULT_SERVER_RESET_QUERY),
+		ServerResetQueryAlways: l.getBool(key("server_reset_query_always")),
+		ServerCheckQuery:       l.getString(key("server_check_query"), DEFAULT_SERVER_CHECK_QUERY),
+		ServerCheckDelay:       l.getSeconds(key("server_check_delay"), DEFAULT_SERVER_CHECK_DELAY),
+		HealthCheckInterval:    l.getSeconds(key("health_check_interval"), DEFAULT_HEALTH_CHECK_INTERVAL),
+		HealthCheckQuery:       l.getString(key("health_check_query"), DEFAULT_HEALTH_CHECK_QUERY),
+		HealthCheckRole:        l.getBool(key("health_check_role")),
+		HealthCheckRise:        l.getInt(key("health_check_rise"), DEFAULT_HEALTH_CHECK_RISE),
+		HealthCheckFall:        l.getInt(key("health_check_fall"), DEFAULT_HEALTH_CHECK_FALL),
+		Options:                l.getStringMap(key("options")),
+		SSLMode:                l.getSSLMode(key("sslmode")),
+		SSLRootCert:            l.getString(key("sslrootcert"), ""),
+		SSLCert:                l.getString(key("sslcert"), ""),
+		SSLKey:                 l.getString(key("sslkey"), ""),
+	}
+}
 
+func (l *loader) database(section string) *DatabaseSetting {
+	key := func(name string) string {
+		return section + "." + name
+	}
+	return &DatabaseSetting{
+		Name:          strings.TrimPrefix(section, "database_"),
+		ProxyPort:     l.getInt(key("proxy_port"), 0),
+		ConnectionMax: l.getInt(key("connection_max"), 0),
+		Primary:       l.getString(key("primary"), ""),
+		Candidates:    l.getStrings(key("candidates")),
+		Replicas:      l.getStrings(key("replicas")),
+		Balance:       l.getBalance(key("balance")),
+		MaxReplicaLag: l.getSeconds(key("max_replica_lag"), 0),
+		StickyPrimary: l.getSeconds(key("sticky_primary"), 0),
+	}
 }
 
-func GetBackendHosts() []*BackendHostSetting {
-	return c.BackendHosts
+func (l *loader) route(section string) *RouteSetting {
+	key := func(name string) string {
+		return section + "." + name
+	}
+	return &RouteSetting{
+		Name:     strings.TrimPrefix(section, "route_"),
+		Database: l.getString(key("database"), "*"),
+		User:     l.getString(key("user"), "*"),
+		Target:   l.getString(key("target"), ""),
+	}
 }
 
-func GetBackendHost(hostName string) *BackendHostSetting {
-	for _, backend := range c.BackendHosts {
-		if backend.Name == hostName {
-			return backend
+// unknownKeys notes every key in the file that was never read, misspelled
+// settings or sections rocky does not know.
+func (l *loader) unknownKeys() {
+	keys := l.v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !l.read[key] {
+			l.problem(key, "unknown setting")
 		}
 	}
-	return nil
+}
+
+// get returns the value at key, nil if it is not set.
+func (l *loader) get(key string) interface{} {
+	l.read[key] = true
+	if !l.v.IsSet(key) {
+		return nil
+	}
+	return l.v.Get(key)
+}
+
+// getInt returns the integer at key, or defaultValue if the key is not set
+func (l *loader) getInt(key string, defaultValue int) int {
+	switch value := l.get(key).(type) {
+	case nil:
+		return defaultValue
+	case int64:
+		return int(value)
+	case int:
+		return value
+	default:
+		l.problem(key, "expected a whole number, got %v", value)
+		return defaultValue
+	}
+}
+
+// getString returns the string at key, or defaultValue if the key is not set.
+// A key set to "" stays empty.
+func (l *loader) getString(key string, defaultValue string) string {
+	switch value := l.get(key).(type) {
+	case nil:
+		return defaultValue
+	case string:
+		return value
+	default:
+		l.problem(key, "expected a quoted string, got %v", value)
+		return defaultValue
+	}
+}
+
+// getBool returns the boolean at key, false if the key is not set
+func (l *loader) getBool(key string) bool {
+	switch value := l.get(key).(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	default:
+		l.problem(key, "expected true or false, got %v", value)
+		return false
+	}
+}
+
+// getStrings returns the list of strings at key
+func (l *loader) getStrings(key string) []string {
+	var values []interface{}
+	switch value := l.get(key).(type) {
+	case nil:
+		return nil
+	case []string:
+		return value
+	case []interface{}:
+		values = value
+	default:
+		l.problem(key, "expected a list of strings, got %v", value)
+		return nil
+	}
+
+	var strs []string
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			l.problem(key, "expected a list of strings, got %v", value)
+			return nil
+		}
+		strs = append(strs, str)
+	}
+	return strs
+}
+
+// getStringMap returns the table at key with its values as strings, nil if
+// the key is not set. Numbers and booleans are kept as written.
+func (l *loader) getStringMap(key string) map[string]string {
+	var table map[string]interface{}
+	switch value := l.get(key).(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		table = value
+	default:
+		l.problem(key, "expected a table, got %v", value)
+		return nil
+	}
+
+	var names []string
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	strs := make(map[string]string)
+	for _, name := range names {
+		l.read[key+"."+name] = true
+		switch value := table[name].(type) {
+		case string:
+			strs[name] = value
+		case int, int64, float64, bool:
+			strs[name] = fmt.Sprint(value)
+		default:
+			l.problem(key+"."+name, "expected a string, got %v", value)
+		}
+	}
+	return strs
+}
+
+// getSeconds reads a number of seconds at key as a duration
+func (l *loader) getSeconds(key string, defaultValue int) time.Duration {
+	return time.Duration(l.getInt(key, defaultValue)) * time.Second
+}
+
+// getChoice returns the value at key lowercased if it is one of choices,
+// defaultValue if it is not set.
+func (l *loader) getChoice(key, defaultValue string, choices ...string) string {
+	value := strings.ToLower(l.getString(key, ""))
+	if value == "" {
+		return defaultValue
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	l.problem(key, "unknown value %q, expected one of %s", value, strings.Join(choices, ", "))
+	return defaultValue
+}
+
+// getPoolMode reads the pool mode at key, defaulting to session pooling
+func (l *loader) getPoolMode(key string) PoolMode {
+	return PoolMode(l.getChoice(key, string(SessionPooling),
+		string(SessionPooling), string(TransactionPooling), string(StatementPooling)))
+}
+
+// getBalance reads the balance at key, defaulting to round_robin
+func (l *loader) getBalance(key string) Balance {
+	return Balance(l.getChoice(key, string(BalanceRoundRobin),
+		string(BalanceRoundRobin), string(BalanceLeastActive), string(BalanceWeightedRandom),
+		string(BalanceHashAddress), string(BalanceHashUser)))
+}
+
+// getSSLMode reads the sslmode at key, defaulting to prefer like libpq
+func (l *loader) getSSLMode(key string) SSLMode {
+	return SSLMode(l.getChoice(key, string(SSLPrefer),
+		string(SSLDisable), string(SSLPrefer), string(SSLRequire), string(SSLVerifyCA), string(SSLVerifyFull)))
+}
+
+// getAuthType reads the auth type at key, defaulting to backend
+func (l *loader) getAuthType(key string) AuthType {
+	return AuthType(l.getChoice(key, string(AuthBackend),
+		string(AuthBackend), string(AuthTrust), string(AuthMD5), string(AuthSCRAM)))
+}
+
+// getClientCertMode reads the client certificate mode at key, defaulting to
+// none
+func (l *loader) getClientCertMode(key string) ClientCertMode {
+	return ClientCertMode(l.getChoice(key, string(ClientCertNone),
+		string(ClientCertNone), string(ClientCertOptional), string(ClientCertRequire)))
 }
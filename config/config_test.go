@@ -0,0 +1,166 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file to a temporary directory, returning its
+// path and a function removing it.
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "rocky-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoad(t *testing.T) {
+	path, remove := writeConfig(t, `
+[backend_backend_a]
+host_port = "localhost:5432"
+username = "postgres"
+database = "postgres"
+proxy_port = 1234
+pool_mode = "Transaction"
+
+[backend_backend_a.options]
+application_name = "rocky"
+statement_timeout = 5000
+
+[database_app]
+proxy_port = 1236
+connection_max = 20
+primary = "backend_a"
+replicas = ["backend_a"]
+
+[route_reporting]
+user = "report_*"
+target = "app"
+
+[rocky_proxy_settings]
+host_port = "localhost:9090"
+connection_max = 100
+user_connection_max = 10
+admin_users = ["postgres"]
+`)
+	defer remove()
+
+	settings, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.BackendHosts) != 1 {
+		t.Fatalf("expected 1 backend, got %d", len(settings.BackendHosts))
+	}
+	// only the prefix is removed from the section name
+	backend := settings.BackendHosts[0]
+	if backend.Name != "backend_a" {
+		t.Errorf("expected backend backend_a, got %q", backend.Name)
+	}
+	if backend.PoolMode != TransactionPooling || backend.Capacity != DEFAULT_CAPACITY ||
+		backend.IdleTimeout != DEFAULT_IDLE_TIMEOUT*time.Second || backend.SSLMode != SSLPrefer ||
+		backend.HealthCheckInterval != 0 {
+		t.Errorf("unexpected backend settings %+v", backend)
+	}
+	if len(backend.Options) != 2 || backend.Options["application_name"] != "rocky" ||
+		backend.Options["statement_timeout"] != "5000" {
+		t.Errorf("unexpected backend options %v", backend.Options)
+	}
+	if len(settings.Databases) != 1 || settings.Databases[0].Balance != BalanceRoundRobin ||
+		settings.Databases[0].ConnectionMax != 20 {
+		t.Errorf("unexpected databases %+v", settings.Databases)
+	}
+	if len(settings.Routes) != 1 || settings.Routes[0].Database != "*" || settings.Routes[0].User != "report_*" {
+		t.Errorf("unexpected routes %+v", settings.Routes)
+	}
+	if settings.AuthType != AuthBackend || settings.ConnectionMax != 100 || settings.UserConnectionMax != 10 ||
+		len(settings.AdminUsers) != 1 || settings.AdminUsers[0] != "postgres" {
+		t.Errorf("unexpected proxy settings %+v", settings)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	path, remove := writeConfig(t, `
+[backend_a]
+host_port = "localhost"
+username = "postgres"
+proxy_port = 1234
+capacity = 0
+min_idle = 2
+pool_mode = "sessions"
+sslmode = "verify-full"
+health_check_role = "yes"
+
+[backend_b]
+host_port = "localhost:5433"
+username = "postgres"
+database = "postgres"
+proxy_port = 1234
+capasity = 5
+options = { user = "other", search_path = ["app"] }
+
+[database_b]
+primary = "c"
+
+[route_r]
+target = "nowhere"
+user = "[a"
+
+[rocky_proxy_settings]
+host_port = "localhost:99999"
+auth_type = "md5"
+require_tls = true
+`)
+	defer remove()
+
+	_, err := Load(path)
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+
+	expected := []string{
+		`backend_a.pool_mode: unknown value "sessions"`,
+		`backend_a.health_check_role: expected true or false`,
+		`backend_b.capasity: unknown setting`,
+		`backend_b.options.search_path: expected a string`,
+		`backend_b.options.user: is set by username and database`,
+		`rocky_proxy_settings.auth_file: is needed with auth_type "md5"`,
+		`rocky_proxy_settings.require_tls: needs client_tls_cert_file`,
+		`backend_a.host_port: "localhost" is not host:port`,
+		`backend_a.database: is needed`,
+		`backend_a.capacity: must be at least 1`,
+		`backend_a.min_idle: must be between 0 and capacity (0)`,
+		`backend_a.sslrootcert: is needed with sslmode "verify-full"`,
+		`backend_b.proxy_port: port 1234 is already used by backend_a.proxy_port`,
+		`database_b: name already used by backend_b`,
+		`database_b.primary: no backend_c section`,
+		`route_r.target: no backend or database named "nowhere"`,
+		`route_r.user: bad pattern "[a"`,
+		`rocky_proxy_settings.host_port: "localhost:99999" does not end in a port number`,
+	}
+	if len(validationErr.Problems) != len(expected) {
+		t.Errorf("expected %d problems, got %d:\n%s", len(expected), len(validationErr.Problems), err)
+	}
+	for _, problem := range expected {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected problem %q in:\n%s", problem, err)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(os.TempDir(), "no-such-rocky-config.toml")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,318 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate checks the settings for values rocky cannot run with, returning a
+// *ValidationError listing all of them, or nil.
+func (settings *RockyProxySettings) Validate() error {
+	v := &validator{ports: make(map[int]string)}
+	v.proxySettings(settings)
+
+	backends := make(map[string]*BackendHostSetting)
+	for _, backend := range settings.BackendHosts {
+		backends[backend.Name] = backend
+		v.backend(backend)
+	}
+	names := make(map[string]bool)
+	for name := range backends {
+		names[name] = true
+	}
+	for _, db := range settings.Databases {
+		if backends[db.Name] != nil {
+			v.problem("database_"+db.Name, "name already used by backend_%s", db.Name)
+		}
+		names[db.Name] = true
+		v.database(db, backends)
+	}
+	for _, route := range settings.Routes {
+		v.route(route, names)
+	}
+
+	// listeners on the same port as a proxy port, whatever their host,
+	// cannot both be bound
+	v.listener("rocky_proxy_settings.host_port", settings.HostPort)
+	v.listener("rocky_proxy_settings.metrics_address", settings.MetricsAddress)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// validator collects the problems found in settings.
+type validator struct {
+	// setting using each port, by port
+	ports    map[int]string
+	problems []string
+}
+
+func (v *validator) problem(key, format string, args ...interface{}) {
+	v.problems = append(v.problems, key+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) proxySettings(settings *RockyProxySettings) {
+	const top = "rocky_proxy_settings."
+	if len(settings.BackendHosts) == 0 {
+		v.problem("config", "no backend_* section, at least one backend is needed")
+	}
+	if settings.ConnectionMax < 0 {
+		v.problem(top+"connection_max", "must not be negative, 0 means no limit")
+	}
+	if settings.UserConnectionMax < 0 {
+		v.problem(top+"user_connection_max", "must not be negative, 0 means no limit")
+	}
+	if settings.MaxMessageSize < 0 {
+		v.problem(top+"max_message_size", "must not be negative, 0 uses the default")
+	}
+
+	if settings.AuthType != "" && settings.AuthType != AuthBackend {
+		if settings.AuthFile == "" {
+			v.problem(top+"auth_file", "is needed with auth_type %q", settings.AuthType)
+		} else {
+			v.file(top+"auth_file", settings.AuthFile)
+		}
+	}
+
+	tls := settings.ClientTLS
+	v.pair(top+"client_tls_cert_file", tls.CertFile, top+"client_tls_key_file", tls.KeyFile)
+	v.file(top+"client_tls_cert_file", tls.CertFile)
+	v.file(top+"client_tls_key_file", tls.KeyFile)
+	v.file(top+"client_tls_ca_file", tls.CAFile)
+	if tls.Require && !tls.Enabled() {
+		v.problem(top+"require_tls", "needs client_tls_cert_file and client_tls_key_file")
+	}
+	if tls.ClientCert != "" && tls.ClientCert != ClientCertNone && tls.CAFile == "" {
+		v.problem(top+"client_tls_client_cert", "%q needs client_tls_ca_file to verify certificates with",
+			tls.ClientCert)
+	}
+}
+
+func (v *validator) backend(backend *BackendHostSetting) {
+	section := "backend_" + backend.Name + "."
+	if backend.Name == "" {
+		v.problem("backend_", "section needs a name after backend_")
+	}
+
+	if backend.Port == "" {
+		v.problem(section+"host_port", "is needed, the backend's host:port")
+	} else if host, err := hostPort(backend.Port); err != nil {
+		v.problem(section+"host_port", "%s", err)
+	} else if host == "" {
+		v.problem(section+"host_port", "%q has no host", backend.Port)
+	}
+	if backend.Username == "" {
+		v.problem(section+"username", "is needed")
+	}
+	if backend.Database == "" {
+		v.problem(section+"database", "is needed")
+	}
+	v.proxyPort(section+"proxy_port", backend.ProxyPort)
+
+	if backend.Capacity < 1 {
+		v.problem(section+"capacity", "must be at least 1, got %d", backend.Capacity)
+	}
+	if backend.ConnectionMax < 0 {
+		v.problem(section+"connection_max", "must not be negative, 0 means no limit")
+	}
+	if backend.MinIdle < 0 || backend.MinIdle > backend.Capacity {
+		v.problem(section+"min_idle", "must be between 0 and capacity (%d), got %d", backend.Capacity, backend.MinIdle)
+	}
+	if backend.MaxIdle < 0 || backend.MaxIdle > backend.Capacity {
+		v.problem(section+"max_idle", "must be between 0 and capacity (%d), got %d", backend.Capacity, backend.MaxIdle)
+	}
+	if backend.Weight < 0 {
+		v.problem(section+"weight", "must not be negative, got %d", backend.Weight)
+	}
+	if backend.MaxPreparedStatements < 0 {
+		v.problem(section+"max_prepared_statements", "must not be negative, 0 disables it")
+	}
+	for _, duration := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"idle_timeout", backend.IdleTimeout},
+		{"max_lifetime", backend.MaxLifetime},
+		{"pool_timeout", backend.PoolTimeout},
+		{"server_check_delay", backend.ServerCheckDelay},
+		{"health_check_interval", backend.HealthCheckInterval},
+	} {
+		if duration.value < 0 {
+			v.problem(section+duration.key, "must not be negative")
+		}
+	}
+	if backend.HealthCheckInterval > 0 {
+		if backend.HealthCheckRise < 1 {
+			v.problem(section+"health_check_rise", "must be at least 1, got %d", backend.HealthCheckRise)
+		}
+		if backend.HealthCheckFall < 1 {
+			v.problem(section+"health_check_fall", "must be at least 1, got %d", backend.HealthCheckFall)
+		}
+	}
+
+	var options []string
+	for name := range backend.Options {
+		options = append(options, name)
+	}
+	sort.Strings(options)
+	for _, name := range options {
+		switch strings.ToLower(name) {
+		case "user", "database":
+			v.problem(section+"options."+name, "is set by username and database")
+		case "replication":
+			v.problem(section+"options."+name, "replication connections cannot be pooled")
+		}
+	}
+
+	if (backend.SSLMode == SSLVerifyCA || backend.SSLMode == SSLVerifyFull) && backend.SSLRootCert == "" {
+		v.problem(section+"sslrootcert", "is needed with sslmode %q", backend.SSLMode)
+	}
+	v.pair(section+"sslcert", backend.SSLCert, section+"sslkey", backend.SSLKey)
+	v.file(section+"sslrootcert", backend.SSLRootCert)
+	v.file(section+"sslcert", backend.SSLCert)
+	v.file(section+"sslkey", backend.SSLKey)
+}
+
+func (v *validator) database(db *DatabaseSetting, backends map[string]*BackendHostSetting) {
+	section := "database_" + db.Name + "."
+	if db.Name == "" {
+		v.problem("database_", "section needs a name after database_")
+	}
+	v.proxyPort(section+"proxy_port", db.ProxyPort)
+	if db.ConnectionMax < 0 {
+		v.problem(section+"connection_max", "must not be negative, 0 means no limit")
+	}
+
+	if db.Primary == "" && len(db.Candidates) == 0 {
+		v.problem(section+"primary", "is needed unless candidates are set")
+	}
+	if db.Primary != "" && backends[db.Primary] == nil {
+		v.problem(section+"primary", "no backend_%s section", db.Primary)
+	}
+	for _, name := range db.Replicas {
+		backend := backends[name]
+		if backend == nil {
+			v.problem(section+"replicas", "no backend_%s section", name)
+			continue
+		}
+		// the lag is measured by the health checks finding the role
+		if db.MaxReplicaLag > 0 && !checksRole(backend) {
+			v.problem(section+"max_replica_lag", "needs health_check_interval and health_check_role on backend_%s", name)
+		}
+	}
+	for _, name := range db.Candidates {
+		backend := backends[name]
+		if backend == nil {
+			v.problem(section+"candidates", "no backend_%s section", name)
+			continue
+		}
+		// the primary is recognized by the role health checks find
+		if !checksRole(backend) {
+			v.problem(section+"candidates", "backend_%s needs health_check_interval and health_check_role", name)
+		}
+	}
+	if db.MaxReplicaLag < 0 {
+		v.problem(section+"max_replica_lag", "must not be negative, 0 disables it")
+	}
+}
+
+func (v *validator) route(route *RouteSetting, names map[string]bool) {
+	section := "route_" + route.Name + "."
+	if route.Name == "" {
+		v.problem("route_", "section needs a name after route_")
+	}
+	if route.Target == "" {
+		v.problem(section+"target", "is needed, a backend or database name")
+	} else if !names[route.Target] {
+		v.problem(section+"target", "no backend or database named %q", route.Target)
+	}
+	if _, err := path.Match(route.Database, ""); err != nil {
+		v.problem(section+"database", "bad pattern %q", route.Database)
+	}
+	if _, err := path.Match(route.User, ""); err != nil {
+		v.problem(section+"user", "bad pattern %q", route.User)
+	}
+}
+
+// proxyPort checks that port is a port number, or 0 for none, that no other
+// setting uses.
+func (v *validator) proxyPort(key string, port int) {
+	if port == 0 {
+		return
+	}
+	if port < 0 || port > 65535 {
+		v.problem(key, "%d is not a port number", port)
+		return
+	}
+	v.usePort(key, port)
+}
+
+// listener checks the host:port a listener is bound to, if set.
+func (v *validator) listener(key, address string) {
+	if address == "" {
+		return
+	}
+	if _, err := hostPort(address); err != nil {
+		v.problem(key, "%s", err)
+		return
+	}
+	_, port, _ := net.SplitHostPort(address)
+	number, _ := strconv.Atoi(port)
+	v.usePort(key, number)
+}
+
+func (v *validator) usePort(key string, port int) {
+	if other, ok := v.ports[port]; ok {
+		v.problem(key, "port %d is already used by %s", port, other)
+		return
+	}
+	v.ports[port] = key
+}
+
+// pair checks that two settings that only work together are both set or
+// neither is.
+func (v *validator) pair(key, value, otherKey, otherValue string) {
+	if value != "" && otherValue == "" {
+		v.problem(otherKey, "is needed with %s", key)
+	}
+	if value == "" && otherValue != "" {
+		v.problem(key, "is needed with %s", otherKey)
+	}
+}
+
+// file checks that the file named at key, if any, can be read.
+func (v *validator) file(key, name string) {
+	if name == "" {
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		v.problem(key, "%s", err)
+		return
+	}
+	f.Close()
+}
+
+// hostPort splits a host:port address, checking the port.
+func hostPort(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("%q is not host:port", address)
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return "", fmt.Errorf("%q does not end in a port number", address)
+	}
+	return host, nil
+}
+
+func checksRole(backend *BackendHostSetting) bool {
+	return backend.HealthCheckInterval > 0 && backend.HealthCheckRole
+}
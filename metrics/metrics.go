@@ -0,0 +1,297 @@
+// Package metrics implements the few Prometheus metric types rocky exposes
+// and serves them in the Prometheus text exposition format.
+//
+// Reference: https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets in seconds, the same as the Prometheus
+// client libraries use.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector is a metric family that can write itself out.
+type Collector interface {
+	// Write writes the family's HELP, TYPE and sample lines to w
+	Write(w io.Writer)
+}
+
+// Registry holds the collectors served by its Handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds collectors to the registry, they are written in the order
+// they were registered.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write writes every registered collector to w.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.Write(w)
+	}
+}
+
+// Handler serves the registry's metrics over HTTP.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buffered := bufio.NewWriter(w)
+		r.Write(buffered)
+		buffered.Flush()
+	})
+}
+
+// desc is the name, help text and label names shared by every metric type.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, metricType)
+}
+
+// key joins label values into a map key
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelPairs formats label values as {name="value",...}, with extra pairs
+// appended as given
+func (d *desc) labelPairs(labelValues []string, extra ...string) string {
+	var pairs []string
+	for i, value := range labelValues {
+		pairs = append(pairs, d.labels[i]+`="`+escapeLabel(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec creates a counter with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]*labeledValue),
+	}
+}
+
+// Add increases the counter for labelValues by v, which must not be negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &labeledValue{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = value
+	}
+	value.value += v
+}
+
+// Inc increases the counter for labelValues by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter for labelValues.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value, ok := c.values[key]; ok {
+		return value.value
+	}
+	return 0
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.writeHeader(w, "counter")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(value.labelValues), formatFloat(value.value))
+	}
+}
+
+// Sample is one value of a GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a gauge whose samples are computed each time it is written,
+// for values such as pool sizes that are already tracked elsewhere.
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc creates a gauge that reports the samples returned by collect.
+func NewGaugeFunc(name, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	return &GaugeFunc{
+		desc:    desc{name: name, help: help, labels: labels},
+		collect: collect,
+	}
+}
+
+func (g *GaugeFunc) Write(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	for _, sample := range g.collect() {
+		g.key(sample.LabelValues)
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(sample.LabelValues), formatFloat(sample.Value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	// counts[i] is the number of observations <= buckets[i], not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds, which
+// must be sorted, and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+// Observe adds an observation for labelValues.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = value
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		value.counts[i]++
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *HistogramVec) Write(w io.Writer) {
+	h.writeHeader(w, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		value := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(value.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(value.labelValues, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(value.labelValues), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(value.labelValues), value.count)
+	}
+}
+
+func sortedKeys(values interface{}) []string {
+	var keys []string
+	switch values := values.(type) {
+	case map[string]*labeledValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	counter := NewCounterVec("rocky_test_total", "A test counter.", "backend", "code")
+	counter.Inc("b", "53300")
+	counter.Add(2, "a", "08006")
+	counter.Inc("b", "53300")
+
+	var out bytes.Buffer
+	counter.Write(&out)
+
+	expected := `# HELP rocky_test_total A test counter.
+# TYPE rocky_test_total counter
+rocky_test_total{backend="a",code="08006"} 2
+rocky_test_total{backend="b",code="53300"} 2
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+	if v := counter.Value("b", "53300"); v != 2 {
+		t.Errorf("expected 2, got %v", v)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	histogram := NewHistogramVec("rocky_wait_seconds", "Wait time.", []float64{0.1, 1}, "backend")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(5, "a")
+
+	var out bytes.Buffer
+	histogram.Write(&out)
+
+	expected := `# HELP rocky_wait_seconds Wait time.
+# TYPE rocky_wait_seconds histogram
+rocky_wait_seconds_bucket{backend="a",le="0.1"} 1
+rocky_wait_seconds_bucket{backend="a",le="1"} 2
+rocky_wait_seconds_bucket{backend="a",le="+Inf"} 3
+rocky_wait_seconds_sum{backend="a"} 5.55
+rocky_wait_seconds_count{backend="a"} 3
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(NewGaugeFunc("rocky_idle", "Idle \"connections\".", []string{"backend"}, func() []Sample {
+		return []Sample{{LabelValues: []string{`a"b`}, Value: 3}}
+	}))
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	if !strings.Contains(body, `rocky_idle{backend="a\"b"} 3`) {
+		t.Errorf("expected escaped label in\n%s", body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+}
@@ -3,6 +3,8 @@ package msgbuf
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"strings"
 )
 
@@ -34,9 +36,8 @@ func New(message []byte) *MessageBuffer {
 // and return them as an int32. If an error occurs then 0 and the error are
 // returned.
 func (message *MessageBuffer) ReadInt32() (int32, error) {
-	value := make([]byte, 4)
-
-	if _, err := message.buffer.Read(value); err != nil {
+	value, err := message.ReadBytes(4)
+	if err != nil {
 		return 0, err
 	}
 
@@ -49,9 +50,8 @@ func (message *MessageBuffer) ReadInt32() (int32, error) {
 // and return them as an int16. If an error occurs then 0 and the error are
 // returned.
 func (message *MessageBuffer) ReadInt16() (int16, error) {
-	value := make([]byte, 2)
-
-	if _, err := message.buffer.Read(value); err != nil {
+	value, err := message.ReadBytes(2)
+	if err != nil {
 		return 0, err
 	}
 	return int16(binary.BigEndian.Uint16(value)), nil
@@ -70,15 +70,32 @@ func (message *MessageBuffer) ReadByte() (byte, error) {
 //
 // This function will read and return the number of bytes as specified by count.
 func (message *MessageBuffer) ReadBytes(count int) ([]byte, error) {
+	if count < 0 {
+		return nil, errors.New("negative byte count")
+	}
+	// the count may come from the message itself, check it before
+	// allocating
+	if count > message.buffer.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
 	value := make([]byte, count)
 
-	if _, err := message.buffer.Read(value); err != nil {
+	n, err := message.buffer.Read(value)
+	if err != nil && count > 0 {
 		return nil, err
 	}
+	if n < count {
+		return nil, io.ErrUnexpectedEOF
+	}
 
 	return value, nil
 }
 
+// Remaining returns the number of bytes left to read in the message buffer.
+func (message *MessageBuffer) Remaining() int {
+	return message.buffer.Len()
+}
+
 // ReadString reads a string from the message buffer.
 //
 // This function will read and return the next Null terminated string from the
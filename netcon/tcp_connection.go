@@ -2,6 +2,7 @@ package netcon
 
 import (
 	"net"
+	"time"
 
 	"github.com/johnshiver/rocky/logger"
 )
@@ -28,33 +29,35 @@ func ReceiveTCP(connection net.Conn, bufferSize int) ([]byte, int, error) {
 	return buffer, length, err
 }
 
+// how long ConnectTCP waits for the connection to be established
+var connectTimeout = 10 * time.Second
+
 // ConnectTCP
 //
 // Given a host string, returns a tcp connection if successful, otherwise returns an error
 func ConnectTCP(host string) (net.Conn, error) {
-	// will fail if host doesnt resolve
-	getResolvedAddress(host)
-	connection, err := net.Dial("tcp", host)
-	if err != nil {
-		return nil, err
-	}
-	return connection, nil
+	return ConnectTCPTimeout(host, connectTimeout)
 }
 
-// getResolvedAddresses
-//
-// Takes a host string and returns a TCPAddr which can be used to
-// establish TCP connection with DialTCP
+// ConnectTCPTimeout
 //
-// tcpAddr := getResolvedAddress("127.0.0.1:8080")
+// Like ConnectTCP, giving up after timeout. Resolving the host counts
+// against the timeout, so an unresponsive DNS server or a host that drops
+// SYNs is an error like any other.
+func ConnectTCPTimeout(host string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.Dial("tcp", host)
+}
+
+// ListenTCP
 //
-func getResolvedAddress(host string) *net.TCPAddr {
-	var addr *net.TCPAddr
+// Given a host string, returns a listener bound to it, otherwise returns an error
+func ListenTCP(host string) (*net.TCPListener, error) {
 	addr, err := net.ResolveTCPAddr("tcp", host)
 	if err != nil {
-		pLogger.Fatal(err)
+		return nil, err
 	}
-	return addr
+	return net.ListenTCP("tcp", addr)
 }
 
 func GetListener(addr *net.TCPAddr) *net.TCPListener {
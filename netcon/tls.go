@@ -0,0 +1,131 @@
+package netcon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// NewServerTLSConfig
+//
+// Builds the TLS config for accepting client connections with the given
+// certificate and key. If caFile is set, client certificates are checked
+// against it according to clientAuth.
+func NewServerTLSConfig(certFile, keyFile, caFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   clientAuth,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+	}
+
+	return config, nil
+}
+
+// NewClientTLSConfig
+//
+// Builds the TLS config for connecting to host ("host:port"). With verifyCA
+// the server certificate must be signed by rootCertFile, verifyHost also
+// checks that it was issued for host. Without verifyCA the certificate is
+// accepted as is. certFile and keyFile, if set, are presented as the client
+// certificate.
+func NewClientTLSConfig(host string, verifyCA, verifyHost bool, rootCertFile, certFile, keyFile string) (*tls.Config, error) {
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if !verifyCA {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	if rootCertFile == "" {
+		return nil, errors.New("verifying the server certificate needs a root certificate")
+	}
+	roots, err := loadCertPool(rootCertFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = roots
+
+	if !verifyHost {
+		// crypto/tls always checks the host name, so the chain is verified
+		// by hand instead
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyChain checks that the first certificate chains up to roots through
+// the others
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// loadCertPool reads the PEM encoded certificates in path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
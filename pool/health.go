@@ -0,0 +1,248 @@
+package pool
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// ErrBackendDown is returned by Get while health checks find the backend
+// down, instead of making clients wait for a connection that cannot be made.
+var ErrBackendDown = errors.New("backend is down")
+
+// how long a health check may take before it counts as failed
+var healthCheckTimeout = 5 * time.Second
+
+// Role is a backend's place in replication, as seen by its health checks and
+// the parameters it reports to new connections.
+type Role string
+
+const (
+	// not reported by the backend nor checked, see
+	// config.BackendHostSetting.HealthCheckRole
+	RoleUnknown Role = ""
+	RolePrimary Role = "primary"
+	// in recovery, a hot standby
+	RoleReplica Role = "replica"
+)
+
+// Health is what a backend's health checks found. Backends are up until
+// checks say otherwise.
+type Health struct {
+	Up   bool
+	Role Role
+	// when the last check finished, zero if none has
+	CheckedAt time.Time
+	// checks in a row that passed and failed, one of them is 0
+	Successes int
+	Failures  int
+	// why the last failed check failed
+	LastError string
+	// how far a replica's replay is behind, 0 for a primary and negative
+	// while unknown
+	ReplicaLag time.Duration
+}
+
+// replicaLagQuery measures how far behind a replica is, see replicaLag. It
+// returns whether the replica is streaming WAL from the primary, then the
+// lag. The status of the WAL receiver is only shown to members of
+// pg_read_all_stats, for others it being there has to do.
+const replicaLagQuery = "select exists (select 1 from pg_stat_wal_receiver " +
+	"where coalesce(status, 'streaming') = 'streaming'), " +
+	"case when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0 " +
+	"else extract(epoch from now() - pg_last_xact_replay_timestamp()) end"
+
+// probeResult is what a passing health check learned.
+type probeResult struct {
+	role Role
+	// see Health.ReplicaLag
+	lag time.Duration
+}
+
+// Health returns the backend's health as of its last check.
+func (p *Pool) Health() Health {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+// checkHealth runs a health check every interval until the pool is closed.
+func (p *Pool) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			result, err := p.probe()
+			p.recordHealth(result, err, time.Now())
+		}
+	}
+}
+
+// probe opens a new connection to the backend and runs the health check
+// query on it. If asked for, the backend's role is found out as well, and how
+// far behind it is if it is a replica.
+func (p *Pool) probe() (probeResult, error) {
+	result := probeResult{role: RoleUnknown, lag: -1}
+	// the whole check, connecting included, must finish in time, a backend
+	// that does not answer at all is what it is there to catch
+	deadline := time.Now().Add(healthCheckTimeout)
+	conn, err := p.dial(deadline)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return result, err
+	}
+
+	if p.config.HealthCheckQuery != "" {
+		if _, err := conn.Exec(p.config.HealthCheckQuery); err != nil {
+			return result, err
+		}
+	}
+	if !p.config.HealthCheckRole {
+		return result, nil
+	}
+
+	inRecovery, err := queryValue(conn, "select pg_is_in_recovery()")
+	if err != nil {
+		return result, err
+	}
+	switch string(inRecovery) {
+	case "f":
+		result.role, result.lag = RolePrimary, 0
+		return result, nil
+	case "t":
+		result.role = RoleReplica
+	default:
+		return result, errors.New("unexpected pg_is_in_recovery() result")
+	}
+
+	row, err := queryRow(conn, replicaLagQuery, 2)
+	if err != nil {
+		return result, err
+	}
+	result.lag, err = replicaLag(row[0], row[1])
+	return result, err
+}
+
+// replicaLag returns the lag of a replica from the result of
+// replicaLagQuery, negative while it is unknown. A replica that has
+// replayed everything it received is not behind, however long ago the last
+// write on the primary was, but only as long as it is receiving: one that
+// lost its primary has nothing left to replay while falling further behind.
+// A replica that never replayed anything has no lag to report either.
+func replicaLag(streaming, lag []byte) (time.Duration, error) {
+	if string(streaming) != "t" || lag == nil {
+		return -1, nil
+	}
+	seconds, err := strconv.ParseFloat(string(lag), 64)
+	if err != nil {
+		return -1, errors.New("unexpected replication lag " + string(lag))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// queryValue runs a query returning a single value and returns it, nil for
+// NULL.
+func queryValue(conn *ServerConn, query string) ([]byte, error) {
+	row, err := queryRow(conn, query, 1)
+	if err != nil {
+		return nil, err
+	}
+	return row[0], nil
+}
+
+// queryRow runs a query returning a single row with that many columns and
+// returns their values, nil for NULL.
+func queryRow(conn *ServerConn, query string, columns int) ([][]byte, error) {
+	messages, err := conn.Exec(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		if protocol.GetMessageType(message) != protocol.DataRowMessageType {
+			continue
+		}
+		values, err := protocol.ParseDataRow(message)
+		if err != nil || len(values) != columns {
+			break
+		}
+		return values, nil
+	}
+	return nil, errors.New("no result for " + query)
+}
+
+// recordHealth updates the backend's health with the outcome of a check.
+// Going down closes the idle connections, they are unlikely to work.
+func (p *Pool) recordHealth(result probeResult, err error, now time.Time) {
+	p.mu.Lock()
+	health := &p.health
+	wasUp := health.Up
+	health.CheckedAt = now
+	if err == nil {
+		if result.role != RoleUnknown {
+			health.Role = result.role
+			health.ReplicaLag = result.lag
+		}
+		health.Successes++
+		health.Failures = 0
+		if health.Successes >= atLeastOne(p.config.HealthCheckRise) {
+			health.Up = true
+		}
+	} else {
+		health.LastError = err.Error()
+		health.Failures++
+		health.Successes = 0
+		if health.Failures >= atLeastOne(p.config.HealthCheckFall) {
+			health.Up = false
+		}
+	}
+	up := health.Up
+	p.mu.Unlock()
+
+	switch {
+	case wasUp && !up:
+		pLogger.Printf("pool %s: backend is down: %s\n", p.config.Name, err.Error())
+		p.CloseIdle()
+	case !wasUp && up:
+		pLogger.Printf("pool %s: backend is up\n", p.config.Name)
+	}
+}
+
+// roleFromParameters returns the role reported by the ParameterStatus
+// messages of a new connection. Servers since PostgreSQL 14 report
+// in_hot_standby, and a transaction_read_only server takes no writes either
+// way.
+func roleFromParameters(messages [][]byte) Role {
+	parameters := make(map[string]string)
+	for _, message := range messages {
+		if protocol.GetMessageType(message) != protocol.ParameterStatusMessageType {
+			continue
+		}
+		if name, value, err := protocol.ParseParameterStatus(message); err == nil {
+			parameters[name] = value
+		}
+	}
+
+	switch {
+	case parameters["in_hot_standby"] == "on", parameters["transaction_read_only"] == "on":
+		return RoleReplica
+	case parameters["in_hot_standby"] == "off", parameters["transaction_read_only"] == "off":
+		return RolePrimary
+	}
+	return RoleUnknown
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,131 @@
+package pool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+func TestHealthHysteresis(t *testing.T) {
+	p, _ := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 2, HealthCheckRise: 2, HealthCheckFall: 3})
+	defer p.Close()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(conn)
+
+	failed := errors.New("connection refused")
+	now := time.Now()
+	steps := []struct {
+		err error
+		up  bool
+	}{
+		{failed, true},
+		{failed, true},
+		// a success resets the count
+		{nil, true},
+		{failed, true},
+		{failed, true},
+		{failed, false},
+		{nil, false},
+		{failed, false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		p.recordHealth(probeResult{role: RolePrimary}, step.err, now)
+		if health := p.Health(); health.Up != step.up {
+			t.Fatalf("step %d: expected up to be %v, got %+v", i, step.up, health)
+		}
+
+		if i == 5 {
+			// going down closes the idle connections and fails Get
+			if stats := p.Stats(); stats.Idle != 0 {
+				t.Errorf("expected no idle connections once down, got %+v", stats)
+			}
+			if _, err := p.Get(); err != ErrBackendDown {
+				t.Errorf("expected ErrBackendDown, got %v", err)
+			}
+			if p.Healthy() {
+				t.Error("expected a down backend not to be healthy")
+			}
+		}
+	}
+
+	health := p.Health()
+	if health.Role != RolePrimary || health.LastError != failed.Error() || !health.CheckedAt.Equal(now) {
+		t.Errorf("unexpected health %+v", health)
+	}
+	if _, err := p.Get(); err != nil {
+		t.Errorf("expected Get to work once up again, got %v", err)
+	}
+}
+
+func TestHealthChecksRunPeriodically(t *testing.T) {
+	p, dialed := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 1})
+	defer p.Close()
+
+	// health checks open a connection of their own each time
+	go p.checkHealth(time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for dialed() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected health checks to dial, got %d dials", dialed())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplicaLag(t *testing.T) {
+	tests := []struct {
+		streaming []byte
+		lag       []byte
+		expected  time.Duration
+	}{
+		{[]byte("t"), []byte("0"), 0},
+		{[]byte("t"), []byte("1.5"), 1500 * time.Millisecond},
+		// never replayed anything
+		{[]byte("t"), nil, -1},
+		// lost its primary, caught up with what it received is not
+		// caught up
+		{[]byte("f"), []byte("0"), -1},
+		{[]byte("f"), []byte("30"), -1},
+	}
+	for _, test := range tests {
+		lag, err := replicaLag(test.streaming, test.lag)
+		if err != nil || lag != test.expected {
+			t.Errorf("replicaLag(%q, %q) = %v, %v, expected %v", test.streaming, test.lag, lag, err, test.expected)
+		}
+	}
+	if _, err := replicaLag([]byte("t"), []byte("soon")); err == nil {
+		t.Error("expected an error for a malformed lag")
+	}
+}
+
+func TestRoleFromParameters(t *testing.T) {
+	tests := []struct {
+		parameters map[string]string
+		role       Role
+	}{
+		{map[string]string{"server_version": "12.4"}, RoleUnknown},
+		{map[string]string{"transaction_read_only": "off"}, RolePrimary},
+		{map[string]string{"transaction_read_only": "on"}, RoleReplica},
+		{map[string]string{"in_hot_standby": "on", "transaction_read_only": "off"}, RoleReplica},
+		{map[string]string{"in_hot_standby": "off", "transaction_read_only": "off"}, RolePrimary},
+	}
+	for _, test := range tests {
+		var messages [][]byte
+		for name, value := range test.parameters {
+			messages = append(messages, protocol.NewParameterStatusMessage(name, value))
+		}
+		messages = append(messages, protocol.NewReadyForQueryMessage(protocol.TransactionIdle))
+		if role := roleFromParameters(messages); role != test.role {
+			t.Errorf("expected %v to be role %q, got %q", test.parameters, test.role, role)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package pool
+
+import (
+	"sort"
+	"strings"
+)
+
+// ApplyParameters gives the connection, which must be idle, the run-time
+// parameters a client asked for, by lowercase name. Parameters applied for an
+// earlier client that this one did not ask for are reset to the backend's
+// defaults, the ones from its startup message. Nothing is sent when the
+// connection already has the parameters, so a connection serving the same
+// client again costs no round trip.
+//
+// The values are applied with set_config rather than SET, which would parse
+// a list like "app, public" for search_path as a single name.
+func (conn *ServerConn) ApplyParameters(parameters map[string]string) error {
+	query := parameterQuery(conn.parameters, parameters)
+	if query == "" {
+		return nil
+	}
+	// the statements run as one transaction, so an error changes nothing
+	if err := conn.exec(query); err != nil {
+		return err
+	}
+	conn.parameters = make(map[string]string, len(parameters))
+	for name, value := range parameters {
+		conn.parameters[name] = value
+	}
+	return nil
+}
+
+// ParameterChanged records a parameter the backend reported changing while a
+// client was attached, so it is reset for the next client that did not ask
+// for it.
+func (conn *ServerConn) ParameterChanged(name, value string) {
+	if conn.parameters == nil {
+		conn.parameters = make(map[string]string)
+	}
+	conn.parameters[strings.ToLower(name)] = value
+}
+
+// parameterQuery returns the query turning the parameters current into
+// wanted, "" if they are the same.
+func parameterQuery(current, wanted map[string]string) string {
+	var statements []string
+	for _, name := range sortedNames(current) {
+		if _, ok := wanted[name]; !ok {
+			statements = append(statements, "RESET "+quoteIdentifier(name))
+		}
+	}
+	var settings []string
+	for _, name := range sortedNames(wanted) {
+		if value, ok := current[name]; !ok || value != wanted[name] {
+			settings = append(settings, "set_config("+quoteLiteral(name)+", "+quoteLiteral(wanted[name])+", false)")
+		}
+	}
+	if len(settings) > 0 {
+		statements = append(statements, "SELECT "+strings.Join(settings, ", "))
+	}
+	return strings.Join(statements, "; ")
+}
+
+func sortedNames(parameters map[string]string) []string {
+	var names []string
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
@@ -0,0 +1,27 @@
+package pool
+
+import "testing"
+
+func TestParameterQuery(t *testing.T) {
+	for _, test := range []struct {
+		current, wanted map[string]string
+		query           string
+	}{
+		{nil, nil, ""},
+		{map[string]string{"application_name": "a"}, map[string]string{"application_name": "a"}, ""},
+		{
+			nil,
+			map[string]string{"search_path": "app, public", "application_name": "it's"},
+			`SELECT set_config('application_name', 'it''s', false), set_config('search_path', 'app, public', false)`,
+		},
+		{
+			map[string]string{"application_name": "a", "timezone": "UTC"},
+			map[string]string{"application_name": "b"},
+			`RESET "timezone"; SELECT set_config('application_name', 'b', false)`,
+		},
+	} {
+		if query := parameterQuery(test.current, test.wanted); query != test.query {
+			t.Errorf("%v to %v: expected %q, got %q", test.current, test.wanted, test.query, query)
+		}
+	}
+}
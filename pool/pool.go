@@ -0,0 +1,816 @@
+package pool
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/logger"
+	"github.com/johnshiver/rocky/netcon"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+var pLogger *logger.PGLogger
+
+func init() {
+	pLogger = logger.GetLogInstance()
+}
+
+var (
+	// ErrPoolExhausted is returned by Get when no connection became
+	// available within the backend's PoolTimeout.
+	ErrPoolExhausted = errors.New("connection pool exhausted")
+
+	// ErrPoolClosed is returned by Get once the pool has been closed.
+	ErrPoolClosed = errors.New("connection pool closed")
+)
+
+// how often idle connections are checked against the pool settings
+var maintenanceInterval = time.Second
+
+// how long opening a backend connection may take, TLS and authentication
+// included
+var connectTimeout = 10 * time.Second
+
+// how long the reset and check queries may take before the connection is
+// given up on
+var serverQueryTimeout = 10 * time.Second
+
+// how long a backend counts as unhealthy after a connection to it failed,
+// see Healthy
+var unhealthyPeriod = 5 * time.Second
+
+// ServerConn is an authenticated connection to a backend, owned by a Pool.
+type ServerConn struct {
+	*protocol.Conn
+
+	// ParameterStatus, BackendKeyData and ReadyForQuery sent by the backend
+	// at the end of its startup. A client handed this connection needs them
+	// to finish its own startup.
+	StartupMessages [][]byte
+	// from the BackendKeyData among StartupMessages, used to cancel queries
+	Key protocol.BackendKey
+
+	// prepared statements created on the connection on behalf of clients
+	Statements *StatementCache
+	// run-time parameters set on the connection for clients, by lowercase
+	// name, see ApplyParameters
+	parameters map[string]string
+
+	createdAt time.Time
+	idleSince time.Time
+}
+
+func (conn *ServerConn) expired(maxLifetime time.Duration, now time.Time) bool {
+	return maxLifetime > 0 && now.Sub(conn.createdAt) >= maxLifetime
+}
+
+// exec runs a query of rocky's own on the connection, which must be idle and
+// stay idle afterwards.
+func (conn *ServerConn) exec(query string) error {
+	if err := conn.SetDeadline(time.Now().Add(serverQueryTimeout)); err != nil {
+		return err
+	}
+	messages, err := conn.Exec(query)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if protocol.GetMessageType(message) == protocol.CommandCompleteMessageType {
+			conn.CommandCompleted(message)
+		}
+	}
+	readyForQuery := messages[len(messages)-1]
+	if len(readyForQuery) < 6 || readyForQuery[5] != protocol.TransactionIdle {
+		return errors.New("query left the connection inside a transaction")
+	}
+	return nil
+}
+
+// CommandCompleted updates the connection's state after a command completed
+// on it, the prepared statements and parameters set for clients are
+// forgotten once the backend dropped them.
+func (conn *ServerConn) CommandCompleted(message []byte) {
+	switch protocol.GetCommandTag(message) {
+	case "DISCARD ALL":
+		conn.Statements.Clear()
+		conn.parameters = nil
+	case "DEALLOCATE ALL":
+		conn.Statements.Clear()
+	}
+}
+
+// Stats is a snapshot of a pool's connection counts.
+type Stats struct {
+	// connections handed out to clients
+	Active int
+	// connections open and waiting in the pool
+	Idle int
+	// clients blocked in Get
+	Waiting int
+}
+
+// ServerInfo describes one open backend connection, see Pool.Servers.
+type ServerInfo struct {
+	LocalAddr   string
+	RemoteAddr  string
+	Active      bool
+	TLS         bool
+	ConnectedAt time.Time
+}
+
+// limits are the settings of a pool that can change while it is in use, see
+// SetLimits.
+type limits struct {
+	capacity    int
+	minIdle     int
+	maxIdle     int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	poolTimeout time.Duration
+}
+
+func limitsOf(backendConfig *config.BackendHostSetting) limits {
+	return limits{
+		capacity:    backendConfig.Capacity,
+		minIdle:     backendConfig.MinIdle,
+		maxIdle:     backendConfig.MaxIdle,
+		idleTimeout: backendConfig.IdleTimeout,
+		maxLifetime: backendConfig.MaxLifetime,
+		poolTimeout: backendConfig.PoolTimeout,
+	}
+}
+
+// Pool keeps up to Capacity authenticated connections to a single backend and
+// shares them between client sessions.
+type Pool struct {
+	// the limits in config are only read when the pool is created, see
+	// limits
+	config         *config.BackendHostSetting
+	maxMessageSize int
+	tlsConfig      *tls.Config
+	// opens a started up connection, giving up at the deadline
+	dial func(deadline time.Time) (*ServerConn, error)
+
+	mu     sync.Mutex
+	limits limits
+	// startup messages of the newest connection, see StartupMessages
+	startupMessages [][]byte
+	idle            []*ServerConn
+	numOpen         int
+	// every connection that has been opened and not yet closed
+	conns   map[*ServerConn]struct{}
+	waiters []chan *ServerConn
+	// while paused Get only queues up, released is signalled whenever a
+	// connection comes back so Pause can wait for all of them
+	paused   bool
+	released *sync.Cond
+	// when opening a connection last failed, zero once one succeeds
+	failedAt time.Time
+	health   Health
+	closed   bool
+	done     chan struct{}
+}
+
+// New creates a pool for backendConfig and starts the goroutine that keeps it
+// within its idle limits. Connections read messages up to maxMessageSize
+// bytes, 0 uses the protocol default. An error is returned if the backend's
+// TLS settings cannot be loaded.
+func New(backendConfig *config.BackendHostSetting, maxMessageSize int) (*Pool, error) {
+	tlsConfig, err := newBackendTLSConfig(backendConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newPool(backendConfig, maxMessageSize, tlsConfig, nil), nil
+}
+
+// newBackendTLSConfig builds the TLS config for the backend's sslmode, nil
+// when TLS is disabled or no sslmode is set
+func newBackendTLSConfig(backendConfig *config.BackendHostSetting) (*tls.Config, error) {
+	var verifyCA, verifyHost bool
+	switch backendConfig.SSLMode {
+	case config.SSLDisable, "":
+		return nil, nil
+	case config.SSLVerifyFull:
+		verifyHost = true
+		verifyCA = true
+	case config.SSLVerifyCA:
+		verifyCA = true
+	}
+	return netcon.NewClientTLSConfig(backendConfig.Port, verifyCA, verifyHost,
+		backendConfig.SSLRootCert, backendConfig.SSLCert, backendConfig.SSLKey)
+}
+
+// newPool creates a pool that opens connections with dial, or connect if dial
+// is nil
+func newPool(backendConfig *config.BackendHostSetting, maxMessageSize int, tlsConfig *tls.Config,
+	dial func(deadline time.Time) (*ServerConn, error)) *Pool {
+	p := &Pool{
+		config:         backendConfig,
+		maxMessageSize: maxMessageSize,
+		tlsConfig:      tlsConfig,
+		dial:           dial,
+		limits:         limitsOf(backendConfig),
+		conns:          make(map[*ServerConn]struct{}),
+		done:           make(chan struct{}),
+		health:         Health{Up: true, ReplicaLag: -1},
+	}
+	p.released = sync.NewCond(&p.mu)
+	if p.dial == nil {
+		p.dial = p.connect
+	}
+	go p.maintain(maintenanceInterval)
+	if backendConfig.HealthCheckInterval > 0 {
+		go p.checkHealth(backendConfig.HealthCheckInterval)
+	}
+	return p
+}
+
+// Name is the name of the backend this pool connects to.
+func (p *Pool) Name() string {
+	return p.config.Name
+}
+
+// Config returns the settings of the backend this pool connects to, with the
+// limits last set by SetLimits.
+func (p *Pool) Config() *config.BackendHostSetting {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	backendConfig := *p.config
+	backendConfig.Capacity = p.limits.capacity
+	backendConfig.MinIdle = p.limits.minIdle
+	backendConfig.MaxIdle = p.limits.maxIdle
+	backendConfig.IdleTimeout = p.limits.idleTimeout
+	backendConfig.MaxLifetime = p.limits.maxLifetime
+	backendConfig.PoolTimeout = p.limits.poolTimeout
+	return &backendConfig
+}
+
+// SetLimits applies the Capacity, MinIdle, MaxIdle, IdleTimeout, MaxLifetime
+// and PoolTimeout of backendConfig to the pool while it is in use. Idle
+// connections above a lowered capacity or MaxIdle are closed right away,
+// connections handed out as they are returned. Clients waiting for a
+// connection are served if the capacity was raised.
+func (p *Pool) SetLimits(backendConfig *config.BackendHostSetting) {
+	p.mu.Lock()
+	p.limits = limitsOf(backendConfig)
+	p.serveWaitersLocked()
+
+	var excess []*ServerConn
+	for len(p.idle) > 0 && (p.numOpen > p.capacity() || len(p.idle) > p.maxIdle()) {
+		// the connections that have waited longest go first
+		conn := p.idle[0]
+		p.idle = p.idle[1:]
+		p.numOpen--
+		delete(p.conns, conn)
+		excess = append(excess, conn)
+	}
+	p.mu.Unlock()
+
+	closeAll(excess)
+}
+
+// Dial opens a new connection to the backend, negotiating TLS according to
+// its sslmode, without starting it up. The connection is not counted by the
+// pool and the caller must close it.
+func (p *Pool) Dial() (*protocol.Conn, error) {
+	backend, err := p.dialBy(time.Now().Add(connectTimeout))
+	if err != nil {
+		return nil, err
+	}
+	// what the caller does with the connection is up to it
+	if err := backend.SetDeadline(time.Time{}); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+// dialBy is Dial giving up at deadline, which is left set on the connection.
+// It is set before TLS is negotiated so a backend that stalls in the
+// handshake cannot hold the caller up either.
+func (p *Pool) dialBy(deadline time.Time) (*protocol.Conn, error) {
+	conn, err := netcon.ConnectTCPTimeout(p.config.Port, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if p.tlsConfig != nil {
+		var tlsConn net.Conn
+		tlsConn, err = protocol.StartTLS(conn, p.tlsConfig)
+		switch {
+		case err == protocol.ErrSSLNotAllowed && p.config.SSLMode == config.SSLPrefer:
+			// the backend stays on the plaintext connection
+		case err != nil:
+			conn.Close()
+			return nil, err
+		default:
+			conn = tlsConn
+		}
+	}
+
+	backend := protocol.NewConn(conn)
+	backend.SetMaxMessageSize(p.maxMessageSize)
+	return backend, nil
+}
+
+// connect opens and authenticates a new backend connection, giving up at
+// deadline
+func (p *Pool) connect(deadline time.Time) (*ServerConn, error) {
+	backend, err := p.dialBy(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := protocol.AuthenticateBackend(p.config, backend)
+	if err == nil {
+		err = backend.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.startupMessages = messages
+	if role := roleFromParameters(messages); role != RoleUnknown && role != p.health.Role {
+		// a replica's lag is learned by the next health check
+		p.health.Role = role
+		p.health.ReplicaLag = -1
+		if role == RolePrimary {
+			p.health.ReplicaLag = 0
+		}
+	}
+	p.mu.Unlock()
+
+	conn := &ServerConn{
+		Conn:            backend,
+		StartupMessages: messages,
+	}
+	for _, message := range messages {
+		if protocol.GetMessageType(message) == protocol.BackendKeyDataMessageType {
+			if conn.Key, err = protocol.ParseBackendKeyData(message); err != nil {
+				backend.Close()
+				return nil, err
+			}
+		}
+	}
+	conn.createdAt = time.Now()
+	conn.idleSince = conn.createdAt
+	return conn, nil
+}
+
+// Cancel asks the backend to cancel the query running on the connection
+// with the given key. The request is sent over a new connection, which the
+// backend closes without answering.
+func (p *Pool) Cancel(key protocol.BackendKey) error {
+	backend, err := p.Dial()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	if err := backend.WriteStartupMessage(protocol.NewCancelRequestMessage(key)); err != nil {
+		return err
+	}
+	return backend.Flush()
+}
+
+// StartupMessages returns the ParameterStatus, BackendKeyData and
+// ReadyForQuery messages of the most recently opened connection, or nil if
+// none has been opened yet. Clients can finish their startup with them
+// without waiting for a connection of their own.
+func (p *Pool) StartupMessages() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startupMessages
+}
+
+// Get hands out a connection, reusing an idle one when possible and opening a
+// new one while the pool is below capacity. Once capacity is reached, or while
+// the pool is paused, Get blocks until a connection is available, failing
+// with ErrPoolExhausted after PoolTimeout. It fails with ErrBackendDown right
+// away while health checks find the backend down.
+func (p *Pool) Get() (*ServerConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if !p.health.Up {
+		p.mu.Unlock()
+		return nil, ErrBackendDown
+	}
+
+	now := time.Now()
+	var expired []*ServerConn
+	for len(p.idle) > 0 && !p.paused {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if conn.expired(p.limits.maxLifetime, now) {
+			p.numOpen--
+			delete(p.conns, conn)
+			expired = append(expired, conn)
+			continue
+		}
+		p.mu.Unlock()
+		closeAll(expired)
+		if err := p.check(conn, now); err != nil {
+			pLogger.Printf("pool %s: server_check_query failed: %s\n", p.config.Name, err.Error())
+			p.Discard(conn)
+			return p.Get()
+		}
+		return conn, nil
+	}
+
+	if p.numOpen < p.capacity() && !p.paused {
+		p.numOpen++
+		p.mu.Unlock()
+		closeAll(expired)
+		return p.open()
+	}
+
+	wait := make(chan *ServerConn, 1)
+	p.waiters = append(p.waiters, wait)
+	poolTimeout := p.limits.poolTimeout
+	p.mu.Unlock()
+	closeAll(expired)
+
+	var timeout <-chan time.Time
+	if poolTimeout > 0 {
+		timer := time.NewTimer(poolTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case conn := <-wait:
+		return p.handoff(conn)
+	case <-timeout:
+		if p.removeWaiter(wait) {
+			return nil, ErrPoolExhausted
+		}
+		// a connection was handed over as the timer fired
+		return p.handoff(<-wait)
+	case <-p.done:
+		if p.removeWaiter(wait) {
+			return nil, ErrPoolClosed
+		}
+		return p.handoff(<-wait)
+	}
+}
+
+// handoff finishes a Get that waited. A nil connection means a slot was freed
+// and reserved for this caller, who has to open the connection itself.
+func (p *Pool) handoff(conn *ServerConn) (*ServerConn, error) {
+	if conn != nil {
+		return conn, nil
+	}
+	return p.open()
+}
+
+// open dials a connection for a slot that has already been counted in
+// numOpen, giving the slot up again if that fails
+func (p *Pool) open() (*ServerConn, error) {
+	conn, err := p.dial(time.Now().Add(connectTimeout))
+	if err != nil {
+		pLogger.Printf("pool %s: could not open connection: %s\n", p.config.Name, err.Error())
+		p.mu.Lock()
+		p.failedAt = time.Now()
+		p.releaseSlotLocked()
+		p.mu.Unlock()
+		return nil, err
+	}
+	conn.Statements = newStatementCache(p.config.MaxPreparedStatements)
+	p.mu.Lock()
+	p.failedAt = time.Time{}
+	p.conns[conn] = struct{}{}
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// check runs the check query on a connection that has been idle for longer
+// than the check delay.
+func (p *Pool) check(conn *ServerConn, now time.Time) error {
+	if p.config.ServerCheckQuery == "" || now.Sub(conn.idleSince) < p.config.ServerCheckDelay {
+		return nil
+	}
+	return conn.exec(p.config.ServerCheckQuery)
+}
+
+// resetQuery is the query clearing a returned connection, empty if none is
+// needed
+func (p *Pool) resetQuery() string {
+	mode := p.config.PoolMode
+	if mode != "" && mode != config.SessionPooling && !p.config.ServerResetQueryAlways {
+		return ""
+	}
+	return p.config.ServerResetQuery
+}
+
+// Put returns a connection to the pool. The caller must only return
+// connections that are idle at a message boundary, broken or dirty ones
+// should be given to Discard instead.
+//
+// If a reset query is configured it runs in the background and the
+// connection only becomes available once it succeeded.
+func (p *Pool) Put(conn *ServerConn) {
+	if conn.Err() != nil || conn.Buffered() > 0 || conn.SetDeadline(time.Time{}) != nil {
+		p.Discard(conn)
+		return
+	}
+
+	if query := p.resetQuery(); query != "" {
+		go func() {
+			if err := conn.exec(query); err != nil {
+				pLogger.Printf("pool %s: server_reset_query failed: %s\n", p.config.Name, err.Error())
+				p.Discard(conn)
+				return
+			}
+			p.release(conn)
+		}()
+		return
+	}
+	p.release(conn)
+}
+
+// release makes a returned connection available again
+func (p *Pool) release(conn *ServerConn) {
+	now := time.Now()
+	p.mu.Lock()
+	// the pool may have shrunk since the connection was handed out
+	if p.closed || conn.expired(p.limits.maxLifetime, now) || p.numOpen > p.capacity() {
+		p.mu.Unlock()
+		p.Discard(conn)
+		return
+	}
+
+	if len(p.waiters) > 0 && !p.paused {
+		wait := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		wait <- conn
+		return
+	}
+
+	if len(p.idle) >= p.maxIdle() {
+		p.mu.Unlock()
+		p.Discard(conn)
+		return
+	}
+
+	conn.idleSince = now
+	p.idle = append(p.idle, conn)
+	p.released.Broadcast()
+	p.mu.Unlock()
+}
+
+// Discard closes a connection handed out by Get and frees its slot.
+func (p *Pool) Discard(conn *ServerConn) {
+	conn.Close()
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.releaseSlotLocked()
+	p.mu.Unlock()
+}
+
+// releaseSlotLocked gives up one open connection slot, passing it straight to
+// the first waiter if there is one
+func (p *Pool) releaseSlotLocked() {
+	p.released.Broadcast()
+	if len(p.waiters) > 0 && !p.paused && p.numOpen <= p.capacity() {
+		wait := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		wait <- nil
+		return
+	}
+	p.numOpen--
+}
+
+func (p *Pool) removeWaiter(wait chan *ServerConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, w := range p.waiters {
+		if w == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Pause stops handing out connections and waits until every connection that
+// is handed out has been returned. Clients calling Get queue up until Resume.
+func (p *Pool) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+	for !p.closed && p.numOpen-len(p.idle) > 0 {
+		p.released.Wait()
+	}
+}
+
+// Resume undoes Pause, serving the clients that queued up in the meantime.
+func (p *Pool) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	p.serveWaitersLocked()
+}
+
+// serveWaitersLocked hands idle connections, or free slots, to the clients
+// waiting in Get. p.mu must be held.
+func (p *Pool) serveWaitersLocked() {
+	for len(p.waiters) > 0 && !p.paused {
+		var conn *ServerConn
+		if len(p.idle) > 0 {
+			conn = p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+		} else if p.numOpen < p.capacity() {
+			// a nil connection reserves the slot, the waiter opens it
+			p.numOpen++
+		} else {
+			return
+		}
+		wait := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		wait <- conn
+	}
+}
+
+// Healthy reports whether the backend should be given new clients. It is
+// not while health checks find it down, nor for a while after opening a
+// connection to it failed, after which it is given another try.
+func (p *Pool) Healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.closed && p.health.Up && (p.failedAt.IsZero() || time.Since(p.failedAt) >= unhealthyPeriod)
+}
+
+// Paused reports whether the pool is paused.
+func (p *Pool) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// CloseIdle closes every idle connection. Connections handed out are not
+// affected.
+func (p *Pool) CloseIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.numOpen -= len(idle)
+	for _, conn := range idle {
+		delete(p.conns, conn)
+	}
+	p.mu.Unlock()
+
+	closeAll(idle)
+}
+
+// Servers describes every open connection.
+func (p *Pool) Servers() []ServerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := make(map[*ServerConn]bool)
+	for _, conn := range p.idle {
+		idle[conn] = true
+	}
+
+	servers := make([]ServerInfo, 0, len(p.conns))
+	for conn := range p.conns {
+		_, isTLS := conn.Conn.Conn.(*tls.Conn)
+		servers = append(servers, ServerInfo{
+			LocalAddr:   conn.LocalAddr().String(),
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Active:      !idle[conn],
+			TLS:         isTLS,
+			ConnectedAt: conn.createdAt,
+		})
+	}
+	return servers
+}
+
+// Stats returns the pool's current connection counts.
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{
+		Active:  p.numOpen - len(p.idle),
+		Idle:    len(p.idle),
+		Waiting: len(p.waiters),
+	}
+}
+
+// Close closes every idle connection and fails pending and future calls to
+// Get. Connections still handed out are closed as they are returned.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.released.Broadcast()
+	p.mu.Unlock()
+
+	p.CloseIdle()
+}
+
+func (p *Pool) capacity() int {
+	if p.limits.capacity > 0 {
+		return p.limits.capacity
+	}
+	return config.DEFAULT_CAPACITY
+}
+
+func (p *Pool) maxIdle() int {
+	if p.limits.maxIdle > 0 && p.limits.maxIdle < p.capacity() {
+		return p.limits.maxIdle
+	}
+	return p.capacity()
+}
+
+// maintain periodically closes connections that have been idle or alive for
+// too long and opens new ones to keep MinIdle connections ready.
+func (p *Pool) maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.closeStale()
+			p.fillIdle()
+		}
+	}
+}
+
+func (p *Pool) closeStale() {
+	now := time.Now()
+
+	p.mu.Lock()
+	var keep, stale []*ServerConn
+	// idle is ordered oldest first, so the connections that have waited
+	// longest are the first to go
+	for i, conn := range p.idle {
+		aboveMin := len(keep)+len(p.idle)-i-1 >= p.limits.minIdle
+		idleTooLong := p.limits.idleTimeout > 0 && now.Sub(conn.idleSince) >= p.limits.idleTimeout
+		if conn.expired(p.limits.maxLifetime, now) || (aboveMin && idleTooLong) {
+			stale = append(stale, conn)
+			continue
+		}
+		keep = append(keep, conn)
+	}
+	p.idle = keep
+	p.numOpen -= len(stale)
+	for _, conn := range stale {
+		delete(p.conns, conn)
+	}
+	p.mu.Unlock()
+
+	closeAll(stale)
+}
+
+func (p *Pool) fillIdle() {
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle) >= p.limits.minIdle || p.numOpen >= p.capacity() {
+			p.mu.Unlock()
+			return
+		}
+		p.numOpen++
+		p.mu.Unlock()
+
+		conn, err := p.open()
+		if err != nil {
+			return
+		}
+		p.Put(conn)
+	}
+}
+
+func closeAll(conns []*ServerConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,305 @@
+package pool
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// newTestPool creates a pool whose connections are in-memory pipes, so no
+// backend is needed. The returned function reports how many were dialed.
+func newTestPool(backendConfig *config.BackendHostSetting) (*Pool, func() int) {
+	var mu sync.Mutex
+	dialed := 0
+
+	p := newPool(backendConfig, 0, nil, func(time.Time) (*ServerConn, error) {
+		mu.Lock()
+		dialed++
+		mu.Unlock()
+		client, _ := net.Pipe()
+		now := time.Now()
+		return &ServerConn{Conn: protocol.NewConn(client), createdAt: now, idleSince: now}, nil
+	})
+	return p, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dialed
+	}
+}
+
+func TestGetReusesIdleConnection(t *testing.T) {
+	p, dialed := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 2})
+	defer p.Close()
+
+	first, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(first)
+
+	second, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected idle connection to be reused")
+	}
+	if dialed() != 1 {
+		t.Errorf("expected 1 connection to be opened, got %d", dialed())
+	}
+}
+
+func TestGetTimesOutAtCapacity(t *testing.T) {
+	p, _ := newTestPool(&config.BackendHostSetting{
+		Name:        "test",
+		Capacity:    1,
+		PoolTimeout: 20 * time.Millisecond,
+	})
+	defer p.Close()
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(); err != ErrPoolExhausted {
+		t.Errorf("expected ErrPoolExhausted, got %v", err)
+	}
+	if stats := p.Stats(); stats.Waiting != 0 {
+		t.Errorf("expected waiter to be removed after timeout, got %d", stats.Waiting)
+	}
+}
+
+func TestPutHandsConnectionToWaiter(t *testing.T) {
+	p, _ := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 1})
+	defer p.Close()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan *ServerConn)
+	go func() {
+		waited, _ := p.Get()
+		got <- waited
+	}()
+
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Put(conn)
+
+	if waited := <-got; waited != conn {
+		t.Error("expected returned connection to be handed to the waiting client")
+	}
+}
+
+func TestDiscardFreesSlot(t *testing.T) {
+	p, dialed := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 1})
+	defer p.Close()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error)
+	go func() {
+		_, err := p.Get()
+		got <- err
+	}()
+
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Discard(conn)
+
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if dialed() != 2 {
+		t.Errorf("expected a new connection to be opened, got %d dials", dialed())
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	p, _ := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 1})
+	defer p.Close()
+
+	first, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *ServerConn)
+	go func() {
+		waited, _ := p.Get()
+		got <- waited
+	}()
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a raised capacity serves the waiting client right away
+	p.SetLimits(&config.BackendHostSetting{Capacity: 2})
+	second := <-got
+	if second == nil || second == first {
+		t.Fatal("expected a new connection for the waiting client")
+	}
+	if capacity := p.Config().Capacity; capacity != 2 {
+		t.Errorf("expected Config to report capacity 2, got %d", capacity)
+	}
+
+	// connections above a lowered capacity are closed as they come back
+	p.SetLimits(&config.BackendHostSetting{Capacity: 1})
+	p.Put(first)
+	p.Put(second)
+	if stats := p.Stats(); stats.Idle != 1 || stats.Active != 0 {
+		t.Errorf("expected 1 idle connection, got %+v", stats)
+	}
+}
+
+func TestPutAboveMaxIdleCloses(t *testing.T) {
+	p, _ := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 3, MaxIdle: 1})
+	defer p.Close()
+
+	first, _ := p.Get()
+	second, _ := p.Get()
+	p.Put(first)
+	p.Put(second)
+
+	if stats := p.Stats(); stats.Idle != 1 || stats.Active != 0 {
+		t.Errorf("expected 1 idle and 0 active connections, got %+v", stats)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	defer func(interval time.Duration) { maintenanceInterval = interval }(maintenanceInterval)
+	maintenanceInterval = 5 * time.Millisecond
+
+	p, dialed := newTestPool(&config.BackendHostSetting{
+		Name:        "test",
+		Capacity:    5,
+		MinIdle:     2,
+		IdleTimeout: 10 * time.Millisecond,
+	})
+	defer p.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().Idle < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("pool never filled to MinIdle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// idle connections above MinIdle are closed after IdleTimeout
+	a, _ := p.Get()
+	b, _ := p.Get()
+	c, _ := p.Get()
+	p.Put(a)
+	p.Put(b)
+	p.Put(c)
+
+	for p.Stats().Idle > 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connections were not closed, %+v", p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if dialed() < 3 {
+		t.Errorf("expected at least 3 connections to be opened, got %d", dialed())
+	}
+}
+
+func TestPauseWaitsForActiveConnections(t *testing.T) {
+	p, _ := newTestPool(&config.BackendHostSetting{Name: "test", Capacity: 2})
+	defer p.Close()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paused := make(chan struct{})
+	go func() {
+		p.Pause()
+		close(paused)
+	}()
+
+	got := make(chan *ServerConn)
+	go func() {
+		for !p.Paused() {
+			time.Sleep(time.Millisecond)
+		}
+		waited, _ := p.Get()
+		got <- waited
+	}()
+
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-paused:
+		t.Fatal("Pause returned while a connection was handed out")
+	default:
+	}
+
+	p.Put(conn)
+	<-paused
+	if stats := p.Stats(); stats.Idle != 1 || stats.Waiting != 1 {
+		t.Errorf("expected the connection to stay idle while paused, got %+v", stats)
+	}
+
+	p.Resume()
+	if waited := <-got; waited != conn {
+		t.Error("expected Resume to hand the idle connection to the waiting client")
+	}
+}
+
+func TestUnhealthyAfterFailedConnect(t *testing.T) {
+	defer func(period time.Duration) { unhealthyPeriod = period }(unhealthyPeriod)
+	unhealthyPeriod = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	failing := true
+	p := newPool(&config.BackendHostSetting{Name: "test", Capacity: 1}, 0, nil, func(time.Time) (*ServerConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return nil, errors.New("connection refused")
+		}
+		client, _ := net.Pipe()
+		now := time.Now()
+		return &ServerConn{Conn: protocol.NewConn(client), createdAt: now, idleSince: now}, nil
+	})
+	defer p.Close()
+
+	if !p.Healthy() {
+		t.Fatal("expected a new pool to be healthy")
+	}
+	if _, err := p.Get(); err == nil {
+		t.Fatal("expected Get to fail")
+	}
+	if p.Healthy() {
+		t.Error("expected the pool to be unhealthy after a failed connect")
+	}
+
+	// after a while the backend is given another try
+	time.Sleep(unhealthyPeriod)
+	if !p.Healthy() {
+		t.Error("expected the pool to be healthy again")
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Healthy() {
+		t.Error("expected the pool to be healthy after a successful connect")
+	}
+}
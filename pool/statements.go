@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"container/list"
+	"sync"
+)
+
+// StatementCache remembers which prepared statements exist on a backend
+// connection, so a statement prepared by one client can be recreated on
+// whichever connection serves it next. Past its capacity the least recently
+// used statement is evicted and must be closed on the backend by the caller.
+type StatementCache struct {
+	mu       sync.Mutex
+	capacity int
+	// front is the most recently used
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newStatementCache(capacity int) *StatementCache {
+	return &StatementCache{
+		capacity: capacity,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// Touch marks the statement as used and reports whether it is prepared on
+// the connection.
+func (c *StatementCache) Touch(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.elements[name]
+	if ok {
+		c.order.MoveToFront(element)
+	}
+	return ok
+}
+
+// Add records a statement prepared on the connection and returns the
+// statements evicted to make room for it.
+func (c *StatementCache) Add(name string) (evicted []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.elements[name]; ok {
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.elements[name] = c.order.PushFront(name)
+	for c.capacity > 0 && c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(string))
+		evicted = append(evicted, oldest.Value.(string))
+	}
+	return evicted
+}
+
+// Remove forgets a statement that was closed or failed to prepare.
+func (c *StatementCache) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.elements[name]; ok {
+		c.order.Remove(element)
+		delete(c.elements, name)
+	}
+}
+
+// Clear forgets every statement, after the backend dropped them all.
+func (c *StatementCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.elements = make(map[string]*list.Element)
+}
+
+// Len returns how many statements are prepared on the connection.
+func (c *StatementCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,34 @@
+package pool
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatementCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newStatementCache(2)
+	cache.Add("a")
+	cache.Add("b")
+	if !cache.Touch("a") {
+		t.Fatal("expected a to be cached")
+	}
+
+	if evicted := cache.Add("c"); !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Errorf("expected b to be evicted, got %v", evicted)
+	}
+	if cache.Touch("b") {
+		t.Error("expected b to be gone")
+	}
+	if evicted := cache.Add("a"); evicted != nil {
+		t.Errorf("expected adding a cached statement to evict nothing, got %v", evicted)
+	}
+
+	cache.Remove("a")
+	if cache.Len() != 1 {
+		t.Errorf("expected 1 statement, got %d", cache.Len())
+	}
+	cache.Clear()
+	if cache.Len() != 0 {
+		t.Errorf("expected no statements, got %d", cache.Len())
+	}
+}
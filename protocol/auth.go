@@ -2,15 +2,23 @@ package protocol
 
 import (
 	"crypto/md5"
+	"crypto/tls"
 	"fmt"
 	"io"
-	"net"
 
 	"github.com/johnshiver/rocky/config"
-	"github.com/johnshiver/rocky/netcon"
+	"github.com/johnshiver/rocky/msgbuf"
 )
 
-func handleAuthentication(backendConfig *config.BackendHostSetting, connection net.Conn, authType int32) bool {
+// handleAuthentication answers the authentication request the backend sent in
+// message. It returns the last message received from the backend and whether
+// the exchange ended with AuthenticationOk.
+func handleAuthentication(backendConfig *config.BackendHostSetting, connection *Conn, message []byte) ([]byte, bool) {
+	_, authType, err := parseStartUpResponse(message)
+	if err != nil {
+		pLogger.Printf("Error: %s\n", err.Error())
+		return message, false
+	}
 
 	switch authType {
 	case AuthenticationKerberosV5:
@@ -20,7 +28,13 @@ func handleAuthentication(backendConfig *config.BackendHostSetting, connection n
 		return handleAuthClearText(connection, backendConfig.Password)
 	case AuthenticationMD5:
 		pLogger.Println("Authenticating with MD5 password.")
-		return handleAuthMD5(connection, backendConfig.Username, backendConfig.Password)
+		// the 4 byte salt follows the auth type
+		if len(message) < 13 {
+			pLogger.Println("The backend sent a malformed AuthenticationMD5Password.")
+			return message, false
+		}
+		salt := string(message[9:13])
+		return handleAuthMD5(connection, backendConfig.Username, backendConfig.Password, salt)
 	case AuthenticationSCM:
 		pLogger.Println("SCM authentication is not currently supported.")
 	case AuthenticationGSS:
@@ -29,14 +43,17 @@ func handleAuthentication(backendConfig *config.BackendHostSetting, connection n
 		pLogger.Println("GSS authentication is not currently supported.")
 	case AuthenticationSSPI:
 		pLogger.Println("SSPI authentication is not currently supported.")
+	case AuthenticationSASL:
+		pLogger.Println("Authenticating with SASL.")
+		return handleAuthSASL(connection, backendConfig.Password, message)
 	case AuthenticationOk:
 		/* Covers the case where the authentication type is 'cert' or 'trust' */
-		return true
+		return message, true
 	default:
 		pLogger.Printf("Unknown authentication method: %d\n", authType)
 	}
 
-	return false
+	return message, false
 }
 
 func createMD5Password(username string, password string, salt string) string {
@@ -46,73 +63,268 @@ func createMD5Password(username string, password string, salt string) string {
 	return fmt.Sprintf("md5%x", md5.Sum([]byte(passwordString)))
 }
 
-func handleAuthMD5(connection net.Conn, username, password string) bool {
-	//  create a better salt
-	salt := "THIS_IS_MY_SALT"
+func handleAuthMD5(connection *Conn, username, password, salt string) ([]byte, bool) {
 	password = createMD5Password(username, password, salt)
 
 	passwordMessage := NewPasswordMessage(password)
 
-	_, err := netcon.SendTCP(connection, passwordMessage)
+	err := connection.Send(passwordMessage)
 
 	if err != nil {
 		pLogger.Println("Error sending password message to the backend.")
 		pLogger.Printf("Error: %s\n", err.Error())
+		return nil, false
 	}
 
-	message, _, err := netcon.ReceiveTCP(connection, 4096)
+	message, err := connection.ReadMessage()
 
 	if err != nil {
 		pLogger.Println("Error receiving authentication response from the backend.")
 		pLogger.Printf("Error: %s", err.Error())
+		return nil, false
 	}
 
-	return IsAuthenticationOk(message)
+	return message, IsAuthenticationOk(message)
 }
 
-func handleAuthClearText(connection net.Conn, password string) bool {
+func handleAuthClearText(connection *Conn, password string) ([]byte, bool) {
 	passwordMessage := NewPasswordMessage(password)
 
-	_, err := connection.Write(passwordMessage)
+	err := connection.Send(passwordMessage)
 
 	if err != nil {
 		pLogger.Println("Error sending clear text password message to the backend.")
 		pLogger.Printf("Error: %s", err.Error())
+		return nil, false
 	}
 
-	response := make([]byte, 4096)
-	_, err = connection.Read(response)
+	response, err := connection.ReadMessage()
 
 	if err != nil {
 		pLogger.Println("Error receiving clear text authentication response.")
 		pLogger.Printf("Error: %s", err.Error())
+		return nil, false
+	}
+
+	return response, IsAuthenticationOk(response)
+}
+
+// handleAuthSASL runs a SCRAM-SHA-256 exchange for the AuthenticationSASL
+// request in message. SCRAM-SHA-256-PLUS is used when the connection is TLS
+// and the backend offers it.
+func handleAuthSASL(connection *Conn, password string, message []byte) ([]byte, bool) {
+	mechanisms := parseSASLMechanisms(message)
+
+	var bindingData []byte
+	if tlsConn, ok := connection.Conn.(*tls.Conn); ok {
+		data, err := tlsServerEndPoint(tlsConn.ConnectionState())
+		if err != nil {
+			pLogger.Printf("Channel binding unavailable: %s\n", err.Error())
+		}
+		bindingData = data
+	}
+
+	mechanism, gs2Header, bindingData := chooseSASLMechanism(mechanisms, bindingData)
+	if mechanism == "" {
+		pLogger.Println("The backend did not offer a supported SASL mechanism.")
+		return message, false
+	}
+
+	client, err := newSCRAMClient(password, gs2Header, bindingData)
+	if err != nil {
+		pLogger.Printf("Error: %s\n", err.Error())
+		return message, false
+	}
+
+	err = connection.Send(NewSASLInitialResponseMessage(mechanism, []byte(client.clientFirstMessage())))
+	if err != nil {
+		pLogger.Println("Error sending SASL initial response to the backend.")
+		pLogger.Printf("Error: %s\n", err.Error())
+		return nil, false
+	}
+
+	message, ok := readSASLMessage(connection, AuthenticationSASLContinue)
+	if !ok {
+		return message, false
+	}
+
+	clientFinal, err := client.clientFinalMessage(string(message[9:]))
+	if err != nil {
+		pLogger.Printf("Error: %s\n", err.Error())
+		return message, false
+	}
+
+	if err := connection.Send(NewSASLResponseMessage([]byte(clientFinal))); err != nil {
+		pLogger.Println("Error sending SASL response to the backend.")
+		pLogger.Printf("Error: %s\n", err.Error())
+		return nil, false
+	}
+
+	message, ok = readSASLMessage(connection, AuthenticationSASLFinal)
+	if !ok {
+		return message, false
+	}
+
+	if err := client.verifyServerFinal(string(message[9:])); err != nil {
+		pLogger.Printf("Error: %s\n", err.Error())
+		return message, false
 	}
 
-	return IsAuthenticationOk(response)
+	message, err = connection.ReadMessage()
+	if err != nil {
+		pLogger.Println("Error receiving authentication response from the backend.")
+		pLogger.Printf("Error: %s\n", err.Error())
+		return nil, false
+	}
+
+	return message, IsAuthenticationOk(message)
+}
+
+// chooseSASLMechanism picks the mechanism to answer an AuthenticationSASL
+// offering mechanisms with, and the GS2 header and channel binding data to
+// use with it. bindingData is nil when the channel cannot be bound. The
+// mechanism is "" if none of those offered is supported.
+func chooseSASLMechanism(mechanisms map[string]bool, bindingData []byte) (string, string, []byte) {
+	switch {
+	case bindingData != nil && mechanisms[SCRAMSHA256Plus]:
+		return SCRAMSHA256Plus, "p=tls-server-end-point,,", bindingData
+	case bindingData != nil && mechanisms[SCRAMSHA256]:
+		// "y" tells the server we could have bound the channel, which
+		// detects a downgrade from -PLUS. Saying so without binding data
+		// would fail logins to a server that offers -PLUS.
+		return SCRAMSHA256, "y,,", nil
+	case mechanisms[SCRAMSHA256]:
+		return SCRAMSHA256, "n,,", nil
+	}
+	return "", "", nil
+}
+
+// readSASLMessage reads the next message of a SASL exchange and checks it is
+// the expected authentication request. The backend sends an ErrorResponse
+// instead if it rejected the last message.
+func readSASLMessage(connection *Conn, authType int32) ([]byte, bool) {
+	message, err := connection.ReadMessage()
+	if err != nil {
+		pLogger.Println("Error receiving SASL message from the backend.")
+		pLogger.Printf("Error: %s\n", err.Error())
+		return nil, false
+	}
+
+	_, gotType, err := parseStartUpResponse(message)
+	if err != nil || gotType != authType {
+		pLogger.Printf("Expected SASL authentication type %d from the backend.\n", authType)
+		return message, false
+	}
+	return message, true
+}
+
+// parseSASLMechanisms reads the mechanism names from an AuthenticationSASL
+// message. The list ends with an empty name.
+func parseSASLMechanisms(message []byte) map[string]bool {
+	mechanisms := make(map[string]bool)
+
+	buffer := msgbuf.New(message[9:])
+	for {
+		mechanism, err := buffer.ReadString()
+		if err != nil || mechanism == "" {
+			return mechanisms
+		}
+		mechanisms[mechanism] = true
+	}
+}
+
+// withoutChannelBinding returns message, with SCRAM-SHA-256-PLUS left out
+// if it is an AuthenticationSASL. The backend's channel is not the client's,
+// so a client binding to its own connection to rocky could not log in. A
+// client on TLS that answers with "y", saying it could have bound the
+// channel, is still taken for a downgrade by a backend offering -PLUS, it has
+// to be told not to use channel binding.
+func withoutChannelBinding(message []byte) []byte {
+	if _, authType, err := parseStartUpResponse(message); err != nil || authType != AuthenticationSASL {
+		return message
+	}
+	var mechanisms []string
+	buffer := msgbuf.New(message[9:])
+	for {
+		mechanism, err := buffer.ReadString()
+		if err != nil || mechanism == "" {
+			break
+		}
+		if mechanism != SCRAMSHA256Plus {
+			mechanisms = append(mechanisms, mechanism)
+		}
+	}
+	return NewAuthenticationSASLMessage(mechanisms)
+}
+
+// AuthenticateBackend logs in to a backend over connection using the
+// credentials and options from backendConfig.
+//
+// After AuthenticationOk the backend finishes its startup with ParameterStatus,
+// BackendKeyData and ReadyForQuery. Those messages are read and returned, in
+// order, so the caller can pass them on to the client.
+func AuthenticateBackend(backendConfig *config.BackendHostSetting, connection *Conn) ([][]byte, error) {
+	startupMessage := NewStartupMessage(backendConfig.Username, backendConfig.Database, backendConfig.Options)
+
+	if err := connection.WriteStartupMessage(startupMessage); err != nil {
+		return nil, err
+	}
+	if err := connection.Flush(); err != nil {
+		return nil, err
+	}
+
+	message, err := connection.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if reply, ok := handleAuthentication(backendConfig, connection, message); !ok {
+		if backendErr, err := ParseErrorResponse(reply); err == nil {
+			return nil, fmt.Errorf("authentication with backend %s failed: %s", backendConfig.Name, backendErr)
+		}
+		return nil, fmt.Errorf("authentication with backend %s failed", backendConfig.Name)
+	}
+
+	var messages [][]byte
+	for {
+		message, err := connection.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if GetMessageType(message) == ErrorMessageType {
+			if backendErr, err := ParseErrorResponse(message); err == nil {
+				return nil, fmt.Errorf("backend %s failed during startup: %s", backendConfig.Name, backendErr)
+			}
+			return nil, fmt.Errorf("backend %s failed during startup", backendConfig.Name)
+		}
+		messages = append(messages, message)
+		if GetMessageType(message) == ReadyForQueryMessageType {
+			return messages, nil
+		}
+	}
 }
 
 // This is just meant for a one off authentication of the client after it initially connects to pg_borg
 // That is why the backend connection is closed at the end
 // NOTE: im not sure it makes sense for the client to ever connect directly to the backend, but for now
 // this works fine
-func AuthenticateClient(client net.Conn, backend_host_port string, message []byte, length int) (bool, error) {
+//
+// backend must be a fresh connection, see Pool.Dial in the pool package, and is closed on return
+func AuthenticateClient(client *Conn, backend *Conn, startupMessage []byte) (bool, error) {
 	var err error
+	defer backend.Close()
+	backend_host_port := backend.RemoteAddr().String()
 
-	backend, err := netcon.ConnectTCP(backend_host_port)
-
+	pLogger.Printf("client auth: relay startup message to %s\n", backend_host_port)
+	if err = backend.WriteStartupMessage(startupMessage); err == nil {
+		err = backend.Flush()
+	}
 	if err != nil {
-		pLogger.Printf("Error connecting to %s\n", backend_host_port)
-		pLogger.Printf("Error %s", err.Error())
 		return false, err
 	}
 
-	defer backend.Close()
-
-	pLogger.Printf("client auth: relay startup message to %s\n", backend_host_port)
-	_, err = backend.Write(message[:length])
-
 	pLogger.Printf("client auth: receiving startup response from %s\n", backend_host_port)
-	message, length, err = netcon.ReceiveTCP(backend, 4096)
+	message, err := backend.ReadMessage()
 
 	if err != nil {
 		pLogger.Println("An error occurred receiving startup response.")
@@ -127,8 +339,10 @@ func AuthenticateClient(client net.Conn, backend_host_port string, message []byt
 	messageType := GetMessageType(message)
 
 	for !IsAuthenticationOk(message) && (messageType != ErrorMessageType) {
-		netcon.SendTCP(client, message[:length])
-		message, length, err = netcon.ReceiveTCP(client, 4096)
+		if err = client.Send(withoutChannelBinding(message)); err != nil {
+			return false, err
+		}
+		message, err = client.ReadMessage()
 
 		/*
 		  Must check that the client has not closed the connection.  This in
@@ -146,10 +360,18 @@ func AuthenticateClient(client net.Conn, backend_host_port string, message []byt
 				"was 'password', then this behavior is expected.")
 			return false, err
 		}
+		if err != nil {
+			return false, err
+		}
 
-		netcon.SendTCP(backend, message[:length])
+		if err = backend.Send(message); err != nil {
+			return false, err
+		}
 
-		message, length, err = netcon.ReceiveTCP(backend, 4096)
+		message, err = backend.ReadMessage()
+		if err != nil {
+			return false, err
+		}
 		messageType = GetMessageType(message)
 	}
 
@@ -162,8 +384,10 @@ func AuthenticateClient(client net.Conn, backend_host_port string, message []byt
 	if IsAuthenticationOk(message) {
 		pLogger.Println("client auth: all good!")
 		termMsg := NewTerminateMessage()
-		netcon.SendTCP(backend, termMsg)
-		netcon.SendTCP(client, message[:length])
+		backend.Send(termMsg)
+		// only relay AuthenticationOk, the rest of the startup comes from
+		// the backend connection the session ends up using
+		client.Send(message)
 		return true, nil
 	}
 
@@ -171,7 +395,7 @@ func AuthenticateClient(client net.Conn, backend_host_port string, message []byt
 		pLogger.Println("Error occurred on client startup.")
 	}
 
-	netcon.SendTCP(client, message[:length])
+	client.Send(message)
 
 	return false, err
 }
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/johnshiver/rocky/msgbuf"
+)
+
+/*   Query cancellation --------------------------------------------------------------------------
+
+Reference: https://www.postgresql.org/docs/current/protocol-flow.html#PROTOCOL-FLOW-CANCELING-REQUESTS
+
+During startup the server sends BackendKeyData with its process ID and a secret key. To cancel
+the query a connection is running, a client opens a new connection and sends a CancelRequest
+with that key in place of a startup message. The server answers nothing and closes the
+connection, so a client cannot tell whether the cancel had any effect.
+
+*/
+
+// BackendKey identifies a server connection for a CancelRequest.
+type BackendKey struct {
+	ProcessID int32
+	SecretKey int32
+}
+
+// NewBackendKeyDataMessage creates the BackendKeyData message sent during
+// startup.
+func NewBackendKeyDataMessage(key BackendKey) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(BackendKeyDataMessageType)
+	message.WriteInt32(0)
+	message.WriteInt32(key.ProcessID)
+	message.WriteInt32(key.SecretKey)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// ParseBackendKeyData reads the key from a BackendKeyData message.
+func ParseBackendKeyData(message []byte) (BackendKey, error) {
+	if len(message) != 13 || GetMessageType(message) != BackendKeyDataMessageType {
+		return BackendKey{}, errors.New("malformed BackendKeyData message")
+	}
+	return readBackendKey(message[5:])
+}
+
+// IsCancelRequest reports whether an untyped startup-phase message is a
+// CancelRequest
+func IsCancelRequest(message []byte) bool {
+	return len(message) == 16 && GetVersion(message) == CancelRequestCode
+}
+
+// NewCancelRequestMessage creates the untyped message cancelling the query
+// running on the server connection identified by key.
+func NewCancelRequestMessage(key BackendKey) []byte {
+	message := msgbuf.New([]byte{})
+	message.WriteInt32(16)
+	message.WriteInt32(CancelRequestCode)
+	message.WriteInt32(key.ProcessID)
+	message.WriteInt32(key.SecretKey)
+	return message.Bytes()
+}
+
+// ParseCancelRequest reads the key from a CancelRequest message.
+func ParseCancelRequest(message []byte) (BackendKey, error) {
+	if !IsCancelRequest(message) {
+		return BackendKey{}, errors.New("malformed CancelRequest message")
+	}
+	return readBackendKey(message[8:])
+}
+
+func readBackendKey(body []byte) (BackendKey, error) {
+	buffer := msgbuf.New(body)
+	processID, err := buffer.ReadInt32()
+	if err != nil {
+		return BackendKey{}, err
+	}
+	secretKey, err := buffer.ReadInt32()
+	if err != nil {
+		return BackendKey{}, err
+	}
+	return BackendKey{ProcessID: processID, SecretKey: secretKey}, nil
+}
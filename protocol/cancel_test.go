@@ -0,0 +1,27 @@
+package protocol
+
+import "testing"
+
+func TestCancelRequestRoundTrip(t *testing.T) {
+	key := BackendKey{ProcessID: 4242, SecretKey: -17}
+
+	message := NewCancelRequestMessage(key)
+	if !IsCancelRequest(message) || IsSSLRequest(message) {
+		t.Fatal("expected a CancelRequest")
+	}
+	parsed, err := ParseCancelRequest(message)
+	if err != nil || parsed != key {
+		t.Errorf("expected %+v, got %+v (%v)", key, parsed, err)
+	}
+
+	parsed, err = ParseBackendKeyData(NewBackendKeyDataMessage(key))
+	if err != nil || parsed != key {
+		t.Errorf("expected %+v, got %+v (%v)", key, parsed, err)
+	}
+	if _, err := ParseBackendKeyData(NewBackendKeyDataMessage(key)[:9]); err == nil {
+		t.Error("expected an error for a truncated BackendKeyData")
+	}
+	if IsCancelRequest(NewSSLRequestMessage()) {
+		t.Error("an SSLRequest is not a CancelRequest")
+	}
+}
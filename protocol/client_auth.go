@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/msgbuf"
+)
+
+const (
+	// iterations used when a SCRAM verifier is derived from a plaintext
+	// userlist password, postgres uses the same default
+	scramDefaultIterations = 4096
+	scramSaltLength        = 16
+)
+
+// ErrClientAuthFailed is returned when a client gives the wrong password or
+// is not in the userlist. The client has already been sent an ErrorResponse.
+var ErrClientAuthFailed = errors.New("client authentication failed")
+
+// AuthenticateLocalClient authenticates a client against users without
+// involving a backend.
+//
+// md5 falls back to SCRAM for users whose secret is a SCRAM verifier. trust
+// skips the password but the user still has to be in the userlist.
+//
+// A user that is not in the userlist is still asked for a password and only
+// turned away once the exchange is over, so a client cannot tell unknown
+// users from wrong passwords.
+//
+// On success the client is sent AuthenticationOk, on failure it is sent an
+// ErrorResponse and ErrClientAuthFailed is returned.
+func AuthenticateLocalClient(client *Conn, method config.AuthType, users Userlist, username string) error {
+	var err error
+	secret, known := users[username]
+	if !known && method != config.AuthTrust {
+		if secret, err = unknownUserSecret(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case method == config.AuthTrust:
+		err = nil
+	case method == config.AuthMD5 && !strings.HasPrefix(secret, SCRAMSHA256+"$"):
+		err = authenticateClientMD5(client, username, secret)
+	case method == config.AuthMD5 || method == config.AuthSCRAM:
+		err = authenticateClientSCRAM(client, secret)
+	default:
+		err = fmt.Errorf("unsupported client auth method %q", method)
+	}
+	if err == nil && !known {
+		err = fmt.Errorf("user %q is not in the userlist", username)
+	}
+
+	if err == io.EOF {
+		// psql hangs up to prompt for a password and then reconnects
+		return err
+	}
+	if err != nil {
+		pLogger.Printf("client auth: %s\n", err.Error())
+		client.Send(NewErrorResponse(SeverityFatal, SQLStateInvalidPassword,
+			fmt.Sprintf("password authentication failed for user \"%s\"", username)))
+		return ErrClientAuthFailed
+	}
+
+	return client.Send(NewAuthenticationOkMessage())
+}
+
+// authenticateClientMD5 sends AuthenticationMD5Password with a random salt
+// and checks the hashed password the client answers with.
+func authenticateClientMD5(client *Conn, username, secret string) error {
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	if err := client.Send(NewAuthenticationMD5Message(salt)); err != nil {
+		return err
+	}
+
+	password, err := readPasswordMessage(client)
+	if err != nil {
+		return err
+	}
+
+	var expected string
+	if isMD5Secret(secret) {
+		// the secret is already md5(password + username)
+		expected = fmt.Sprintf("md5%x", md5.Sum([]byte(secret[3:]+string(salt))))
+	} else {
+		expected = createMD5Password(username, secret, string(salt))
+	}
+
+	if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return fmt.Errorf("wrong md5 password for user %q", username)
+	}
+	return nil
+}
+
+// authenticateClientSCRAM runs the server side of a SCRAM-SHA-256 exchange.
+// Channel binding is not offered, so clients must send a "n" or "y" header.
+func authenticateClientSCRAM(client *Conn, secret string) error {
+	verifier, ok := parseSCRAMSecret(secret)
+	if !ok {
+		if strings.HasPrefix(secret, SCRAMSHA256+"$") {
+			return errors.New("malformed SCRAM verifier in userlist")
+		}
+		if isMD5Secret(secret) {
+			return errors.New("SCRAM authentication needs a plaintext password or SCRAM verifier")
+		}
+		var err error
+		if verifier, err = newSCRAMSecret(secret); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Send(NewAuthenticationSASLMessage([]string{SCRAMSHA256})); err != nil {
+		return err
+	}
+
+	message, err := readSASLResponse(client)
+	if err != nil {
+		return err
+	}
+	buffer := msgbuf.New(message[5:])
+	mechanism, err := buffer.ReadString()
+	if err != nil || mechanism != SCRAMSHA256 {
+		return fmt.Errorf("client chose unsupported SASL mechanism %q", mechanism)
+	}
+	// -1 means no initial response, which SCRAM needs
+	length, err := buffer.ReadInt32()
+	if err != nil || length < 0 || int(length) > buffer.Remaining() {
+		return errors.New("malformed SASLInitialResponse")
+	}
+	clientFirst, err := buffer.ReadBytes(int(length))
+	if err != nil {
+		return errors.New("malformed SASLInitialResponse")
+	}
+
+	// gs2-header, then client-first-message-bare
+	parts := strings.SplitN(string(clientFirst), ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") || parts[1] != "" {
+		return errors.New("client requested unsupported SCRAM channel binding")
+	}
+	gs2Header := parts[0] + ",,"
+	clientFirstBare := parts[2]
+
+	clientNonce := parseSCRAMAttributes(clientFirstBare)["r"]
+	if clientNonce == "" {
+		return errors.New("client sent no SCRAM nonce")
+	}
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	nonce := clientNonce + serverNonce
+
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d",
+		nonce, base64.StdEncoding.EncodeToString(verifier.salt), verifier.iterations)
+	if err := client.Send(NewAuthenticationSASLContinueMessage([]byte(serverFirst))); err != nil {
+		return err
+	}
+
+	message, err = readSASLResponse(client)
+	if err != nil {
+		return err
+	}
+	clientFinal := string(message[5:])
+
+	proofAt := strings.LastIndex(clientFinal, ",p=")
+	if proofAt < 0 {
+		return errors.New("client sent no SCRAM proof")
+	}
+	clientFinalWithoutProof := clientFinal[:proofAt]
+	attributes := parseSCRAMAttributes(clientFinal)
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(gs2Header)) {
+		return errors.New("SCRAM channel binding does not match")
+	}
+	if attributes["r"] != nonce {
+		return errors.New("SCRAM nonce does not match")
+	}
+	proof, err := base64.StdEncoding.DecodeString(attributes["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return errors.New("malformed SCRAM proof")
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientSignature := scramHMAC(verifier.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], verifier.storedKey) {
+		return errors.New("wrong SCRAM password")
+	}
+
+	serverSignature := scramHMAC(verifier.serverKey, authMessage)
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+	return client.Send(NewAuthenticationSASLFinalMessage([]byte(serverFinal)))
+}
+
+// unknownUserSecret returns a random plaintext password to run the exchange
+// against for a user that is not in the userlist. Being plaintext, it gets a
+// fresh salt and the default iterations with SCRAM, like any user with a
+// plaintext password.
+func unknownUserSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// newSCRAMSecret derives a SCRAM verifier from a plaintext password.
+func newSCRAMSecret(password string) (*scramSecret, error) {
+	salt := make([]byte, scramSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, scramDefaultIterations)
+	storedKey := sha256.Sum256(scramHMAC(saltedPassword, "Client Key"))
+	return &scramSecret{
+		iterations: scramDefaultIterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(saltedPassword, "Server Key"),
+	}, nil
+}
+
+// readPasswordMessage reads a PasswordMessage and returns the password.
+func readPasswordMessage(client *Conn) (string, error) {
+	message, err := readSASLResponse(client)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(message[5:]), "\x00"), nil
+}
+
+// readSASLResponse reads the client's next authentication message. Password,
+// SASLInitialResponse and SASLResponse messages all use the same type.
+func readSASLResponse(client *Conn) ([]byte, error) {
+	message, err := client.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if GetMessageType(message) != PasswordMessageType {
+		return nil, fmt.Errorf("expected password message, got %q", GetMessageType(message))
+	}
+	return message, nil
+}
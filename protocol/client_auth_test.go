@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/johnshiver/rocky/config"
+)
+
+// authenticatePair runs AuthenticateLocalClient against the backend side of
+// rocky's own auth code, logging in as user with password.
+func authenticatePair(t *testing.T, method config.AuthType, users Userlist, user, password string) (bool, error) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- AuthenticateLocalClient(NewConn(serverSide), method, users, user)
+	}()
+
+	client := NewConn(clientSide)
+	message, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendConfig := &config.BackendHostSetting{Username: user, Password: password}
+	_, ok := handleAuthentication(backendConfig, client, message)
+
+	return ok, <-errc
+}
+
+func scramVerifier(t *testing.T, password string) string {
+	secret, err := newSCRAMSecret(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", secret.iterations,
+		base64.StdEncoding.EncodeToString(secret.salt),
+		base64.StdEncoding.EncodeToString(secret.storedKey),
+		base64.StdEncoding.EncodeToString(secret.serverKey))
+}
+
+func TestAuthenticateLocalClient(t *testing.T) {
+	users := Userlist{
+		"plain": "secret",
+		"md5":   fmt.Sprintf("md5%x", md5.Sum([]byte("secretmd5"))),
+		"scram": scramVerifier(t, "secret"),
+	}
+
+	tests := []struct {
+		method   config.AuthType
+		user     string
+		password string
+		ok       bool
+	}{
+		{config.AuthMD5, "plain", "secret", true},
+		{config.AuthMD5, "plain", "wrong", false},
+		{config.AuthMD5, "md5", "secret", true},
+		{config.AuthMD5, "md5", "wrong", false},
+		{config.AuthMD5, "scram", "secret", true},
+		{config.AuthSCRAM, "plain", "secret", true},
+		{config.AuthSCRAM, "plain", "wrong", false},
+		{config.AuthSCRAM, "scram", "secret", true},
+		{config.AuthSCRAM, "scram", "wrong", false},
+		{config.AuthSCRAM, "md5", "secret", false},
+		{config.AuthTrust, "plain", "", true},
+		{config.AuthTrust, "nobody", "", false},
+		{config.AuthMD5, "nobody", "secret", false},
+		{config.AuthSCRAM, "nobody", "secret", false},
+	}
+
+	for _, test := range tests {
+		ok, err := authenticatePair(t, test.method, users, test.user, test.password)
+		if ok != test.ok {
+			t.Errorf("%s as %s with %q: expected ok=%v", test.method, test.user, test.password, test.ok)
+		}
+		if test.ok && err != nil {
+			t.Errorf("%s as %s: %s", test.method, test.user, err)
+		}
+		if !test.ok && err != ErrClientAuthFailed {
+			t.Errorf("%s as %s: expected ErrClientAuthFailed, got %v", test.method, test.user, err)
+		}
+	}
+}
+
+func TestUnknownUserAskedForPassword(t *testing.T) {
+	users := Userlist{"plain": "secret"}
+
+	for _, test := range []struct {
+		method   config.AuthType
+		authType int32
+	}{
+		{config.AuthMD5, AuthenticationMD5},
+		{config.AuthSCRAM, AuthenticationSASL},
+	} {
+		for _, user := range []string{"plain", "nobody"} {
+			serverSide, clientSide := net.Pipe()
+			go AuthenticateLocalClient(NewConn(serverSide), test.method, users, user)
+
+			message, err := NewConn(clientSide).ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, authType, err := parseStartUpResponse(message); err != nil || authType != test.authType {
+				t.Errorf("%s as %s: expected auth request %d, got %q", test.method, user, test.authType, message)
+			}
+			clientSide.Close()
+			serverSide.Close()
+		}
+	}
+}
+
+func TestMalformedSASLInitialResponse(t *testing.T) {
+	users := Userlist{"plain": "secret"}
+
+	for _, length := range []int32{-1, -5, 1 << 30, 100} {
+		serverSide, clientSide := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- AuthenticateLocalClient(NewConn(serverSide), config.AuthSCRAM, users, "plain")
+		}()
+
+		client := NewConn(clientSide)
+		if _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		message := NewSASLInitialResponseMessage(SCRAMSHA256, []byte("n,,n=,r=nonce"))
+		// the length of the data follows the mechanism name
+		binary.BigEndian.PutUint32(message[5+len(SCRAMSHA256)+1:], uint32(length))
+		client.Send(message)
+		go client.ReadMessage()
+
+		if err := <-errc; err != ErrClientAuthFailed {
+			t.Errorf("length %d: expected ErrClientAuthFailed, got %v", length, err)
+		}
+		clientSide.Close()
+		serverSide.Close()
+	}
+}
+
+func TestLoadUserlist(t *testing.T) {
+	file, err := ioutil.TempFile("", "userlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`; comment
+"alice" "pa ss"
+# another comment
+
+"bob" "say ""hi"""
+`)
+	file.Close()
+
+	users, err := LoadUserlist(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] != "pa ss" || users["bob"] != `say "hi"` {
+		t.Errorf("unexpected userlist %v", users)
+	}
+}
+
+func TestLoadUserlistRejectsUnquoted(t *testing.T) {
+	file, err := ioutil.TempFile("", "userlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("alice secret\n")
+	file.Close()
+
+	if _, err := LoadUserlist(file.Name()); err == nil {
+		t.Error("expected an unquoted line to be rejected")
+	}
+}
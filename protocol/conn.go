@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+)
+
+// Conn is a network connection together with the Reader and Writer framing
+// the messages sent over it.
+//
+// The Reader buffers ahead, so once a connection is wrapped all reads must go
+// through the Conn rather than the underlying net.Conn.
+type Conn struct {
+	net.Conn
+	*Reader
+	*Writer
+}
+
+// NewConn wraps conn for message level reads and writes.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:   conn,
+		Reader: NewReader(conn),
+		Writer: NewWriter(conn),
+	}
+}
+
+// Send writes the given typed messages and flushes them.
+func (c *Conn) Send(messages ...[]byte) error {
+	for _, message := range messages {
+		if err := c.WriteMessage(message); err != nil {
+			return err
+		}
+	}
+	return c.Flush()
+}
+
+// Exec runs query with the simple query protocol and returns every message
+// the server answered with, ending with ReadyForQuery. If the query failed
+// the server's ErrorResponse is returned as the error once the connection is
+// ready again.
+func (c *Conn) Exec(query string) ([][]byte, error) {
+	if err := c.Send(NewQueryMessage(query)); err != nil {
+		return nil, err
+	}
+
+	var messages [][]byte
+	var queryErr error
+	for {
+		message, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+
+		switch GetMessageType(message) {
+		case ErrorMessageType:
+			if queryErr, err = ParseErrorResponse(message); err != nil {
+				queryErr = errors.New("malformed ErrorResponse")
+			}
+		case ReadyForQueryMessageType:
+			return messages, queryErr
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/johnshiver/rocky/msgbuf"
+)
+
+/*   ErrorResponse and NoticeResponse ------------------------------------------------------------
+
+Reference: https://www.postgresql.org/docs/current/protocol-error-fields.html
+
+Both messages are a list of fields, each a one byte code followed by a NULL terminated string,
+ended by a zero byte. Severity, SQLSTATE code and message are always present, the rest are
+optional. Fields with unknown codes must be ignored.
+
+*/
+
+const (
+	// field codes
+	ErrorFieldSeverity             byte = 'S'
+	ErrorFieldSeverityNonLocalized byte = 'V'
+	ErrorFieldCode                 byte = 'C'
+	ErrorFieldMessage              byte = 'M'
+	ErrorFieldDetail               byte = 'D'
+	ErrorFieldHint                 byte = 'H'
+	ErrorFieldPosition             byte = 'P'
+	ErrorFieldInternalPosition     byte = 'p'
+	ErrorFieldInternalQuery        byte = 'q'
+	ErrorFieldWhere                byte = 'W'
+	ErrorFieldSchemaName           byte = 's'
+	ErrorFieldTableName            byte = 't'
+	ErrorFieldColumnName           byte = 'c'
+	ErrorFieldDataTypeName         byte = 'd'
+	ErrorFieldConstraintName       byte = 'n'
+	ErrorFieldFile                 byte = 'F'
+	ErrorFieldLine                 byte = 'L'
+	ErrorFieldRoutine              byte = 'R'
+
+	// severities
+	SeverityError   = "ERROR"
+	SeverityFatal   = "FATAL"
+	SeverityPanic   = "PANIC"
+	SeverityWarning = "WARNING"
+	SeverityNotice  = "NOTICE"
+	SeverityDebug   = "DEBUG"
+	SeverityInfo    = "INFO"
+	SeverityLog     = "LOG"
+
+	// SQLSTATE codes used by rocky, see
+	// https://www.postgresql.org/docs/current/errcodes-appendix.html
+	SQLStateConnectionFailure    = "08006"
+	SQLStateProtocolViolation    = "08P01"
+	SQLStateInvalidAuthorization = "28000"
+	SQLStateInvalidPassword      = "28P01"
+	SQLStateInvalidCatalogName   = "3D000"
+	SQLStateSyntaxError          = "42601"
+	SQLStateTooManyConnections   = "53300"
+	SQLStateProgramLimitExceeded = "54000"
+	SQLStateSystemError          = "58000"
+)
+
+// ErrorResponse is a parsed ErrorResponse message. Every field is kept as the
+// string sent on the wire, empty when absent.
+type ErrorResponse struct {
+	// Severity may be localized, SeverityNonLocalized never is but is only
+	// sent by postgres 9.6 and later
+	Severity             string
+	SeverityNonLocalized string
+	Code                 string
+	Message              string
+	Detail               string
+	Hint                 string
+	// 1-based character index into the query
+	Position string
+	// position into InternalQuery, a query generated by the server
+	InternalPosition string
+	InternalQuery    string
+	Where            string
+	SchemaName       string
+	TableName        string
+	ColumnName       string
+	DataTypeName     string
+	ConstraintName   string
+	// location in the server source code
+	File    string
+	Line    string
+	Routine string
+}
+
+// NoticeResponse is a parsed NoticeResponse message, it has the same fields
+// as an ErrorResponse.
+type NoticeResponse ErrorResponse
+
+// NewError creates an ErrorResponse with the fields every error must have.
+func NewError(severity, code, message string) *ErrorResponse {
+	return &ErrorResponse{
+		Severity:             severity,
+		SeverityNonLocalized: severity,
+		Code:                 code,
+		Message:              message,
+	}
+}
+
+// NewTooManyConnectionsError is the FATAL 53300 sent to clients that cannot
+// get a connection.
+func NewTooManyConnectionsError(message string) *ErrorResponse {
+	return NewError(SeverityFatal, SQLStateTooManyConnections, message)
+}
+
+// NewConnectionFailureError is the FATAL 08006 sent to clients when rocky
+// cannot reach their backend.
+func NewConnectionFailureError(message string) *ErrorResponse {
+	return NewError(SeverityFatal, SQLStateConnectionFailure, message)
+}
+
+// NewProtocolViolationError is the ERROR 08P01 sent to clients that send
+// something rocky cannot handle.
+func NewProtocolViolationError(message string) *ErrorResponse {
+	return NewError(SeverityError, SQLStateProtocolViolation, message)
+}
+
+// Error formats the error like psql does, "SEVERITY:  message".
+func (e *ErrorResponse) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s:  %s", e.Severity, e.Message)
+	}
+	return fmt.Sprintf("%s:  %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// Bytes encodes the error as an ErrorResponse message.
+func (e *ErrorResponse) Bytes() []byte {
+	return e.encode(ErrorMessageType)
+}
+
+// Bytes encodes the notice as a NoticeResponse message.
+func (n *NoticeResponse) Bytes() []byte {
+	return (*ErrorResponse)(n).encode(NoticeMessageType)
+}
+
+func (e *ErrorResponse) encode(messageType byte) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(messageType)
+	message.WriteInt32(0)
+
+	for _, field := range e.fields() {
+		if *field.value == "" {
+			continue
+		}
+		message.WriteByte(field.code)
+		message.WriteString(*field.value)
+	}
+
+	// the fields are terminated by a NULL byte
+	message.WriteByte(0x00)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+type errorField struct {
+	code  byte
+	value *string
+}
+
+// fields pairs each field code with the struct field holding it, in the
+// order postgres sends them
+func (e *ErrorResponse) fields() []errorField {
+	return []errorField{
+		{ErrorFieldSeverity, &e.Severity},
+		{ErrorFieldSeverityNonLocalized, &e.SeverityNonLocalized},
+		{ErrorFieldCode, &e.Code},
+		{ErrorFieldMessage, &e.Message},
+		{ErrorFieldDetail, &e.Detail},
+		{ErrorFieldHint, &e.Hint},
+		{ErrorFieldPosition, &e.Position},
+		{ErrorFieldInternalPosition, &e.InternalPosition},
+		{ErrorFieldInternalQuery, &e.InternalQuery},
+		{ErrorFieldWhere, &e.Where},
+		{ErrorFieldSchemaName, &e.SchemaName},
+		{ErrorFieldTableName, &e.TableName},
+		{ErrorFieldColumnName, &e.ColumnName},
+		{ErrorFieldDataTypeName, &e.DataTypeName},
+		{ErrorFieldConstraintName, &e.ConstraintName},
+		{ErrorFieldFile, &e.File},
+		{ErrorFieldLine, &e.Line},
+		{ErrorFieldRoutine, &e.Routine},
+	}
+}
+
+// ParseErrorResponse parses an ErrorResponse message.
+func ParseErrorResponse(message []byte) (*ErrorResponse, error) {
+	if len(message) == 0 || GetMessageType(message) != ErrorMessageType {
+		return nil, errors.New("not an ErrorResponse")
+	}
+	return parseErrorFields(message)
+}
+
+// ParseNoticeResponse parses a NoticeResponse message.
+func ParseNoticeResponse(message []byte) (*NoticeResponse, error) {
+	if len(message) == 0 || GetMessageType(message) != NoticeMessageType {
+		return nil, errors.New("not a NoticeResponse")
+	}
+	e, err := parseErrorFields(message)
+	if err != nil {
+		return nil, err
+	}
+	return (*NoticeResponse)(e), nil
+}
+
+func parseErrorFields(message []byte) (*ErrorResponse, error) {
+	if len(message) < 5 {
+		return nil, errors.New("message too short")
+	}
+
+	e := &ErrorResponse{}
+	fields := make(map[byte]*string)
+	for _, field := range e.fields() {
+		fields[field.code] = field.value
+	}
+
+	buffer := msgbuf.New(message[5:])
+	for {
+		code, err := buffer.ReadByte()
+		if err != nil {
+			return nil, errors.New("error fields are not terminated")
+		}
+		if code == 0x00 {
+			return e, nil
+		}
+		value, err := buffer.ReadString()
+		if err != nil {
+			return nil, fmt.Errorf("error field %q is not terminated", code)
+		}
+		// unknown fields are skipped as the protocol asks
+		if field, ok := fields[code]; ok {
+			*field = value
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/johnshiver/rocky/msgbuf"
+)
+
+func TestErrorResponseRoundTrip(t *testing.T) {
+	original := &ErrorResponse{
+		Severity:             SeverityError,
+		SeverityNonLocalized: SeverityError,
+		Code:                 "23505",
+		Message:              "duplicate key value violates unique constraint \"users_pkey\"",
+		Detail:               "Key (id)=(1) already exists.",
+		SchemaName:           "public",
+		TableName:            "users",
+		ConstraintName:       "users_pkey",
+		File:                 "nbtinsert.c",
+		Line:                 "434",
+		Routine:              "_bt_check_unique",
+	}
+
+	parsed, err := ParseErrorResponse(original.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *original {
+		t.Errorf("expected %+v, got %+v", original, parsed)
+	}
+	if code := GetErrorCode(original.Bytes()); code != "23505" {
+		t.Errorf("expected code 23505, got %q", code)
+	}
+}
+
+func TestParseErrorResponseSkipsUnknownFields(t *testing.T) {
+	message := msgbuf.New([]byte{})
+	message.WriteByte(ErrorMessageType)
+	message.WriteInt32(0)
+	message.WriteByte('S')
+	message.WriteString("FATAL")
+	message.WriteByte('Z')
+	message.WriteString("from a future postgres")
+	message.WriteByte('C')
+	message.WriteString(SQLStateTooManyConnections)
+	message.WriteByte(0x00)
+	message.ResetLength(PGMessageLengthOffset)
+
+	parsed, err := ParseErrorResponse(message.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Severity != "FATAL" || parsed.Code != SQLStateTooManyConnections {
+		t.Errorf("unexpected fields %+v", parsed)
+	}
+}
+
+func TestParseErrorResponseMalformed(t *testing.T) {
+	complete := NewTooManyConnectionsError("sorry, too many clients already").Bytes()
+
+	for _, message := range [][]byte{
+		nil,
+		complete[:5],
+		complete[:len(complete)-1],
+		complete[:len(complete)-3],
+		NewCommandCompleteMessage("SELECT 1"),
+	} {
+		if _, err := ParseErrorResponse(message); err == nil {
+			t.Errorf("expected an error parsing %q", message)
+		}
+	}
+}
+
+func TestNoticeResponse(t *testing.T) {
+	notice := &NoticeResponse{
+		Severity: SeverityWarning,
+		Code:     "01000",
+		Message:  "there is no transaction in progress",
+	}
+	message := notice.Bytes()
+	if GetMessageType(message) != NoticeMessageType {
+		t.Fatalf("expected NoticeResponse, got %q", GetMessageType(message))
+	}
+
+	parsed, err := ParseNoticeResponse(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *notice {
+		t.Errorf("expected %+v, got %+v", notice, parsed)
+	}
+	if _, err := ParseErrorResponse(message); err == nil {
+		t.Error("expected a NoticeResponse not to parse as an ErrorResponse")
+	}
+}
@@ -0,0 +1,380 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/johnshiver/rocky/msgbuf"
+)
+
+/*   Extended query protocol ---------------------------------------------------------------------
+
+Reference: https://www.postgresql.org/docs/current/protocol-flow.html#PROTOCOL-FLOW-EXT-QUERY
+
+Instead of a single Query the client sends a pipeline of messages, usually
+
+    Parse      -> ParseComplete            prepare a statement, named or unnamed
+    Bind       -> BindComplete             bind parameters to it, creating a portal
+    Describe   -> ParameterDescription,    describe the statement or portal
+                  RowDescription / NoData
+    Execute    -> DataRow..., CommandComplete or PortalSuspended
+    Sync       -> ReadyForQuery            end the pipeline
+
+After an error the server discards messages until Sync, so ReadyForQuery is only sent in answer
+to Sync. Flush asks the server to send what it has so far without ending the pipeline. Close
+frees a statement or portal and is answered with CloseComplete.
+
+*/
+
+const (
+	// the object a Describe or Close refers to
+	StatementTarget byte = 'S'
+	PortalTarget    byte = 'P'
+
+	// parameter and result format codes
+	TextFormat   int16 = 0
+	BinaryFormat int16 = 1
+)
+
+// Parse prepares a statement. An empty Name is the unnamed statement.
+type Parse struct {
+	Name  string
+	Query string
+	// type OIDs of the parameters, 0 leaves the type to the server
+	ParameterTypes []int32
+}
+
+// Bind creates a portal from a prepared statement. An empty Portal or
+// Statement name refers to the unnamed one.
+type Bind struct {
+	Portal    string
+	Statement string
+	// empty means every parameter is text, a single code applies to all
+	ParameterFormats []int16
+	// a nil parameter is NULL
+	Parameters    [][]byte
+	ResultFormats []int16
+}
+
+// Describe asks for the description of a statement or portal, Target is
+// StatementTarget or PortalTarget.
+type Describe struct {
+	Target byte
+	Name   string
+}
+
+// Execute runs a portal, MaxRows 0 returns every row.
+type Execute struct {
+	Portal  string
+	MaxRows int32
+}
+
+// Close frees a statement or portal, Target is StatementTarget or
+// PortalTarget.
+type Close struct {
+	Target byte
+	Name   string
+}
+
+// ParameterDescription lists the parameter type OIDs of a statement.
+type ParameterDescription struct {
+	ParameterTypes []int32
+}
+
+func (p *Parse) Bytes() []byte {
+	message := newMessage(ParseMessageType)
+	message.WriteString(p.Name)
+	message.WriteString(p.Query)
+	message.WriteInt16(int16(len(p.ParameterTypes)))
+	for _, oid := range p.ParameterTypes {
+		message.WriteInt32(oid)
+	}
+	return finishMessage(message)
+}
+
+func (b *Bind) Bytes() []byte {
+	message := newMessage(BindMessageType)
+	message.WriteString(b.Portal)
+	message.WriteString(b.Statement)
+	writeInt16s(message, b.ParameterFormats)
+	message.WriteInt16(int16(len(b.Parameters)))
+	for _, parameter := range b.Parameters {
+		if parameter == nil {
+			message.WriteInt32(-1)
+			continue
+		}
+		message.WriteInt32(int32(len(parameter)))
+		message.WriteBytes(parameter)
+	}
+	writeInt16s(message, b.ResultFormats)
+	return finishMessage(message)
+}
+
+func (d *Describe) Bytes() []byte {
+	message := newMessage(DescribeMessageType)
+	message.WriteByte(d.Target)
+	message.WriteString(d.Name)
+	return finishMessage(message)
+}
+
+func (e *Execute) Bytes() []byte {
+	message := newMessage(ExecuteMessageType)
+	message.WriteString(e.Portal)
+	message.WriteInt32(e.MaxRows)
+	return finishMessage(message)
+}
+
+func (c *Close) Bytes() []byte {
+	message := newMessage(CloseMessageType)
+	message.WriteByte(c.Target)
+	message.WriteString(c.Name)
+	return finishMessage(message)
+}
+
+func (p *ParameterDescription) Bytes() []byte {
+	message := newMessage(ParameterDescriptionMessageType)
+	message.WriteInt16(int16(len(p.ParameterTypes)))
+	for _, oid := range p.ParameterTypes {
+		message.WriteInt32(oid)
+	}
+	return finishMessage(message)
+}
+
+// NewFlushMessage asks the server to deliver pending output.
+func NewFlushMessage() []byte {
+	return finishMessage(newMessage(FlushMessageType))
+}
+
+// NewSyncMessage ends an extended query pipeline.
+func NewSyncMessage() []byte {
+	return finishMessage(newMessage(SyncMessageType))
+}
+
+// NewParseCompleteMessage answers Parse.
+func NewParseCompleteMessage() []byte {
+	return finishMessage(newMessage(ParseCompleteMessageType))
+}
+
+// NewBindCompleteMessage answers Bind.
+func NewBindCompleteMessage() []byte {
+	return finishMessage(newMessage(BindCompleteMessageType))
+}
+
+// NewCloseCompleteMessage answers Close.
+func NewCloseCompleteMessage() []byte {
+	return finishMessage(newMessage(CloseCompleteMessageType))
+}
+
+// NewNoDataMessage answers Describe for statements that return no rows.
+func NewNoDataMessage() []byte {
+	return finishMessage(newMessage(NoDataMessageType))
+}
+
+// NewPortalSuspendedMessage ends an Execute that reached its MaxRows.
+func NewPortalSuspendedMessage() []byte {
+	return finishMessage(newMessage(PortalSuspendedMessageType))
+}
+
+// DecodeParse reads a Parse message.
+func DecodeParse(message []byte) (*Parse, error) {
+	buffer, err := messageBody(message, ParseMessageType)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Parse{}
+	if p.Name, err = buffer.ReadString(); err != nil {
+		return nil, malformed(ParseMessageType)
+	}
+	if p.Query, err = buffer.ReadString(); err != nil {
+		return nil, malformed(ParseMessageType)
+	}
+	if p.ParameterTypes, err = readInt32s(buffer); err != nil {
+		return nil, malformed(ParseMessageType)
+	}
+	return p, nil
+}
+
+// DecodeBind reads a Bind message.
+func DecodeBind(message []byte) (*Bind, error) {
+	buffer, err := messageBody(message, BindMessageType)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bind{}
+	if b.Portal, err = buffer.ReadString(); err != nil {
+		return nil, malformed(BindMessageType)
+	}
+	if b.Statement, err = buffer.ReadString(); err != nil {
+		return nil, malformed(BindMessageType)
+	}
+	if b.ParameterFormats, err = readInt16s(buffer); err != nil {
+		return nil, malformed(BindMessageType)
+	}
+
+	count, err := buffer.ReadInt16()
+	if err != nil || count < 0 {
+		return nil, malformed(BindMessageType)
+	}
+	b.Parameters = make([][]byte, count)
+	for i := range b.Parameters {
+		length, err := buffer.ReadInt32()
+		if err != nil || length < -1 {
+			return nil, malformed(BindMessageType)
+		}
+		if length == -1 {
+			continue
+		}
+		if b.Parameters[i], err = buffer.ReadBytes(int(length)); err != nil {
+			return nil, malformed(BindMessageType)
+		}
+	}
+
+	if b.ResultFormats, err = readInt16s(buffer); err != nil {
+		return nil, malformed(BindMessageType)
+	}
+	return b, nil
+}
+
+// DecodeDescribe reads a Describe message.
+func DecodeDescribe(message []byte) (*Describe, error) {
+	target, name, err := decodeTarget(message, DescribeMessageType)
+	if err != nil {
+		return nil, err
+	}
+	return &Describe{Target: target, Name: name}, nil
+}
+
+// DecodeExecute reads an Execute message.
+func DecodeExecute(message []byte) (*Execute, error) {
+	buffer, err := messageBody(message, ExecuteMessageType)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Execute{}
+	if e.Portal, err = buffer.ReadString(); err != nil {
+		return nil, malformed(ExecuteMessageType)
+	}
+	if e.MaxRows, err = buffer.ReadInt32(); err != nil {
+		return nil, malformed(ExecuteMessageType)
+	}
+	return e, nil
+}
+
+// DecodeClose reads a Close message.
+func DecodeClose(message []byte) (*Close, error) {
+	target, name, err := decodeTarget(message, CloseMessageType)
+	if err != nil {
+		return nil, err
+	}
+	return &Close{Target: target, Name: name}, nil
+}
+
+// DecodeParameterDescription reads a ParameterDescription message.
+func DecodeParameterDescription(message []byte) (*ParameterDescription, error) {
+	buffer, err := messageBody(message, ParameterDescriptionMessageType)
+	if err != nil {
+		return nil, err
+	}
+
+	types, err := readInt32s(buffer)
+	if err != nil {
+		return nil, malformed(ParameterDescriptionMessageType)
+	}
+	return &ParameterDescription{ParameterTypes: types}, nil
+}
+
+// decodeTarget reads the body shared by Describe and Close
+func decodeTarget(message []byte, messageType byte) (byte, string, error) {
+	buffer, err := messageBody(message, messageType)
+	if err != nil {
+		return 0, "", err
+	}
+
+	target, err := buffer.ReadByte()
+	if err != nil || (target != StatementTarget && target != PortalTarget) {
+		return 0, "", malformed(messageType)
+	}
+	name, err := buffer.ReadString()
+	if err != nil {
+		return 0, "", malformed(messageType)
+	}
+	return target, name, nil
+}
+
+func newMessage(messageType byte) *msgbuf.MessageBuffer {
+	message := msgbuf.New([]byte{})
+	message.WriteByte(messageType)
+	message.WriteInt32(0)
+	return message
+}
+
+func finishMessage(message *msgbuf.MessageBuffer) []byte {
+	message.ResetLength(PGMessageLengthOffset)
+	return message.Bytes()
+}
+
+// messageBody checks the message type and returns a buffer positioned after
+// the header
+func messageBody(message []byte, messageType byte) (*msgbuf.MessageBuffer, error) {
+	if len(message) < 5 || GetMessageType(message) != messageType {
+		return nil, fmt.Errorf("not a %s message", messageName(messageType))
+	}
+	return msgbuf.New(message[5:]), nil
+}
+
+func malformed(messageType byte) error {
+	return fmt.Errorf("malformed %s message", messageName(messageType))
+}
+
+// messageName names the messages decoded here, only ParameterDescription is
+// sent by servers
+func messageName(messageType byte) string {
+	if messageType == ParameterDescriptionMessageType {
+		name, _ := BackendMessageName(messageType)
+		return name
+	}
+	name, _ := FrontendMessageName(messageType)
+	return name
+}
+
+func writeInt16s(message *msgbuf.MessageBuffer, values []int16) {
+	message.WriteInt16(int16(len(values)))
+	for _, value := range values {
+		message.WriteInt16(value)
+	}
+}
+
+func readInt16s(buffer *msgbuf.MessageBuffer) ([]int16, error) {
+	count, err := buffer.ReadInt16()
+	if err != nil || count < 0 {
+		return nil, errors.New("invalid count")
+	}
+	var values []int16
+	for i := 0; i < int(count); i++ {
+		value, err := buffer.ReadInt16()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func readInt32s(buffer *msgbuf.MessageBuffer) ([]int32, error) {
+	count, err := buffer.ReadInt16()
+	if err != nil || count < 0 {
+		return nil, errors.New("invalid count")
+	}
+	var values []int32
+	for i := 0; i < int(count); i++ {
+		value, err := buffer.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	original := &Parse{Name: "stmt1", Query: "select $1::int, $2", ParameterTypes: []int32{23, 0}}
+	parsed, err := DecodeParse(original.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, original) {
+		t.Errorf("expected %+v, got %+v", original, parsed)
+	}
+}
+
+func TestBindRoundTrip(t *testing.T) {
+	original := &Bind{
+		Portal:           "",
+		Statement:        "stmt1",
+		ParameterFormats: []int16{TextFormat, BinaryFormat},
+		Parameters:       [][]byte{[]byte("42"), nil, {}},
+		ResultFormats:    []int16{BinaryFormat},
+	}
+	parsed, err := DecodeBind(original.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, original) {
+		t.Errorf("expected %+v, got %+v", original, parsed)
+	}
+	if parsed.Parameters[1] != nil {
+		t.Error("expected the NULL parameter to stay nil")
+	}
+	if parsed.Parameters[2] == nil {
+		t.Error("expected the empty parameter not to become NULL")
+	}
+}
+
+func TestDescribeExecuteCloseRoundTrip(t *testing.T) {
+	describe := &Describe{Target: PortalTarget, Name: "portal"}
+	if parsed, err := DecodeDescribe(describe.Bytes()); err != nil || *parsed != *describe {
+		t.Errorf("expected %+v, got %+v (%v)", describe, parsed, err)
+	}
+
+	execute := &Execute{Portal: "portal", MaxRows: 100}
+	if parsed, err := DecodeExecute(execute.Bytes()); err != nil || *parsed != *execute {
+		t.Errorf("expected %+v, got %+v (%v)", execute, parsed, err)
+	}
+
+	closeMessage := &Close{Target: StatementTarget, Name: "stmt1"}
+	if parsed, err := DecodeClose(closeMessage.Bytes()); err != nil || *parsed != *closeMessage {
+		t.Errorf("expected %+v, got %+v (%v)", closeMessage, parsed, err)
+	}
+
+	description := &ParameterDescription{ParameterTypes: []int32{23, 25}}
+	parsed, err := DecodeParameterDescription(description.Bytes())
+	if err != nil || !reflect.DeepEqual(parsed, description) {
+		t.Errorf("expected %+v, got %+v (%v)", description, parsed, err)
+	}
+}
+
+func TestBodylessMessages(t *testing.T) {
+	for expected, message := range map[byte][]byte{
+		FlushMessageType:           NewFlushMessage(),
+		SyncMessageType:            NewSyncMessage(),
+		ParseCompleteMessageType:   NewParseCompleteMessage(),
+		BindCompleteMessageType:    NewBindCompleteMessage(),
+		CloseCompleteMessageType:   NewCloseCompleteMessage(),
+		NoDataMessageType:          NewNoDataMessage(),
+		PortalSuspendedMessageType: NewPortalSuspendedMessage(),
+	} {
+		if GetMessageType(message) != expected || GetMessageLength(message) != 4 || len(message) != 5 {
+			t.Errorf("unexpected %q message %v", expected, message)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	bind := (&Bind{Statement: "stmt1", Parameters: [][]byte{[]byte("42")}}).Bytes()
+
+	// every truncation of the message must fail rather than panic
+	for i := 5; i < len(bind); i++ {
+		if _, err := DecodeBind(bind[:i]); err == nil {
+			t.Errorf("expected an error decoding %d of %d bytes", i, len(bind))
+		}
+	}
+
+	if _, err := DecodeParse(bind); err == nil {
+		t.Error("expected an error decoding a Bind as a Parse")
+	}
+	if _, err := DecodeDescribe([]byte{DescribeMessageType, 0, 0, 0, 6, 'X', 0}); err == nil {
+		t.Error("expected an error for an unknown describe target")
+	}
+	if _, err := DecodeExecute([]byte{ExecuteMessageType}); err == nil {
+		t.Error("expected an error for a message without a header")
+	}
+}
+
+func TestMessageNames(t *testing.T) {
+	if name, ok := FrontendMessageName('D'); !ok || name != "Describe" {
+		t.Errorf("expected Describe, got %q", name)
+	}
+	if name, ok := BackendMessageName('D'); !ok || name != "DataRow" {
+		t.Errorf("expected DataRow, got %q", name)
+	}
+	if _, ok := FrontendMessageName(ParameterDescriptionMessageType); ok {
+		t.Error("clients do not send ParameterDescription")
+	}
+}
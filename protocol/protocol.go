@@ -44,32 +44,77 @@ const (
 	PGMessageLengthOffset        int   = 1
 	ProtocolVersion              int32 = 196608
 	SSLRequestCode               int32 = 80877103
+	GSSENCRequestCode            int32 = 80877104
+	CancelRequestCode            int32 = 80877102
 
 	SSLAllowed    byte = 'S'
 	SSLNotAllowed byte = 'N'
 
-	// Message Types
-	AuthenticationMessageType  byte = 'R'
-	ErrorMessageType           byte = 'E'
-	EmptyQueryMessageType      byte = 'I'
-	DescribeMessageType        byte = 'D'
-	RowDescriptionMessageType  byte = 'T'
-	DataRowMessageType         byte = 'D'
-	QueryMessageType           byte = 'Q'
-	CommandCompleteMessageType byte = 'C'
-	TerminateMessageType       byte = 'X'
-	NoticeMessageType          byte = 'N'
-	PasswordMessageType        byte = 'p'
-	ReadyForQueryMessageType   byte = 'Z'
-
-	AuthenticationOk          int32 = 0
-	AuthenticationKerberosV5  int32 = 2
-	AuthenticationClearText   int32 = 3
-	AuthenticationMD5         int32 = 5
-	AuthenticationSCM         int32 = 6
-	AuthenticationGSS         int32 = 7
-	AuthenticationGSSContinue int32 = 8
-	AuthenticationSSPI        int32 = 9
+	// Message types. The same byte means different messages depending on
+	// who sends it, 'D' is Describe from a client but DataRow from a
+	// server, so a type is only meaningful together with its direction.
+
+	// Frontend message types, sent by clients
+	BindMessageType         byte = 'B'
+	CloseMessageType        byte = 'C'
+	DescribeMessageType     byte = 'D'
+	ExecuteMessageType      byte = 'E'
+	FlushMessageType        byte = 'H'
+	FunctionCallMessageType byte = 'F'
+	ParseMessageType        byte = 'P'
+	PasswordMessageType     byte = 'p'
+	QueryMessageType        byte = 'Q'
+	SyncMessageType         byte = 'S'
+	TerminateMessageType    byte = 'X'
+
+	// Backend message types, sent by servers
+	AuthenticationMessageType       byte = 'R'
+	BackendKeyDataMessageType       byte = 'K'
+	BindCompleteMessageType         byte = '2'
+	CloseCompleteMessageType        byte = '3'
+	CommandCompleteMessageType      byte = 'C'
+	CopyInResponseMessageType       byte = 'G'
+	CopyOutResponseMessageType      byte = 'H'
+	CopyBothResponseMessageType     byte = 'W'
+	DataRowMessageType              byte = 'D'
+	EmptyQueryMessageType           byte = 'I'
+	ErrorMessageType                byte = 'E'
+	FunctionCallResponseMessageType byte = 'V'
+	NegotiateProtocolMessageType    byte = 'v'
+	NoDataMessageType               byte = 'n'
+	NoticeMessageType               byte = 'N'
+	NotificationMessageType         byte = 'A'
+	ParameterDescriptionMessageType byte = 't'
+	ParameterStatusMessageType      byte = 'S'
+	ParseCompleteMessageType        byte = '1'
+	PortalSuspendedMessageType      byte = 's'
+	ReadyForQueryMessageType        byte = 'Z'
+	RowDescriptionMessageType       byte = 'T'
+
+	// Message types sent by both sides during COPY
+	CopyDataMessageType byte = 'd'
+	CopyDoneMessageType byte = 'c'
+	CopyFailMessageType byte = 'f'
+
+	// ReadyForQuery transaction status indicators
+	TransactionIdle   byte = 'I'
+	TransactionActive byte = 'T'
+	TransactionFailed byte = 'E'
+
+	AuthenticationOk           int32 = 0
+	AuthenticationKerberosV5   int32 = 2
+	AuthenticationClearText    int32 = 3
+	AuthenticationMD5          int32 = 5
+	AuthenticationSCM          int32 = 6
+	AuthenticationGSS          int32 = 7
+	AuthenticationGSSContinue  int32 = 8
+	AuthenticationSSPI         int32 = 9
+	AuthenticationSASL         int32 = 10
+	AuthenticationSASLContinue int32 = 11
+	AuthenticationSASLFinal    int32 = 12
+
+	// type OID of text columns in RowDescription
+	TextOID int32 = 25
 )
 
 var pLogger *logger.PGLogger
@@ -90,12 +135,80 @@ func GetVersion(message []byte) int32 {
 	return code
 }
 
+// IsSSLRequest reports whether an untyped startup-phase message is an SSLRequest
+func IsSSLRequest(message []byte) bool {
+	return len(message) >= 8 && GetVersion(message) == SSLRequestCode
+}
+
+// IsGSSENCRequest reports whether an untyped startup-phase message asks for
+// GSSAPI encryption
+func IsGSSENCRequest(message []byte) bool {
+	return len(message) >= 8 && GetVersion(message) == GSSENCRequestCode
+}
+
 // The first byte of the message identifies its type
 func GetMessageType(message []byte) byte {
 	return message[0]
 }
 
-// TODO: this appears to fail when transmitting larger responses from the backend
+var frontendMessageNames = map[byte]string{
+	BindMessageType:         "Bind",
+	CloseMessageType:        "Close",
+	CopyDataMessageType:     "CopyData",
+	CopyDoneMessageType:     "CopyDone",
+	CopyFailMessageType:     "CopyFail",
+	DescribeMessageType:     "Describe",
+	ExecuteMessageType:      "Execute",
+	FlushMessageType:        "Flush",
+	FunctionCallMessageType: "FunctionCall",
+	ParseMessageType:        "Parse",
+	PasswordMessageType:     "PasswordMessage",
+	QueryMessageType:        "Query",
+	SyncMessageType:         "Sync",
+	TerminateMessageType:    "Terminate",
+}
+
+var backendMessageNames = map[byte]string{
+	AuthenticationMessageType:       "Authentication",
+	BackendKeyDataMessageType:       "BackendKeyData",
+	BindCompleteMessageType:         "BindComplete",
+	CloseCompleteMessageType:        "CloseComplete",
+	CommandCompleteMessageType:      "CommandComplete",
+	CopyDataMessageType:             "CopyData",
+	CopyDoneMessageType:             "CopyDone",
+	CopyInResponseMessageType:       "CopyInResponse",
+	CopyOutResponseMessageType:      "CopyOutResponse",
+	CopyBothResponseMessageType:     "CopyBothResponse",
+	DataRowMessageType:              "DataRow",
+	EmptyQueryMessageType:           "EmptyQueryResponse",
+	ErrorMessageType:                "ErrorResponse",
+	FunctionCallResponseMessageType: "FunctionCallResponse",
+	NegotiateProtocolMessageType:    "NegotiateProtocolVersion",
+	NoDataMessageType:               "NoData",
+	NoticeMessageType:               "NoticeResponse",
+	NotificationMessageType:         "NotificationResponse",
+	ParameterDescriptionMessageType: "ParameterDescription",
+	ParameterStatusMessageType:      "ParameterStatus",
+	ParseCompleteMessageType:        "ParseComplete",
+	PortalSuspendedMessageType:      "PortalSuspended",
+	ReadyForQueryMessageType:        "ReadyForQuery",
+	RowDescriptionMessageType:       "RowDescription",
+}
+
+// FrontendMessageName names a message type sent by a client, ok is false if
+// clients do not send messages of that type.
+func FrontendMessageName(messageType byte) (name string, ok bool) {
+	name, ok = frontendMessageNames[messageType]
+	return name, ok
+}
+
+// BackendMessageName names a message type sent by a server, ok is false if
+// servers do not send messages of that type.
+func BackendMessageName(messageType byte) (name string, ok bool) {
+	name, ok = backendMessageNames[messageType]
+	return name, ok
+}
+
 // The 4 bytes after the message identify the message length
 func GetMessageLength(message []byte) int32 {
 	var messageLength int32
@@ -107,7 +220,8 @@ func GetMessageLength(message []byte) int32 {
 }
 
 func IsAuthenticationOk(message []byte) bool {
-	if GetMessageType(message) != AuthenticationMessageType {
+	// type, length and auth type
+	if len(message) < 9 || GetMessageType(message) != AuthenticationMessageType {
 		return false
 	}
 
@@ -124,6 +238,82 @@ func IsAuthenticationOk(message []byte) bool {
 	return (messageLength == 8 && messageValue == AuthenticationOk)
 }
 
+// NewSSLRequestMessage asks the server to switch the connection to TLS. The
+// server answers with a single SSLAllowed or SSLNotAllowed byte.
+func NewSSLRequestMessage() []byte {
+	message := msgbuf.New([]byte{})
+	message.WriteInt32(8)
+	message.WriteInt32(SSLRequestCode)
+	return message.Bytes()
+}
+
+// GetStartupParameters reads the name/value pairs that follow the protocol
+// version in a startup message.
+func GetStartupParameters(message []byte) map[string]string {
+	parameters := make(map[string]string)
+	if len(message) < 8 {
+		return parameters
+	}
+
+	buffer := msgbuf.New(message[8:])
+	for {
+		name, err := buffer.ReadString()
+		if err != nil || name == "" {
+			return parameters
+		}
+		value, err := buffer.ReadString()
+		if err != nil {
+			return parameters
+		}
+		parameters[name] = value
+	}
+}
+
+// NewAuthenticationOkMessage tells the client it has been authenticated.
+func NewAuthenticationOkMessage() []byte {
+	return newAuthenticationMessage(AuthenticationOk, nil)
+}
+
+// NewAuthenticationMD5Message asks the client for its password hashed with
+// the 4 byte salt.
+func NewAuthenticationMD5Message(salt []byte) []byte {
+	return newAuthenticationMessage(AuthenticationMD5, salt)
+}
+
+// NewAuthenticationSASLMessage starts a SASL exchange, offering the given
+// mechanisms.
+func NewAuthenticationSASLMessage(mechanisms []string) []byte {
+	data := msgbuf.New([]byte{})
+	for _, mechanism := range mechanisms {
+		data.WriteString(mechanism)
+	}
+	data.WriteByte(0x00)
+	return newAuthenticationMessage(AuthenticationSASL, data.Bytes())
+}
+
+// NewAuthenticationSASLContinueMessage carries a SASL challenge.
+func NewAuthenticationSASLContinueMessage(data []byte) []byte {
+	return newAuthenticationMessage(AuthenticationSASLContinue, data)
+}
+
+// NewAuthenticationSASLFinalMessage carries the outcome of a SASL exchange.
+func NewAuthenticationSASLFinalMessage(data []byte) []byte {
+	return newAuthenticationMessage(AuthenticationSASLFinal, data)
+}
+
+func newAuthenticationMessage(authType int32, data []byte) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(AuthenticationMessageType)
+	message.WriteInt32(0)
+	message.WriteInt32(authType)
+	message.WriteBytes(data)
+
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
 func NewTerminateMessage() []byte {
 	var buffer []byte
 	buffer = append(buffer, 'X')
@@ -135,6 +325,176 @@ func NewTerminateMessage() []byte {
 	return buffer
 }
 
+// NewQueryMessage creates a simple Query message.
+func NewQueryMessage(query string) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(QueryMessageType)
+	message.WriteInt32(0)
+	message.WriteString(query)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// NewErrorResponse creates an ErrorResponse with the given severity, SQLSTATE
+// code and message, which is the minimum a client needs to report an error.
+func NewErrorResponse(severity, code, text string) []byte {
+	return NewError(severity, code, text).Bytes()
+}
+
+// NewParameterStatusMessage reports the value of a run-time parameter.
+func NewParameterStatusMessage(name, value string) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(ParameterStatusMessageType)
+	message.WriteInt32(0)
+	message.WriteString(name)
+	message.WriteString(value)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// ParseParameterStatus returns the parameter name and value a
+// ParameterStatus message reports.
+func ParseParameterStatus(message []byte) (name, value string, err error) {
+	if len(message) < 5 || GetMessageType(message) != ParameterStatusMessageType {
+		return "", "", errors.New("not a ParameterStatus message")
+	}
+	buffer := msgbuf.New(message[5:])
+	if name, err = buffer.ReadString(); err != nil {
+		return "", "", errors.New("malformed ParameterStatus message")
+	}
+	if value, err = buffer.ReadString(); err != nil {
+		return "", "", errors.New("malformed ParameterStatus message")
+	}
+	return name, value, nil
+}
+
+// NewRowDescriptionMessage describes a result with the given columns, all of
+// them text in text format.
+func NewRowDescriptionMessage(columns []string) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(RowDescriptionMessageType)
+	message.WriteInt32(0)
+	message.WriteInt16(int16(len(columns)))
+	for _, column := range columns {
+		message.WriteString(column)
+		// table OID and column attribute number, the column is not from a table
+		message.WriteInt32(0)
+		message.WriteInt16(0)
+		// type OID, type size (variable), type modifier and format code (text)
+		message.WriteInt32(TextOID)
+		message.WriteInt16(-1)
+		message.WriteInt32(-1)
+		message.WriteInt16(0)
+	}
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// NewDataRowMessage holds one row of a result in text format.
+func NewDataRowMessage(values []string) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(DataRowMessageType)
+	message.WriteInt32(0)
+	message.WriteInt16(int16(len(values)))
+	for _, value := range values {
+		message.WriteInt32(int32(len(value)))
+		message.WriteBytes([]byte(value))
+	}
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// ParseDataRow returns the column values of a DataRow message, nil for NULL.
+func ParseDataRow(message []byte) ([][]byte, error) {
+	malformed := errors.New("malformed DataRow message")
+	if len(message) < 5 || GetMessageType(message) != DataRowMessageType {
+		return nil, errors.New("not a DataRow message")
+	}
+	buffer := msgbuf.New(message[5:])
+	count, err := buffer.ReadInt16()
+	if err != nil || count < 0 {
+		return nil, malformed
+	}
+	values := make([][]byte, count)
+	for i := range values {
+		length, err := buffer.ReadInt32()
+		if err != nil || length < -1 {
+			return nil, malformed
+		}
+		if length == -1 {
+			continue
+		}
+		if values[i], err = buffer.ReadBytes(int(length)); err != nil {
+			return nil, malformed
+		}
+	}
+	return values, nil
+}
+
+// NewCommandCompleteMessage ends the result of a command, tag is e.g. "SHOW"
+// or "SELECT 3".
+func NewCommandCompleteMessage(tag string) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(CommandCompleteMessageType)
+	message.WriteInt32(0)
+	message.WriteString(tag)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// NewEmptyQueryResponseMessage answers an empty query string.
+func NewEmptyQueryResponseMessage() []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(EmptyQueryMessageType)
+	message.WriteInt32(0)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// NewReadyForQueryMessage tells the client a new query can be sent, txStatus
+// is one of TransactionIdle, TransactionActive or TransactionFailed.
+func NewReadyForQueryMessage(txStatus byte) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(ReadyForQueryMessageType)
+	message.WriteInt32(0)
+	message.WriteByte(txStatus)
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// GetErrorCode returns the SQLSTATE code of an ErrorResponse or
+// NoticeResponse, or "" if it cannot be parsed.
+func GetErrorCode(message []byte) string {
+	e, err := parseErrorFields(message)
+	if err != nil {
+		return ""
+	}
+	return e.Code
+}
+
+// GetCommandTag returns the tag of a CommandComplete message, such as
+// "SELECT 3" or "DISCARD ALL".
+func GetCommandTag(message []byte) string {
+	if len(message) < 6 {
+		return ""
+	}
+	return string(bytes.TrimRight(message[5:], "\x00"))
+}
+
 func NewPasswordMessage(password string) []byte {
 	message := msgbuf.New([]byte{})
 
@@ -153,6 +513,36 @@ func NewPasswordMessage(password string) []byte {
 	return message.Bytes()
 }
 
+// NewSASLInitialResponseMessage starts a SASL exchange with the chosen
+// mechanism and its first message. It shares the password message type.
+func NewSASLInitialResponseMessage(mechanism string, data []byte) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(PasswordMessageType)
+	message.WriteInt32(0)
+
+	message.WriteString(mechanism)
+	message.WriteInt32(int32(len(data)))
+	message.WriteBytes(data)
+
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
+// NewSASLResponseMessage carries the next message of a SASL exchange.
+func NewSASLResponseMessage(data []byte) []byte {
+	message := msgbuf.New([]byte{})
+
+	message.WriteByte(PasswordMessageType)
+	message.WriteInt32(0)
+	message.WriteBytes(data)
+
+	message.ResetLength(PGMessageLengthOffset)
+
+	return message.Bytes()
+}
+
 // CreateStartupMessage creates a PG startup message. This message is used to
 // startup all connections with a PG backend.
 func NewStartupMessage(username string, database string, options map[string]string) []byte {
@@ -191,9 +581,12 @@ func NewStartupMessage(username string, database string, options map[string]stri
 func parseStartUpResponse(message []byte) (int32, int32, error) {
 	var msgLength int32
 	var authType int32
-	if GetMessageType(message) != AuthenticationMessageType {
+	if len(message) == 0 || GetMessageType(message) != AuthenticationMessageType {
 		return msgLength, authType, errors.New("StartUp Response was not AuthMessageType")
 	}
+	if len(message) < 9 {
+		return msgLength, authType, errors.New("malformed authentication request")
+	}
 
 	reader := bytes.NewReader(message[1:5])
 	binary.Read(reader, binary.BigEndian, &msgLength)
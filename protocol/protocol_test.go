@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/johnshiver/rocky/config"
+)
+
+func TestParseDataRow(t *testing.T) {
+	values, err := ParseDataRow(NewDataRowMessage([]string{"t", "", "42"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{[]byte("t"), {}, []byte("42")}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+
+	// a NULL column has length -1 and no value
+	null := []byte{DataRowMessageType, 0, 0, 0, 10, 0, 1, 0xff, 0xff, 0xff, 0xff}
+	if values, err := ParseDataRow(null); err != nil || len(values) != 1 || values[0] != nil {
+		t.Errorf("expected a single NULL, got %q, %v", values, err)
+	}
+
+	if _, err := ParseDataRow(NewCommandCompleteMessage("SELECT 1")); err == nil {
+		t.Error("expected an error for a CommandComplete")
+	}
+	truncated := NewDataRowMessage([]string{"value"})
+	if _, err := ParseDataRow(truncated[:len(truncated)-2]); err == nil {
+		t.Error("expected an error for a truncated DataRow")
+	}
+}
+
+func TestParseParameterStatus(t *testing.T) {
+	name, value, err := ParseParameterStatus(NewParameterStatusMessage("transaction_read_only", "on"))
+	if err != nil || name != "transaction_read_only" || value != "on" {
+		t.Errorf("unexpected %q = %q, %v", name, value, err)
+	}
+	if _, _, err := ParseParameterStatus(NewDataRowMessage([]string{"on"})); err == nil {
+		t.Error("expected an error for a DataRow")
+	}
+	if _, _, err := ParseParameterStatus([]byte{ParameterStatusMessageType, 0, 0, 0, 6, 'x'}); err == nil {
+		t.Error("expected an error for a truncated ParameterStatus")
+	}
+}
+
+func TestTruncatedAuthenticationMessages(t *testing.T) {
+	tests := []struct {
+		message []byte
+		// whether parseStartUpResponse accepts it
+		parses bool
+	}{
+		{nil, false},
+		{[]byte{AuthenticationMessageType}, false},
+		{[]byte{AuthenticationMessageType, 0, 0, 0, 4}, false},
+		{[]byte{AuthenticationMessageType, 0, 0, 0, 6, 0, 0}, false},
+		// AuthenticationMD5Password without its salt
+		{[]byte{AuthenticationMessageType, 0, 0, 0, 8, 0, 0, 0, 5}, true},
+		{[]byte{AuthenticationMessageType, 0, 0, 0, 10, 0, 0, 0, 5, 's', 'a'}, true},
+	}
+	for _, test := range tests {
+		if IsAuthenticationOk(test.message) {
+			t.Errorf("%q: expected no AuthenticationOk", test.message)
+		}
+		if _, _, err := parseStartUpResponse(test.message); (err == nil) != test.parses {
+			t.Errorf("%q: expected parsing to succeed: %v, got %v", test.message, test.parses, err)
+		}
+		// none of them gets as far as using the connection
+		if _, ok := handleAuthentication(&config.BackendHostSetting{}, nil, test.message); ok {
+			t.Errorf("%q: expected authentication to fail", test.message)
+		}
+	}
+}
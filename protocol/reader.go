@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// DefaultMaxMessageSize matches the largest allocation postgres itself
+	// will make for a single message.
+	DefaultMaxMessageSize int = 1024 * 1024 * 1024
+
+	// MaxStartupMessageSize is the limit postgres places on untyped
+	// startup-phase messages.
+	MaxStartupMessageSize int = 10000
+
+	// MaxAuthMessageSize is the limit postgres places on the password and
+	// SASL messages of a client that has not authenticated yet.
+	MaxAuthMessageSize int = 65536
+
+	readBufferSize = 8192
+)
+
+// ErrMessageTooLarge is returned when a message header announces a length
+// above the reader's limit. The stream cannot be resynchronized afterwards, so
+// the connection should be abandoned.
+var ErrMessageTooLarge = errors.New("message exceeds maximum message size")
+
+// Reader reads complete PostgreSQL messages from a stream.
+//
+// Each message is returned exactly as it appeared on the wire, header
+// included, so the helpers in this package (GetMessageType, GetMessageLength,
+// IsAuthenticationOk, ...) can be used on the result.
+type Reader struct {
+	reader         *bufio.Reader
+	maxMessageSize int
+
+	// set when a read failed part way through a message
+	err error
+}
+
+// NewReader creates a Reader limited to DefaultMaxMessageSize.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		reader:         bufio.NewReaderSize(r, readBufferSize),
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// SetMaxMessageSize sets the largest message, header included, the reader
+// will accept. Values <= 0 restore DefaultMaxMessageSize.
+func (r *Reader) SetMaxMessageSize(size int) {
+	if size <= 0 {
+		size = DefaultMaxMessageSize
+	}
+	r.maxMessageSize = size
+}
+
+// ReadMessage reads one typed message: the message type byte, the 4 byte
+// length and the rest of the message as given by that length.
+//
+// The header is only consumed once it has fully arrived, so an error such as
+// a read deadline expiring while waiting for the next message leaves the
+// reader usable. An error part way through the rest of a message is sticky
+// and returned by every later call.
+func (r *Reader) ReadMessage() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	header, err := r.reader.Peek(5)
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	length := int(GetMessageLength(header))
+	if length < 4 {
+		return nil, fmt.Errorf("invalid length %d for message type %q", length, header[0])
+	}
+	if length+1 > r.maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	message := make([]byte, length+1)
+	if _, err := io.ReadFull(r.reader, message); err != nil {
+		r.err = unexpectedEOF(err)
+		return nil, r.err
+	}
+	return message, nil
+}
+
+// ReadStartupMessage reads one untyped message, which is how the startup
+// message, SSLRequest and CancelRequest are sent. The first 4 bytes are the
+// length of the whole message.
+func (r *Reader) ReadStartupMessage() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, err
+	}
+
+	// GetMessageLength expects a type byte in front of the length
+	length := int(GetMessageLength(append([]byte{0}, header...)))
+	if length < 8 {
+		return nil, fmt.Errorf("invalid startup message length %d", length)
+	}
+	if length > MaxStartupMessageSize || length > r.maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	message := make([]byte, length)
+	copy(message, header)
+	if _, err := io.ReadFull(r.reader, message[4:]); err != nil {
+		r.err = unexpectedEOF(err)
+		return nil, r.err
+	}
+	return message, nil
+}
+
+// Buffered returns the number of bytes already read from the stream but not
+// yet returned as messages. Relays use it to decide when to flush.
+func (r *Reader) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// Err returns the error that left the reader part way through a message, if
+// any. Once set, the stream can no longer be framed.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// a stream that ends part way through a message was not closed cleanly
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadMessageSplitsCoalescedMessages(t *testing.T) {
+	first := NewPasswordMessage("first")
+	second := NewTerminateMessage()
+
+	reader := NewReader(bytes.NewReader(append(append([]byte{}, first...), second...)))
+
+	message, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, first) {
+		t.Errorf("expected %v, got %v", first, message)
+	}
+
+	message, err = reader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, second) {
+		t.Errorf("expected %v, got %v", second, message)
+	}
+
+	if _, err = reader.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestReadMessageLargerThanReadBuffer(t *testing.T) {
+	large := NewPasswordMessage(string(bytes.Repeat([]byte("x"), readBufferSize*3)))
+
+	message, err := NewReader(bytes.NewReader(large)).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, large) {
+		t.Errorf("message of %d bytes was read as %d bytes", len(large), len(message))
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	message := NewPasswordMessage("secret")
+
+	_, err := NewReader(bytes.NewReader(message[:len(message)-2])).ReadMessage()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReadMessageMaxSize(t *testing.T) {
+	message := NewPasswordMessage("secret")
+
+	reader := NewReader(bytes.NewReader(message))
+	reader.SetMaxMessageSize(len(message) - 1)
+	if _, err := reader.ReadMessage(); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestReadStartupMessage(t *testing.T) {
+	startup := NewStartupMessage("test", "test", map[string]string{"application_name": "rocky"})
+	query := NewTerminateMessage()
+
+	reader := NewReader(bytes.NewReader(append(append([]byte{}, startup...), query...)))
+
+	message, err := reader.ReadStartupMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, startup) {
+		t.Errorf("expected %v, got %v", startup, message)
+	}
+
+	message, err = reader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetMessageType(message) != TerminateMessageType {
+		t.Errorf("expected Terminate after startup, got %q", GetMessageType(message))
+	}
+}
+
+func TestWriteMessageRejectsBadLength(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+
+	message := NewPasswordMessage("secret")
+	if err := writer.WriteMessage(message[:len(message)-1]); err == nil {
+		t.Error("expected truncated message to be rejected")
+	}
+	if err := writer.WriteMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.Len() != 0 {
+		t.Error("message written before Flush")
+	}
+	writer.Flush()
+	if !bytes.Equal(buffer.Bytes(), message) {
+		t.Errorf("expected %v, got %v", message, buffer.Bytes())
+	}
+}
+
+func TestReadMessageIncompleteHeaderNotConsumed(t *testing.T) {
+	message := NewPasswordMessage("secret")
+	stream := &chunkedReader{chunks: [][]byte{message[:3], message[3:]}}
+
+	reader := NewReader(stream)
+	if _, err := reader.ReadMessage(); err != errChunk {
+		t.Fatalf("expected errChunk, got %v", err)
+	}
+	if reader.Err() != nil {
+		t.Errorf("reader marked broken by an incomplete header: %v", reader.Err())
+	}
+
+	got, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Errorf("expected %v, got %v", message, got)
+	}
+}
+
+var errChunk = errors.New("end of chunk")
+
+// chunkedReader returns one chunk per Read with errChunk between them, like a
+// connection whose read deadline expires mid-stream.
+type chunkedReader struct {
+	chunks [][]byte
+	paused bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if c.paused {
+		c.paused = false
+		return 0, errChunk
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	c.paused = true
+	return n, nil
+}
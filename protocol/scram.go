@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+/*   SCRAM-SHA-256 ------------------------------------------------------------------------------
+
+Reference: https://www.postgresql.org/docs/current/sasl-authentication.html
+           https://tools.ietf.org/html/rfc5802
+           https://tools.ietf.org/html/rfc7677
+
+The client and server exchange nonces and the server sends the salt and iteration count used to
+store the password. Both sides then prove they know the salted password without sending it:
+
+    SaltedPassword  := PBKDF2(password, salt, iterations)
+    ClientKey       := HMAC(SaltedPassword, "Client Key")
+    StoredKey       := H(ClientKey)
+    AuthMessage     := client-first-message-bare + "," + server-first-message + "," +
+                       client-final-message-without-proof
+    ClientSignature := HMAC(StoredKey, AuthMessage)
+    ClientProof     := ClientKey XOR ClientSignature
+    ServerKey       := HMAC(SaltedPassword, "Server Key")
+    ServerSignature := HMAC(ServerKey, AuthMessage)
+
+*/
+
+const (
+	SCRAMSHA256     = "SCRAM-SHA-256"
+	SCRAMSHA256Plus = "SCRAM-SHA-256-PLUS"
+
+	scramNonceLength = 18
+)
+
+// scramClient is the client side of a single SCRAM-SHA-256 exchange.
+//
+// Postgres takes the user name from the startup message and ignores the one
+// in the SCRAM messages, so it is left empty like libpq does.
+type scramClient struct {
+	username    string
+	password    string
+	clientNonce string
+
+	// gs2Header announces whether channel binding is used, bindingData is
+	// the tls-server-end-point hash when it is
+	gs2Header   string
+	bindingData []byte
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAMClient(password, gs2Header string, bindingData []byte) (*scramClient, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &scramClient{
+		password:    password,
+		clientNonce: nonce,
+		gs2Header:   gs2Header,
+		bindingData: bindingData,
+	}, nil
+}
+
+// clientFirstMessage is sent in the SASLInitialResponse.
+func (c *scramClient) clientFirstMessage() string {
+	c.clientFirstBare = "n=" + c.username + ",r=" + c.clientNonce
+	return c.gs2Header + c.clientFirstBare
+}
+
+// clientFinalMessage answers the server-first-message from SASLContinue with
+// the client proof.
+func (c *scramClient) clientFinalMessage(serverFirst string) (string, error) {
+	attributes := parseSCRAMAttributes(serverFirst)
+
+	nonce := attributes["r"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return "", errors.New("SCRAM server nonce does not extend the client nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil || len(salt) == 0 {
+		return "", errors.New("SCRAM server sent an invalid salt")
+	}
+
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return "", errors.New("SCRAM server sent an invalid iteration count")
+	}
+
+	channelBinding := base64.StdEncoding.EncodeToString(append([]byte(c.gs2Header), c.bindingData...))
+	clientFinalWithoutProof := "c=" + channelBinding + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	saltedPassword := pbkdf2SHA256([]byte(c.password), salt, iterations)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	c.serverSignature = scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks the server-final-message from SASLFinal, which
+// proves the server knew the password as well.
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attributes := parseSCRAMAttributes(serverFinal)
+	if e, ok := attributes["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil || subtle.ConstantTimeCompare(signature, c.serverSignature) != 1 {
+		return errors.New("SCRAM server signature is invalid")
+	}
+	return nil
+}
+
+// parseSCRAMAttributes splits a SCRAM message like "r=abc,s=def,i=4096" into
+// its attributes.
+func parseSCRAMAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			continue
+		}
+		attributes[field[:1]] = field[2:]
+	}
+	return attributes
+}
+
+func scramNonce() (string, error) {
+	raw := make([]byte, scramNonceLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a SCRAM-SHA-256 salted password. The output is a single
+// SHA-256 block, so only the first block of PBKDF2 is needed.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// tlsServerEndPoint returns the tls-server-end-point channel binding data for
+// a TLS connection: the server certificate hashed with the hash function of its
+// signature, where MD5 and SHA-1 are replaced by SHA-256.
+func tlsServerEndPoint(state tls.ConnectionState) ([]byte, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no server certificate for channel binding")
+	}
+	cert := state.PeerCertificates[0]
+
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	case x509.UnknownSignatureAlgorithm:
+		return nil, fmt.Errorf("channel binding not supported for %s certificates", cert.SignatureAlgorithm)
+	default:
+		h = sha256.New()
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil), nil
+}
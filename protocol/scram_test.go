@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Example exchange from RFC 7677 section 3
+func TestSCRAMClientRFC7677(t *testing.T) {
+	client := &scramClient{
+		username:    "user",
+		password:    "pencil",
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		gs2Header:   "n,,",
+	}
+
+	if first := client.clientFirstMessage(); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("unexpected client-first-message %q", first)
+	}
+
+	final, err := client.clientFinalMessage(
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if final != expected {
+		t.Errorf("unexpected client-final-message %q", final)
+	}
+
+	if err := client.verifyServerFinal("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Error(err)
+	}
+	if err := client.verifyServerFinal("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Error("expected a wrong server signature to be rejected")
+	}
+}
+
+func TestSCRAMClientRejectsForeignNonce(t *testing.T) {
+	client := &scramClient{password: "pencil", clientNonce: "abc", gs2Header: "n,,"}
+	client.clientFirstMessage()
+
+	if _, err := client.clientFinalMessage("r=xyz123,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Error("expected a server nonce without the client nonce to be rejected")
+	}
+}
+
+func TestParseSASLMechanisms(t *testing.T) {
+	message := []byte{'R', 0, 0, 0, 0, 0, 0, 0, 10}
+	message = append(message, []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")...)
+
+	mechanisms := parseSASLMechanisms(message)
+	if !mechanisms[SCRAMSHA256] || !mechanisms[SCRAMSHA256Plus] || len(mechanisms) != 2 {
+		t.Errorf("unexpected mechanisms %v", mechanisms)
+	}
+}
+
+func TestChooseSASLMechanism(t *testing.T) {
+	binding := []byte("end point")
+	tests := []struct {
+		mechanisms []string
+		binding    []byte
+		mechanism  string
+		gs2Header  string
+	}{
+		{[]string{SCRAMSHA256Plus, SCRAMSHA256}, binding, SCRAMSHA256Plus, "p=tls-server-end-point,,"},
+		{[]string{SCRAMSHA256}, binding, SCRAMSHA256, "y,,"},
+		// TLS without binding data, say for an unsupported certificate
+		{[]string{SCRAMSHA256Plus, SCRAMSHA256}, nil, SCRAMSHA256, "n,,"},
+		{[]string{SCRAMSHA256}, nil, SCRAMSHA256, "n,,"},
+		{[]string{SCRAMSHA256Plus}, nil, "", ""},
+		{[]string{"OTHER"}, binding, "", ""},
+	}
+	for _, test := range tests {
+		mechanisms := make(map[string]bool)
+		for _, mechanism := range test.mechanisms {
+			mechanisms[mechanism] = true
+		}
+		mechanism, gs2Header, data := chooseSASLMechanism(mechanisms, test.binding)
+		if mechanism != test.mechanism || gs2Header != test.gs2Header {
+			t.Errorf("%v with binding %q: expected %q %q, got %q %q",
+				test.mechanisms, test.binding, test.mechanism, test.gs2Header, mechanism, gs2Header)
+		}
+		if (data != nil) != (mechanism == SCRAMSHA256Plus) {
+			t.Errorf("%v with binding %q: unexpected binding data %q", test.mechanisms, test.binding, data)
+		}
+	}
+}
+
+func TestWithoutChannelBinding(t *testing.T) {
+	offered := NewAuthenticationSASLMessage([]string{SCRAMSHA256Plus, SCRAMSHA256})
+	expected := NewAuthenticationSASLMessage([]string{SCRAMSHA256})
+	if got := withoutChannelBinding(offered); !bytes.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	md5 := NewAuthenticationMD5Message([]byte("salt"))
+	if got := withoutChannelBinding(md5); !bytes.Equal(got, md5) {
+		t.Errorf("expected %q unchanged, got %q", md5, got)
+	}
+}
+
+func TestNewSASLInitialResponseMessage(t *testing.T) {
+	message := NewSASLInitialResponseMessage(SCRAMSHA256, []byte("n,,n=,r=abc"))
+
+	if int(GetMessageLength(message))+1 != len(message) {
+		t.Errorf("length %d does not match message of %d bytes", GetMessageLength(message), len(message))
+	}
+	expected := append([]byte("SCRAM-SHA-256\x00"), 0, 0, 0, 11)
+	expected = append(expected, []byte("n,,n=,r=abc")...)
+	if !bytes.Equal(message[5:], expected) {
+		t.Errorf("unexpected body %q", message[5:])
+	}
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrNoStartupUser is returned by ParseStartupMessage for a startup message
+// without a user, which postgres rejects as well.
+var ErrNoStartupUser = errors.New("no PostgreSQL user name specified in startup packet")
+
+// Startup holds what a client asked for in its StartupMessage.
+type Startup struct {
+	ProtocolVersion int32
+	User            string
+	// the user's name if the client did not name a database, like postgres
+	// does
+	Database        string
+	ApplicationName string
+	// command-line arguments for the backend, e.g. "-c search_path=app"
+	Options string
+	// every parameter sent, including the ones above
+	Parameters map[string]string
+}
+
+// ParseStartupMessage reads a StartupMessage of protocol version 3.
+func ParseStartupMessage(message []byte) (*Startup, error) {
+	if len(message) < 8 {
+		return nil, errors.New("malformed StartupMessage")
+	}
+	version := int32(binary.BigEndian.Uint32(message[4:8]))
+	if version>>16 != ProtocolVersion>>16 {
+		return nil, fmt.Errorf("unsupported frontend protocol %d.%d", version>>16, version&0xffff)
+	}
+
+	parameters := GetStartupParameters(message)
+	startup := &Startup{
+		ProtocolVersion: version,
+		User:            parameters["user"],
+		Database:        parameters["database"],
+		ApplicationName: parameters["application_name"],
+		Options:         parameters["options"],
+		Parameters:      parameters,
+	}
+	if startup.User == "" {
+		return nil, ErrNoStartupUser
+	}
+	if startup.Database == "" {
+		startup.Database = startup.User
+	}
+	return startup, nil
+}
+
+// ParseStartupOptions reads the run-time parameters set by the options of a
+// startup message, backend command-line arguments of the form
+// "-c name=value", "-cname=value" or "--name=value". Arguments are separated
+// by spaces, a backslash escapes the character after it. As in postgres,
+// dashes in names stand for underscores. Other arguments are rejected since
+// they cannot be applied to a connection that is already open.
+func ParseStartupOptions(options string) (map[string]string, error) {
+	parameters := make(map[string]string)
+	args := splitStartupOptions(options)
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch arg := args[i]; {
+		case arg == "-c" && i+1 < len(args):
+			i++
+			setting = args[i]
+		case strings.HasPrefix(arg, "--"):
+			setting = arg[2:]
+		case strings.HasPrefix(arg, "-c") && len(arg) > 2:
+			setting = arg[2:]
+		default:
+			return nil, fmt.Errorf("unsupported startup option \"%s\"", arg)
+		}
+
+		equals := strings.IndexByte(setting, '=')
+		if equals < 1 {
+			return nil, fmt.Errorf("startup option \"%s\" requires a value", setting)
+		}
+		name := strings.Replace(setting[:equals], "-", "_", -1)
+		parameters[name] = setting[equals+1:]
+	}
+	return parameters, nil
+}
+
+// splitStartupOptions splits options into arguments at unescaped spaces.
+func splitStartupOptions(options string) []string {
+	var args []string
+	var arg strings.Builder
+	escaped := false
+	for _, r := range options {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case unicode.IsSpace(r):
+			if arg.Len() > 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	if arg.Len() > 0 {
+		args = append(args, arg.String())
+	}
+	return args
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseStartupMessage(t *testing.T) {
+	message := NewStartupMessage("alice", "app", map[string]string{
+		"application_name": "psql",
+		"options":          "-c search_path=app",
+	})
+	startup, err := ParseStartupMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startup.User != "alice" || startup.Database != "app" || startup.ApplicationName != "psql" ||
+		startup.Options != "-c search_path=app" || startup.ProtocolVersion != ProtocolVersion {
+		t.Errorf("unexpected startup %+v", startup)
+	}
+	if startup.Parameters["application_name"] != "psql" {
+		t.Errorf("expected every parameter, got %v", startup.Parameters)
+	}
+
+	// the database defaults to the user name
+	startup, err = ParseStartupMessage(NewStartupMessage("alice", "", map[string]string{}))
+	if err != nil || startup.Database != "alice" {
+		t.Errorf("expected database alice, got %+v, %v", startup, err)
+	}
+
+	if _, err := ParseStartupMessage(NewStartupMessage("", "app", map[string]string{})); err != ErrNoStartupUser {
+		t.Errorf("expected ErrNoStartupUser, got %v", err)
+	}
+
+	// protocol version 2
+	binary.BigEndian.PutUint32(message[4:8], 2<<16)
+	if _, err := ParseStartupMessage(message); err == nil {
+		t.Error("expected an error for protocol version 2")
+	}
+}
+
+func TestParseStartupOptions(t *testing.T) {
+	parameters, err := ParseStartupOptions(`-c search_path=app,public -cstatement_timeout=5s --lock-timeout=1s -c application_name=my\ app`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"search_path":       "app,public",
+		"statement_timeout": "5s",
+		"lock_timeout":      "1s",
+		"application_name":  "my app",
+	}
+	if len(parameters) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, parameters)
+	}
+	for name, value := range expected {
+		if parameters[name] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, parameters[name])
+		}
+	}
+
+	for _, options := range []string{"-d 1", "-c", "-c search_path", "--=x"} {
+		if _, err := ParseStartupOptions(options); err == nil {
+			t.Errorf("%q: expected an error", options)
+		}
+	}
+}
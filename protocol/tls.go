@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrSSLNotAllowed is returned by StartTLS when the server refused the
+// SSLRequest.
+var ErrSSLNotAllowed = errors.New("server does not support SSL")
+
+// StartTLS sends an SSLRequest over a fresh connection to a server and, if
+// the server accepts, performs the TLS handshake. It must be called before
+// anything else is sent and before the connection is wrapped in a Conn.
+func StartTLS(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	if _, err := conn.Write(NewSSLRequestMessage()); err != nil {
+		return nil, err
+	}
+
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+
+	switch answer[0] {
+	case SSLAllowed:
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	case SSLNotAllowed:
+		return nil, ErrSSLNotAllowed
+	}
+	// servers older than 7.0 answered with an ErrorResponse
+	return nil, errors.New("unexpected response to SSLRequest")
+}
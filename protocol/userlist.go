@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Userlist maps user names to the secrets rocky authenticates clients with.
+//
+// The file format is the one pgbouncer uses for its auth_file, one user per
+// line with both fields in double quotes:
+//
+//	"alice" "plaintext password"
+//	"bob" "md5d0b4b6d4b69e0a48bbd2b5d6c4e1e5b2"
+//	"carol" "SCRAM-SHA-256$4096:c2FsdA==$c3RvcmVkIGtleQ==:c2VydmVyIGtleQ=="
+//
+// The md5 form is "md5" followed by md5(password + username) in hex and the
+// SCRAM form is the verifier stored in pg_authid. Lines starting with ';' or
+// '#' are comments. A quote inside a field is written as two quotes.
+type Userlist map[string]string
+
+// LoadUserlist reads a userlist file.
+func LoadUserlist(path string) (Userlist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(Userlist)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		fields, err := parseQuotedFields(line)
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"username\" \"password\"", path, lineNumber)
+		}
+		users[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func parseQuotedFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] != '"' {
+			return nil, errors.New("field is not quoted")
+		}
+
+		var field strings.Builder
+		i := 1
+		for {
+			if i >= len(line) {
+				return nil, errors.New("unterminated quote")
+			}
+			if line[i] == '"' {
+				if i+1 < len(line) && line[i+1] == '"' {
+					field.WriteByte('"')
+					i += 2
+					continue
+				}
+				break
+			}
+			field.WriteByte(line[i])
+			i++
+		}
+		fields = append(fields, field.String())
+		line = line[i+1:]
+	}
+}
+
+// isMD5Secret reports whether a userlist secret is an md5 hash rather than a
+// plaintext password.
+func isMD5Secret(secret string) bool {
+	if len(secret) != 35 || !strings.HasPrefix(secret, "md5") {
+		return false
+	}
+	for _, c := range secret[3:] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// scramSecret holds the parts of a SCRAM-SHA-256 verifier.
+type scramSecret struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// parseSCRAMSecret reads a verifier in the
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey> form. ok is false
+// if secret is not a verifier.
+func parseSCRAMSecret(secret string) (*scramSecret, bool) {
+	if !strings.HasPrefix(secret, SCRAMSHA256+"$") {
+		return nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(secret, SCRAMSHA256+"$"), "$")
+	if len(parts) != 2 {
+		return nil, false
+	}
+	iterationsAndSalt := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(iterationsAndSalt) != 2 || len(keys) != 2 {
+		return nil, false
+	}
+
+	iterations, err := strconv.Atoi(iterationsAndSalt[0])
+	if err != nil || iterations < 1 {
+		return nil, false
+	}
+	salt, err := base64.StdEncoding.DecodeString(iterationsAndSalt[1])
+	if err != nil {
+		return nil, false
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil {
+		return nil, false
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	if err != nil {
+		return nil, false
+	}
+
+	return &scramSecret{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey,
+		serverKey:  serverKey,
+	}, true
+}
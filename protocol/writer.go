@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Writer writes complete PostgreSQL messages to a stream.
+//
+// Messages are buffered until Flush is called so that several messages can go
+// out in a single packet. A message is only accepted if its length field
+// matches its size, which keeps partially built messages off the wire.
+type Writer struct {
+	writer *bufio.Writer
+}
+
+// NewWriter creates a Writer on top of w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		writer: bufio.NewWriter(w),
+	}
+}
+
+// WriteMessage buffers one typed message.
+func (w *Writer) WriteMessage(message []byte) error {
+	if len(message) < 5 || int(GetMessageLength(message))+1 != len(message) {
+		return fmt.Errorf("refusing to write malformed message of %d bytes", len(message))
+	}
+	_, err := w.writer.Write(message)
+	return err
+}
+
+// WriteStartupMessage buffers one untyped startup-phase message.
+func (w *Writer) WriteStartupMessage(message []byte) error {
+	if len(message) < 8 || int(GetMessageLength(append([]byte{0}, message[:4]...))) != len(message) {
+		return fmt.Errorf("refusing to write malformed startup message of %d bytes", len(message))
+	}
+	_, err := w.writer.Write(message)
+	return err
+}
+
+// Flush sends everything buffered so far.
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
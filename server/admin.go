@@ -0,0 +1,446 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// AdminDatabase is the virtual database clients connect to for the admin
+// console. It answers a few commands modeled on pgbouncer's console instead
+// of relaying to a backend:
+//
+//	SHOW POOLS | CLIENTS | SERVERS | CONFIG | HEALTH | DATABASES | LIMITS
+//	PAUSE [backend]   stop handing out connections and wait for active ones
+//	RESUME [backend]  undo PAUSE
+//	RELOAD            re-read the config file, or the auth file
+//	KILL backend      disconnect the backend's clients and idle connections
+const AdminDatabase = "rocky"
+
+// clientInfo is one row of SHOW CLIENTS.
+type clientInfo struct {
+	user        string
+	database    string
+	backend     string
+	state       string
+	addr        string
+	tls         bool
+	admin       bool
+	connectedAt time.Time
+}
+
+// startAdmin authenticates a client connecting to the admin database and
+// checks that it is one of the admin users.
+func (s *Session) startAdmin(startupMessage []byte) error {
+	params := protocol.GetStartupParameters(startupMessage)
+	user := params["user"]
+
+	setup := s.srv.current()
+	if s.db == nil {
+		// on a routed listener admin logins are checked against the
+		// database a route for the admin database leads to, or the first
+		// backend
+		db := setup.router.resolve(AdminDatabase, user)
+		if db == nil {
+			db = setup.databases[setup.settings.BackendHosts[0].Name]
+		}
+		s.setDatabase(db)
+	}
+
+	if err := s.authenticate(startupMessage); err != nil {
+		return err
+	}
+
+	if !s.srv.isAdminUser(user) {
+		s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal, protocol.SQLStateInvalidAuthorization,
+			fmt.Sprintf("user \"%s\" is not allowed to use the admin console", user)))
+		return fmt.Errorf("user %q is not an admin user", user)
+	}
+
+	return s.client.Send(
+		protocol.NewParameterStatusMessage("client_encoding", "UTF8"),
+		protocol.NewParameterStatusMessage("server_encoding", "UTF8"),
+		protocol.NewReadyForQueryMessage(protocol.TransactionIdle),
+	)
+}
+
+// serveAdmin answers admin console queries until the client leaves. Only the
+// simple query protocol is supported.
+func (s *Session) serveAdmin() error {
+	// after an error the rest of an extended query is skipped up to Sync
+	skipping := false
+	for {
+		message, err := s.client.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch protocol.GetMessageType(message) {
+		case protocol.TerminateMessageType:
+			return nil
+		case protocol.QueryMessageType:
+			query := strings.TrimRight(string(message[5:]), "\x00")
+			messages := append(s.srv.adminCommand(query),
+				protocol.NewReadyForQueryMessage(protocol.TransactionIdle))
+			if err := s.client.Send(messages...); err != nil {
+				return err
+			}
+		case protocol.SyncMessageType:
+			skipping = false
+			if err := s.client.Send(protocol.NewReadyForQueryMessage(protocol.TransactionIdle)); err != nil {
+				return err
+			}
+		default:
+			if skipping {
+				continue
+			}
+			skipping = true
+			if err := s.client.Send(protocol.NewProtocolViolationError(
+				"the admin console only supports simple queries").Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// adminCommand runs a single admin console command and returns the messages
+// answering it, without the final ReadyForQuery.
+func (s *Server) adminCommand(query string) [][]byte {
+	words := strings.Fields(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if len(words) == 0 {
+		return [][]byte{protocol.NewEmptyQueryResponseMessage()}
+	}
+	command := strings.ToUpper(words[0])
+	args := words[1:]
+
+	switch {
+	case command == "SHOW" && len(args) == 1:
+		switch strings.ToUpper(args[0]) {
+		case "POOLS":
+			return result("SHOW", []string{"database", "host", "pool_mode", "cl_active", "cl_waiting",
+				"sv_active", "sv_idle", "capacity", "paused"}, s.showPools())
+		case "CLIENTS":
+			return result("SHOW", []string{"user", "database", "backend", "state", "addr", "tls",
+				"connect_time"}, s.showClients())
+		case "SERVERS":
+			return result("SHOW", []string{"database", "state", "addr", "local_addr", "tls",
+				"connect_time"}, s.showServers())
+		case "CONFIG":
+			return result("SHOW", []string{"key", "value"}, s.showConfig())
+		case "DATABASES":
+			return result("SHOW", []string{"name", "proxy_port", "primary", "replicas", "candidates"},
+				s.showDatabases())
+		case "HEALTH":
+			return result("SHOW", []string{"database", "status", "role", "replica_lag", "check_time",
+				"successes", "failures", "last_error"}, s.showHealth())
+		case "LIMITS":
+			return result("SHOW", []string{"scope", "name", "clients", "max"}, s.showLimits())
+		}
+	case (command == "PAUSE" || command == "RESUME") && len(args) <= 1:
+		pools, err := s.adminPools(args)
+		if err != nil {
+			return adminError(protocol.SQLStateInvalidCatalogName, err.Error())
+		}
+		for _, p := range pools {
+			if command == "PAUSE" {
+				p.Pause()
+			} else {
+				p.Resume()
+			}
+		}
+		return [][]byte{protocol.NewCommandCompleteMessage(command)}
+	case command == "RELOAD" && len(args) == 0:
+		if err := s.Reload(); err != nil {
+			return adminError(protocol.SQLStateSystemError, err.Error())
+		}
+		return [][]byte{protocol.NewCommandCompleteMessage(command)}
+	case command == "KILL" && len(args) == 1:
+		pools, err := s.adminPools(args)
+		if err != nil {
+			return adminError(protocol.SQLStateInvalidCatalogName, err.Error())
+		}
+		s.kill(pools[0])
+		return [][]byte{protocol.NewCommandCompleteMessage(command)}
+	}
+
+	return [][]byte{protocol.NewErrorResponse(protocol.SeverityError, protocol.SQLStateSyntaxError,
+		fmt.Sprintf("unknown admin command \"%s\"", strings.TrimSpace(query)))}
+}
+
+// adminError is the answer to a failed admin command.
+func adminError(code, message string) [][]byte {
+	return [][]byte{protocol.NewErrorResponse(protocol.SeverityError, code, message)}
+}
+
+// result builds the messages of a query result.
+func result(tag string, columns []string, rows [][]string) [][]byte {
+	messages := [][]byte{protocol.NewRowDescriptionMessage(columns)}
+	for _, row := range rows {
+		messages = append(messages, protocol.NewDataRowMessage(row))
+	}
+	return append(messages, protocol.NewCommandCompleteMessage(tag))
+}
+
+// adminPools returns the pool named by args, or every pool if args is empty.
+func (s *Server) adminPools(args []string) ([]*pool.Pool, error) {
+	setup := s.current()
+	if len(args) == 0 {
+		var pools []*pool.Pool
+		for _, name := range setup.poolNames() {
+			pools = append(pools, setup.pools[name])
+		}
+		return pools, nil
+	}
+	p, ok := setup.pools[args[0]]
+	if !ok {
+		return nil, errors.New("no such database: " + args[0])
+	}
+	return []*pool.Pool{p}, nil
+}
+
+// kill disconnects every client of a pool and closes its idle connections.
+// Connections in use are closed as their sessions end.
+func (s *Server) kill(p *pool.Pool) {
+	for _, session := range s.sessionList() {
+		if db := session.target(); db != nil && db.uses(p) && !session.info().admin {
+			session.Close()
+		}
+	}
+	p.CloseIdle()
+}
+
+func (s *Server) isAdminUser(user string) bool {
+	for _, admin := range s.current().settings.AdminUsers {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) showPools() [][]string {
+	// clients of a logical database count towards its primary
+	clients := make(map[string]int)
+	for _, session := range s.sessionList() {
+		if info := session.info(); !info.admin && session.target() != nil {
+			clients[session.target().primaryPool().Name()]++
+		}
+	}
+
+	setup := s.current()
+	var rows [][]string
+	for _, name := range setup.poolNames() {
+		p := setup.pools[name]
+		stats := p.Stats()
+		backend := p.Config()
+		rows = append(rows, []string{
+			name,
+			backend.Port,
+			string(poolMode(backend)),
+			strconv.Itoa(clients[name]),
+			strconv.Itoa(stats.Waiting),
+			strconv.Itoa(stats.Active),
+			strconv.Itoa(stats.Idle),
+			strconv.Itoa(backend.Capacity),
+			strconv.FormatBool(p.Paused()),
+		})
+	}
+	return rows
+}
+
+func (s *Server) showClients() [][]string {
+	var infos []clientInfo
+	for _, session := range s.sessionList() {
+		infos = append(infos, session.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].connectedAt.Before(infos[j].connectedAt) })
+
+	var rows [][]string
+	for _, info := range infos {
+		rows = append(rows, []string{
+			info.user,
+			info.database,
+			info.backend,
+			info.state,
+			info.addr,
+			strconv.FormatBool(info.tls),
+			info.connectedAt.Format(time.RFC3339),
+		})
+	}
+	return rows
+}
+
+func (s *Server) showServers() [][]string {
+	setup := s.current()
+	var rows [][]string
+	for _, name := range setup.poolNames() {
+		servers := setup.pools[name].Servers()
+		sort.Slice(servers, func(i, j int) bool { return servers[i].ConnectedAt.Before(servers[j].ConnectedAt) })
+		for _, server := range servers {
+			state := "idle"
+			if server.Active {
+				state = "active"
+			}
+			rows = append(rows, []string{
+				name,
+				state,
+				server.RemoteAddr,
+				server.LocalAddr,
+				strconv.FormatBool(server.TLS),
+				server.ConnectedAt.Format(time.RFC3339),
+			})
+		}
+	}
+	return rows
+}
+
+// showDatabases lists the logical databases with the primary they currently
+// write to.
+func (s *Server) showDatabases() [][]string {
+	names := func(pools []*pool.Pool) string {
+		var names []string
+		for _, p := range pools {
+			names = append(names, p.Name())
+		}
+		return strings.Join(names, ",")
+	}
+
+	setup := s.current()
+	var rows [][]string
+	for _, setting := range setup.settings.Databases {
+		db := setup.databases[setting.Name]
+		rows = append(rows, []string{
+			db.name,
+			strconv.Itoa(db.proxyPort),
+			db.primaryPool().Name(),
+			names(db.replicas),
+			names(db.candidates),
+		})
+	}
+	return rows
+}
+
+func (s *Server) showHealth() [][]string {
+	setup := s.current()
+	var rows [][]string
+	for _, name := range setup.poolNames() {
+		health := setup.pools[name].Health()
+		status, lag, checkTime := "down", "", ""
+		if health.Up {
+			status = "up"
+		}
+		if health.ReplicaLag >= 0 {
+			lag = health.ReplicaLag.String()
+		}
+		if !health.CheckedAt.IsZero() {
+			checkTime = health.CheckedAt.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{
+			name,
+			status,
+			string(health.Role),
+			lag,
+			checkTime,
+			strconv.Itoa(health.Successes),
+			strconv.Itoa(health.Failures),
+			health.LastError,
+		})
+	}
+	return rows
+}
+
+// showConfig lists the settings in effect, leaving out passwords.
+func (s *Server) showConfig() [][]string {
+	setup := s.current()
+	settings := setup.settings
+	rows := [][]string{
+		{"host_port", settings.HostPort},
+		{"connection_max", strconv.Itoa(settings.ConnectionMax)},
+		{"user_connection_max", strconv.Itoa(settings.UserConnectionMax)},
+		{"max_message_size", strconv.Itoa(settings.MaxMessageSize)},
+		{"auth_type", string(settings.AuthType)},
+		{"auth_file", settings.AuthFile},
+		{"admin_users", strings.Join(settings.AdminUsers, ",")},
+		{"client_tls_cert_file", settings.ClientTLS.CertFile},
+		{"client_tls_key_file", settings.ClientTLS.KeyFile},
+		{"client_tls_ca_file", settings.ClientTLS.CAFile},
+		{"client_tls_client_cert", string(settings.ClientTLS.ClientCert)},
+		{"require_tls", strconv.FormatBool(settings.ClientTLS.Require)},
+	}
+
+	for _, name := range setup.poolNames() {
+		backend := setup.pools[name].Config()
+		prefix := "backend_" + name + "."
+		rows = append(rows,
+			[]string{prefix + "host_port", backend.Port},
+			[]string{prefix + "username", backend.Username},
+			[]string{prefix + "database", backend.Database},
+			[]string{prefix + "proxy_port", strconv.Itoa(backend.ProxyPort)},
+			[]string{prefix + "capacity", strconv.Itoa(backend.Capacity)},
+			[]string{prefix + "connection_max", strconv.Itoa(setup.connectionMax(name))},
+			[]string{prefix + "weight", strconv.Itoa(backend.Weight)},
+			[]string{prefix + "min_idle", strconv.Itoa(backend.MinIdle)},
+			[]string{prefix + "max_idle", strconv.Itoa(backend.MaxIdle)},
+			[]string{prefix + "idle_timeout", backend.IdleTimeout.String()},
+			[]string{prefix + "max_lifetime", backend.MaxLifetime.String()},
+			[]string{prefix + "pool_timeout", backend.PoolTimeout.String()},
+			[]string{prefix + "pool_mode", string(poolMode(backend))},
+			[]string{prefix + "max_prepared_statements", strconv.Itoa(backend.MaxPreparedStatements)},
+			[]string{prefix + "server_reset_query", backend.ServerResetQuery},
+			[]string{prefix + "server_reset_query_always", strconv.FormatBool(backend.ServerResetQueryAlways)},
+			[]string{prefix + "server_check_query", backend.ServerCheckQuery},
+			[]string{prefix + "server_check_delay", backend.ServerCheckDelay.String()},
+			[]string{prefix + "health_check_interval", backend.HealthCheckInterval.String()},
+			[]string{prefix + "health_check_query", backend.HealthCheckQuery},
+			[]string{prefix + "health_check_role", strconv.FormatBool(backend.HealthCheckRole)},
+			[]string{prefix + "health_check_rise", strconv.Itoa(backend.HealthCheckRise)},
+			[]string{prefix + "health_check_fall", strconv.Itoa(backend.HealthCheckFall)},
+			[]string{prefix + "sslmode", string(backend.SSLMode)},
+		)
+		var options []string
+		for option := range backend.Options {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			rows = append(rows, []string{prefix + "options." + option, backend.Options[option]})
+		}
+	}
+	for _, db := range settings.Databases {
+		prefix := "database_" + db.Name + "."
+		rows = append(rows,
+			[]string{prefix + "proxy_port", strconv.Itoa(db.ProxyPort)},
+			[]string{prefix + "connection_max", strconv.Itoa(db.ConnectionMax)},
+			[]string{prefix + "primary", db.Primary},
+			[]string{prefix + "candidates", strings.Join(db.Candidates, ",")},
+			[]string{prefix + "replicas", strings.Join(db.Replicas, ",")},
+			[]string{prefix + "balance", string(db.Balance)},
+			[]string{prefix + "max_replica_lag", db.MaxReplicaLag.String()},
+			[]string{prefix + "sticky_primary", db.StickyPrimary.String()},
+		)
+	}
+	for _, route := range settings.Routes {
+		prefix := "route_" + route.Name + "."
+		rows = append(rows,
+			[]string{prefix + "database", route.Database},
+			[]string{prefix + "user", route.User},
+			[]string{prefix + "target", route.Target},
+		)
+	}
+	return rows
+}
+
+// poolMode is the backend's pool mode, session if unset.
+func poolMode(backend *config.BackendHostSetting) config.PoolMode {
+	if backend.PoolMode == "" {
+		return config.SessionPooling
+	}
+	return backend.PoolMode
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/msgbuf"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+func startAdminServer(t *testing.T, fb *fakeBackend) (*Server, string) {
+	return startServerWith(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{testBackend(fb)},
+		AdminUsers:   []string{"admin"},
+	})
+}
+
+// connectAdmin logs user in to the admin console and returns the first
+// message after AuthenticationOk.
+func connectAdmin(t *testing.T, addr, user string) (*protocol.Conn, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	client.WriteStartupMessage(protocol.NewStartupMessage(user, AdminDatabase, map[string]string{}))
+	client.Flush()
+
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %v", message)
+	}
+	return client, readMessage(t, client)
+}
+
+// adminClient logs in to the admin console as an admin user.
+func adminClient(t *testing.T, addr string) *protocol.Conn {
+	client, message := connectAdmin(t, addr, "admin")
+	for protocol.GetMessageType(message) != protocol.ReadyForQueryMessageType {
+		if protocol.GetMessageType(message) == protocol.ErrorMessageType {
+			t.Fatalf("admin login failed: %q", message[5:])
+		}
+		message = readMessage(t, client)
+	}
+	return client
+}
+
+// adminQuery runs an admin command and returns the rows of its result.
+func adminQuery(t *testing.T, client *protocol.Conn, command string) [][]string {
+	client.Send(queryMessage(command))
+
+	var rows [][]string
+	for {
+		message := readMessage(t, client)
+		switch protocol.GetMessageType(message) {
+		case protocol.ErrorMessageType:
+			t.Fatalf("%s failed: %q", command, message[5:])
+		case protocol.DataRowMessageType:
+			buffer := msgbuf.New(message[5:])
+			count, _ := buffer.ReadInt16()
+			row := make([]string, count)
+			for i := range row {
+				length, _ := buffer.ReadInt32()
+				value, _ := buffer.ReadBytes(int(length))
+				row[i] = string(value)
+			}
+			rows = append(rows, row)
+		case protocol.ReadyForQueryMessageType:
+			return rows
+		}
+	}
+}
+
+func TestAdminShow(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startAdminServer(t, fb)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	admin := adminClient(t, addr)
+	defer admin.Close()
+
+	pools := adminQuery(t, admin, "show pools;")
+	if len(pools) != 1 || pools[0][0] != "test" {
+		t.Fatalf("expected a row for the test pool, got %v", pools)
+	}
+	// the client holds the only connection in session mode
+	if clients, active := pools[0][3], pools[0][5]; clients != "1" || active != "1" {
+		t.Errorf("expected 1 client and 1 active server, got %v", pools[0])
+	}
+
+	if clients := adminQuery(t, admin, "SHOW CLIENTS"); len(clients) != 2 {
+		t.Errorf("expected the client and the admin session, got %v", clients)
+	}
+	if servers := adminQuery(t, admin, "SHOW SERVERS"); len(servers) != 1 || servers[0][1] != "active" {
+		t.Errorf("expected 1 active server, got %v", servers)
+	}
+
+	if health := adminQuery(t, admin, "SHOW HEALTH"); len(health) != 1 || health[0][1] != "up" {
+		t.Errorf("expected the test backend to be up, got %v", health)
+	}
+
+	admin.Send(queryMessage("SHOW NOTHING"))
+	expectMessage(t, admin, protocol.ErrorMessageType)
+	expectMessage(t, admin, protocol.ReadyForQueryMessageType)
+}
+
+func TestAdminRequiresAdminUser(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startAdminServer(t, fb)
+	defer srv.Close()
+
+	client, message := connectAdmin(t, addr, "test")
+	defer client.Close()
+	if protocol.GetMessageType(message) != protocol.ErrorMessageType {
+		t.Errorf("expected ErrorResponse, got %v", message)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{backend},
+		AdminUsers:   []string{"admin"},
+	})
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+
+	admin := adminClient(t, addr)
+	defer admin.Close()
+	adminQuery(t, admin, "PAUSE test")
+
+	// queries wait while the pool is paused
+	client.Send(queryMessage("select 1"))
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := client.ReadMessage(); err == nil {
+		t.Fatal("expected no answer while paused")
+	}
+	client.SetReadDeadline(time.Time{})
+
+	adminQuery(t, admin, "RESUME")
+	expectMessage(t, client, protocol.CommandCompleteMessageType)
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+}
+
+func TestAdminKill(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startAdminServer(t, fb)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	admin := adminClient(t, addr)
+	defer admin.Close()
+	adminQuery(t, admin, "KILL test")
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.ReadMessage(); err == nil {
+		t.Error("expected the client to be disconnected")
+	}
+	// the admin session stays up
+	adminQuery(t, admin, "SHOW POOLS")
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+)
+
+// Balancer picks the backend serving a client out of equivalent ones, the
+// replicas of a logical database.
+type Balancer interface {
+	// Pick returns one of backends, which only holds healthy ones and is
+	// never empty. addr is the client's address and user the name it logged
+	// in with.
+	Pick(backends []*pool.Pool, addr, user string) *pool.Pool
+}
+
+// NewBalancer returns the Balancer for a balance setting, round-robin if it
+// is unknown.
+func NewBalancer(balance config.Balance) Balancer {
+	switch balance {
+	case config.BalanceLeastActive:
+		return leastActive{}
+	case config.BalanceWeightedRandom:
+		return &weightedRandom{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	case config.BalanceHashAddress:
+		return hashBalancer{key: func(addr, user string) string { return addrHost(addr) }}
+	case config.BalanceHashUser:
+		return hashBalancer{key: func(addr, user string) string { return user }}
+	}
+	return &roundRobin{}
+}
+
+// roundRobin has the backends take turns.
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (b *roundRobin) Pick(backends []*pool.Pool, addr, user string) *pool.Pool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next = (b.next + 1) % len(backends)
+	return backends[b.next]
+}
+
+// leastActive picks the backend with the fewest connections handed out or
+// waited for, the first of them on a tie.
+type leastActive struct{}
+
+func (leastActive) Pick(backends []*pool.Pool, addr, user string) *pool.Pool {
+	var picked *pool.Pool
+	least := 0
+	for _, backend := range backends {
+		stats := backend.Stats()
+		if active := stats.Active + stats.Waiting; picked == nil || active < least {
+			picked, least = backend, active
+		}
+	}
+	return picked
+}
+
+// weightedRandom picks a random backend, each as likely as its weight.
+// Backends without a positive weight are only picked if all of them are.
+type weightedRandom struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (b *weightedRandom) Pick(backends []*pool.Pool, addr, user string) *pool.Pool {
+	total := 0
+	for _, backend := range backends {
+		if weight := backend.Config().Weight; weight > 0 {
+			total += weight
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if total == 0 {
+		return backends[b.rand.Intn(len(backends))]
+	}
+	n := b.rand.Intn(total)
+	for _, backend := range backends {
+		if weight := backend.Config().Weight; weight > 0 {
+			if n < weight {
+				return backend
+			}
+			n -= weight
+		}
+	}
+	return backends[len(backends)-1]
+}
+
+// hashBalancer gives every client the backend scoring highest for its key,
+// rendezvous hashing, so a backend going away or coming back only moves the
+// clients it is picked for.
+type hashBalancer struct {
+	key func(addr, user string) string
+}
+
+func (b hashBalancer) Pick(backends []*pool.Pool, addr, user string) *pool.Pool {
+	key := b.key(addr, user)
+	var picked *pool.Pool
+	var highest uint64
+	for _, backend := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(backend.Name()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := h.Sum64(); picked == nil || score > highest {
+			picked, highest = backend, score
+		}
+	}
+	return picked
+}
+
+// addrHost is the host of a client address, so that the connections of a
+// client hash the same whatever their port.
+func addrHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
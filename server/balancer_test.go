@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+)
+
+// newBalancerPools returns pools named after names that are never connected
+// to, with the given weights.
+func newBalancerPools(t *testing.T, names []string, weights []int) []*pool.Pool {
+	var pools []*pool.Pool
+	for i, name := range names {
+		p, err := pool.New(&config.BackendHostSetting{Name: name, Weight: weights[i]}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+func closePools(pools []*pool.Pool) {
+	for _, p := range pools {
+		p.Close()
+	}
+}
+
+// picks counts how often each backend is picked in n tries.
+func picks(b Balancer, backends []*pool.Pool, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.Pick(backends, "10.0.0.1:5000", "app").Name()]++
+	}
+	return counts
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	backends := newBalancerPools(t, []string{"a", "b", "c"}, []int{1, 1, 1})
+	defer closePools(backends)
+
+	counts := picks(NewBalancer(config.BalanceRoundRobin), backends, 30)
+	for _, backend := range backends {
+		if counts[backend.Name()] != 10 {
+			t.Errorf("expected every backend to be picked 10 times, got %v", counts)
+		}
+	}
+}
+
+func TestWeightedRandomBalancer(t *testing.T) {
+	backends := newBalancerPools(t, []string{"a", "b", "c"}, []int{3, 1, 0})
+	defer closePools(backends)
+
+	counts := picks(NewBalancer(config.BalanceWeightedRandom), backends, 4000)
+	if counts["c"] != 0 {
+		t.Errorf("expected a backend without weight not to be picked, got %v", counts)
+	}
+	if counts["a"] < 2*counts["b"] {
+		t.Errorf("expected a to be picked about three times as often as b, got %v", counts)
+	}
+}
+
+func TestLeastActiveBalancer(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	busy, err := pool.New(testBackend(fb), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	idle := newBalancerPools(t, []string{"idle"}, []int{1})
+	defer closePools(idle)
+
+	conn, err := busy.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Put(conn)
+
+	b := NewBalancer(config.BalanceLeastActive)
+	if picked := b.Pick([]*pool.Pool{busy, idle[0]}, "", ""); picked != idle[0] {
+		t.Errorf("expected the backend without active connections, got %s", picked.Name())
+	}
+}
+
+func TestHashBalancer(t *testing.T) {
+	backends := newBalancerPools(t, []string{"a", "b", "c", "d"}, []int{1, 1, 1, 1})
+	defer closePools(backends)
+
+	b := NewBalancer(config.BalanceHashAddress)
+	// the port of a client connection does not matter
+	picked := b.Pick(backends, "10.0.0.1:5000", "")
+	if other := b.Pick(backends, "10.0.0.1:6000", ""); other != picked {
+		t.Errorf("expected the same backend for the same host, got %s and %s", picked.Name(), other.Name())
+	}
+
+	// removing another backend keeps the client where it was
+	var rest []*pool.Pool
+	for _, backend := range backends {
+		if backend != picked {
+			rest = append(rest, backend)
+		}
+	}
+	if b.Pick(append(rest[1:], picked), "10.0.0.1:5000", "") != picked {
+		t.Error("expected the client to keep its backend when another one goes away")
+	}
+
+	users := make(map[string]bool)
+	b = NewBalancer(config.BalanceHashUser)
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		first := b.Pick(backends, "10.0.0.1:5000", user)
+		if b.Pick(backends, "10.0.0.2:5000", user) != first {
+			t.Errorf("expected user %s to get the same backend from any address", user)
+		}
+		users[first.Name()] = true
+	}
+	if len(users) < 2 {
+		t.Errorf("expected users to be spread over the backends, got %v", users)
+	}
+}
+
+func TestUnhealthyReplicaSkipped(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	// nothing listens on the address of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	down, err := pool.New(&config.BackendHostSetting{Name: "down", Port: listener.Addr().String(), Capacity: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+	up, err := pool.New(testBackend(fb), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+
+	db := &database{replicas: []*pool.Pool{down, up}, balancer: NewBalancer(config.BalanceRoundRobin)}
+	if _, err := down.Get(); err == nil {
+		t.Fatal("expected connecting to the stopped backend to fail")
+	}
+	for i := 0; i < 3; i++ {
+		if replica := db.replica("", ""); replica != up {
+			t.Fatalf("expected the healthy replica, got %v", replica)
+		}
+	}
+
+	up.Close()
+	if replica := db.replica("", ""); replica != nil {
+		t.Errorf("expected no replica once none is healthy, got %s", replica.Name())
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// Clients get a BackendKeyData of rocky's own rather than one of a backend
+// connection, since outside of session mode the connection serving them
+// changes between transactions. A CancelRequest carrying that key is
+// forwarded with the key of whichever connection serves the client at that
+// moment.
+
+// errCancelRequest ends a session that only delivered a CancelRequest.
+var errCancelRequest = errors.New("connection was a cancel request")
+
+// newCancelKeyLocked returns a random key no other session uses. s.mu must
+// be held.
+func (s *Server) newCancelKeyLocked() protocol.BackendKey {
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		key := protocol.BackendKey{
+			// process IDs are positive
+			ProcessID: int32(binary.BigEndian.Uint32(b[:4]) & 0x7fffffff),
+			SecretKey: int32(binary.BigEndian.Uint32(b[4:])),
+		}
+		if _, taken := s.cancelKeys[key]; !taken {
+			return key
+		}
+	}
+}
+
+// cancel forwards a CancelRequest to the backend connection serving the
+// client with the given key. Like postgres, rocky does not tell whether the
+// key matched anything.
+func (s *Server) cancel(key protocol.BackendKey) {
+	s.mu.Lock()
+	session := s.cancelKeys[key]
+	s.mu.Unlock()
+
+	if session == nil {
+		pLogger.Printf("cancel request with unknown key %d\n", key.ProcessID)
+		return
+	}
+	session.cancel()
+}
+
+// cancel cancels the query the session's backend connection is running, if
+// it has one.
+func (s *Session) cancel() {
+	// the pool goes with the connection, read together they cannot belong to
+	// different attachments
+	s.mu.Lock()
+	server, serverPool := s.server, s.serverPool
+	s.mu.Unlock()
+
+	if server == nil {
+		return
+	}
+	if err := serverPool.Cancel(server.Key); err != nil {
+		pLogger.Printf("session %s: could not cancel query on backend %s: %s\n",
+			s.client.RemoteAddr(), serverPool.Name(), err.Error())
+	}
+}
+
+// withClientKey replaces the BackendKeyData among a backend connection's
+// startup messages with the session's own key.
+func (s *Session) withClientKey(messages [][]byte) [][]byte {
+	replaced := make([][]byte, len(messages))
+	for i, message := range messages {
+		if protocol.GetMessageType(message) == protocol.BackendKeyDataMessageType {
+			message = protocol.NewBackendKeyDataMessage(s.key)
+		}
+		replaced[i] = message
+	}
+	return replaced
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// connectClientWithKey is connectClient that also returns the key the
+// client was given.
+func connectClientWithKey(t *testing.T, addr string) (*protocol.Conn, protocol.BackendKey) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+	client.Flush()
+
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %v", message)
+	}
+	return client, finishStartup(t, client)
+}
+
+// sendCancel sends a CancelRequest through the proxy and waits for the proxy
+// to close the connection.
+func sendCancel(t *testing.T, addr string, key protocol.BackendKey) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(protocol.NewCancelRequestMessage(key)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected no answer to a CancelRequest")
+	}
+}
+
+func TestCancelRequestRouting(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client, key := connectClientWithKey(t, addr)
+	defer client.Close()
+
+	// holding a transaction open keeps the backend connection attached
+	query(t, client, "begin")
+
+	var session *Session
+	for _, s := range srv.sessionList() {
+		session = s
+	}
+	session.mu.Lock()
+	serverKey := session.server.Key
+	session.mu.Unlock()
+	if key == serverKey {
+		t.Fatal("expected the client to get a key of rocky's own")
+	}
+
+	sendCancel(t, addr, key)
+	// the backend reads the request after rocky has moved on
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fb.Cancels()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancels := fb.Cancels()
+	if len(cancels) != 1 || cancels[0] != serverKey {
+		t.Errorf("expected a cancel for %+v, got %+v", serverKey, cancels)
+	}
+
+	// a client without a backend connection has nothing to cancel, and
+	// unknown keys are ignored
+	query(t, client, "commit")
+	sendCancel(t, addr, key)
+	sendCancel(t, addr, protocol.BackendKey{ProcessID: key.ProcessID, SecretKey: key.SecretKey + 1})
+	time.Sleep(50 * time.Millisecond)
+	if cancels := fb.Cancels(); len(cancels) != 1 {
+		t.Errorf("expected no more cancels, got %+v", cancels)
+	}
+}
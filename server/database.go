@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// replicaHint in a query sends it to a replica even when rocky cannot tell
+// that it is read-only.
+const replicaHint = "/* rocky:replica */"
+
+// primaryHint in a query keeps it on the primary even when it looks
+// read-only, for a SELECT calling a function that writes.
+const primaryHint = "/* rocky:primary */"
+
+// writingFunctions write or take locks although they are called from a
+// SELECT. Only the built in ones are known, see primaryHint.
+var writingFunctions = map[string]bool{
+	"nextval":                          true,
+	"setval":                           true,
+	"pg_advisory_lock":                 true,
+	"pg_advisory_lock_shared":          true,
+	"pg_advisory_unlock":               true,
+	"pg_advisory_unlock_shared":        true,
+	"pg_advisory_unlock_all":           true,
+	"pg_advisory_xact_lock":            true,
+	"pg_advisory_xact_lock_shared":     true,
+	"pg_try_advisory_lock":             true,
+	"pg_try_advisory_lock_shared":      true,
+	"pg_try_advisory_xact_lock":        true,
+	"pg_try_advisory_xact_lock_shared": true,
+}
+
+// database is what a session is connected to: a backend, or a logical
+// database whose read-only transactions can run on replicas while
+// everything else runs on the primary. Splitting happens per transaction, so
+// only outside of session pooling mode.
+type database struct {
+	name      string
+	proxyPort int
+	// backends the primary can move to, see watchPrimaries
+	candidates []*pool.Pool
+	replicas   []*pool.Pool
+	balancer   Balancer
+	// see config.DatabaseSetting
+	maxReplicaLag time.Duration
+	stickyPrimary time.Duration
+
+	mu      sync.Mutex
+	primary *pool.Pool
+}
+
+// newDatabases returns a database for every backend and every logical
+// database, by name.
+func newDatabases(settings config.RockyProxySettings, pools map[string]*pool.Pool) (map[string]*database, error) {
+	databases := make(map[string]*database)
+	for _, backend := range settings.BackendHosts {
+		databases[backend.Name] = &database{
+			name:      backend.Name,
+			proxyPort: backend.ProxyPort,
+			primary:   pools[backend.Name],
+		}
+	}
+
+	for _, setting := range settings.Databases {
+		if _, ok := databases[setting.Name]; ok {
+			return nil, fmt.Errorf("database %s: name already used by a backend", setting.Name)
+		}
+		primaryName := setting.Primary
+		if primaryName == "" && len(setting.Candidates) > 0 {
+			primaryName = setting.Candidates[0]
+		}
+		primary, ok := pools[primaryName]
+		if !ok {
+			return nil, fmt.Errorf("database %s: unknown primary backend %q", setting.Name, primaryName)
+		}
+		db := &database{
+			name:          setting.Name,
+			proxyPort:     setting.ProxyPort,
+			primary:       primary,
+			balancer:      NewBalancer(setting.Balance),
+			maxReplicaLag: setting.MaxReplicaLag,
+			stickyPrimary: setting.StickyPrimary,
+		}
+		for _, name := range setting.Replicas {
+			replica, ok := pools[name]
+			if !ok {
+				return nil, fmt.Errorf("database %s: unknown replica backend %q", setting.Name, name)
+			}
+			// the lag is measured by the health checks finding the role
+			if config := replica.Config(); setting.MaxReplicaLag > 0 &&
+				(config.HealthCheckInterval <= 0 || !config.HealthCheckRole) {
+				return nil, fmt.Errorf("database %s: max_replica_lag needs health_check_interval and health_check_role "+
+					"on replica backend %s", setting.Name, name)
+			}
+			db.replicas = append(db.replicas, replica)
+		}
+		for _, name := range setting.Candidates {
+			candidate, ok := pools[name]
+			if !ok {
+				return nil, fmt.Errorf("database %s: unknown candidate backend %q", setting.Name, name)
+			}
+			// the primary is recognized by the role health checks find
+			if config := candidate.Config(); config.HealthCheckInterval <= 0 || !config.HealthCheckRole {
+				return nil, fmt.Errorf("database %s: candidate backend %s needs health_check_interval and health_check_role",
+					setting.Name, name)
+			}
+			db.candidates = append(db.candidates, candidate)
+		}
+		databases[setting.Name] = db
+	}
+	return databases, nil
+}
+
+// primaryPool returns the pool of the current primary.
+func (db *database) primaryPool() *pool.Pool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.primary
+}
+
+// uses reports whether p is one of the database's backends.
+func (db *database) uses(p *pool.Pool) bool {
+	if db.primaryPool() == p {
+		return true
+	}
+	for _, backends := range [][]*pool.Pool{db.candidates, db.replicas} {
+		for _, backend := range backends {
+			if backend == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replica picks a healthy replica for a read-only transaction of the client
+// at addr logged in as user, nil if there is none. A replica promoted to
+// primary is left out, as are replicas lagging too far behind.
+func (db *database) replica(addr, user string) *pool.Pool {
+	primary := db.primaryPool()
+	var healthy []*pool.Pool
+	for _, replica := range db.replicas {
+		if replica != primary && replica.Healthy() && !db.lagging(replica) {
+			healthy = append(healthy, replica)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return db.balancer.Pick(healthy, addr, user)
+}
+
+// lagging reports whether replica is further behind than the database
+// allows, or might be.
+func (db *database) lagging(replica *pool.Pool) bool {
+	if db.maxReplicaLag <= 0 {
+		return false
+	}
+	lag := replica.Health().ReplicaLag
+	return lag < 0 || lag > db.maxReplicaLag
+}
+
+// route picks the pool for the transaction the client message starts. Reads
+// fall back to the primary while no replica is healthy.
+func (s *Session) route(message []byte) *pool.Pool {
+	db := s.db
+	primary := db.primaryPool()
+	if len(db.replicas) == 0 || s.mode == config.SessionPooling {
+		return primary
+	}
+
+	if !s.readOnly(message) {
+		s.wroteAt = time.Now()
+		return primary
+	}
+	if !s.wroteAt.IsZero() && db.stickyPrimary != 0 &&
+		(db.stickyPrimary < 0 || time.Since(s.wroteAt) < db.stickyPrimary) {
+		return primary
+	}
+	if replica := db.replica(s.client.RemoteAddr().String(), s.user); replica != nil {
+		return replica
+	}
+	return primary
+}
+
+// readOnly reports whether a transaction starting with the client message
+// can run on a replica. Anything rocky is unsure about is not.
+func (s *Session) readOnly(message []byte) bool {
+	switch protocol.GetMessageType(message) {
+	case protocol.QueryMessageType:
+		return isReadOnlyQuery(strings.TrimRight(string(message[5:]), "\x00"))
+	case protocol.ParseMessageType:
+		parse, err := protocol.DecodeParse(message)
+		// a named statement parsed on a replica is only found again if it
+		// is prepared wherever it is used
+		if err != nil || (parse.Name != "" && !s.tracksStatements()) {
+			return false
+		}
+		return isReadOnlyQuery(parse.Query)
+	case protocol.BindMessageType:
+		bind, err := protocol.DecodeBind(message)
+		if err != nil {
+			return false
+		}
+		statement, ok := s.statements[bind.Statement]
+		return ok && isReadOnlyQuery(statement.query)
+	}
+	return false
+}
+
+// isReadOnlyQuery reports whether query is a read-only transaction, a single
+// SELECT that does not lock, create or write anything, or carries the replica
+// hint and not the primary hint.
+//
+// It is a heuristic on the words of the query: a word like FOR in a string
+// literal keeps a query on the primary, while a function that writes and is
+// not in writingFunctions goes unnoticed.
+func isReadOnlyQuery(query string) bool {
+	if strings.Contains(query, primaryHint) {
+		return false
+	}
+	if strings.Contains(query, replicaHint) {
+		return true
+	}
+
+	query = strings.ToLower(skipComments(query))
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	if len(words) == 0 {
+		return false
+	}
+	// whatever follows a first statement is not looked at
+	if strings.Contains(strings.TrimRight(query, "; \t\r\n"), ";") {
+		return false
+	}
+	switch words[0] {
+	case "begin", "start":
+		// the backend enforces that the rest of the transaction only reads.
+		// Of several access modes the last one counts.
+		readOnly := false
+		for i := 1; i < len(words)-1; i++ {
+			if words[i] == "read" {
+				readOnly = words[i+1] == "only"
+			}
+		}
+		return readOnly
+	case "select":
+		for _, word := range words {
+			// FOR UPDATE, FOR NO KEY UPDATE, FOR SHARE and FOR KEY SHARE
+			// lock rows, SELECT INTO creates a table
+			if word == "for" || word == "into" || writingFunctions[word] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// skipComments strips the comments and whitespace a query starts with.
+func skipComments(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			end := strings.IndexByte(query, '\n')
+			if end < 0 {
+				return ""
+			}
+			query = query[end+1:]
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+2:]
+		default:
+			return query
+		}
+	}
+}
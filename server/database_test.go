@@ -0,0 +1,343 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		readOnly bool
+	}{
+		{"select 1", true},
+		{"  SELECT * FROM users;", true},
+		{"-- comment\nselect 1", true},
+		{"/* comment */ select 1", true},
+		{"select * from users for update", false},
+		{"SELECT * FROM users FOR NO KEY UPDATE", false},
+		{"select * from users for share", false},
+		{"select * from (select 1) as one for\tkey share", false},
+		{"select * from users where id = (1)for update", false},
+		{"select nextval('seq')", false},
+		{"select pg_advisory_lock(1)", false},
+		{"select 1 " + primaryHint, false},
+		{"select 1 " + primaryHint + " " + replicaHint, false},
+		{"select forecast from weather", true},
+		{"select * into copy from users", false},
+		{"select 1; delete from users", false},
+		{"insert into users values (1)", false},
+		{"update users set name = 'x'", false},
+		{"begin", false},
+		{"begin read only", true},
+		{"begin;", false},
+		{"begin read only;", true},
+		{"BEGIN ISOLATION LEVEL REPEATABLE READ, READ ONLY", true},
+		{"start transaction read only, read write", false},
+		{"begin isolation level read committed", false},
+		{"begin read only; update users set name = 'x'", false},
+		{"begin; select 'read only'", false},
+		{"start transaction read only", true},
+		{"with deleted as (delete from users returning *) select * from deleted", false},
+		{"select nextval('seq') " + replicaHint, true},
+		{"", false},
+		{"/* unterminated", false},
+	}
+	for _, test := range tests {
+		if got := isReadOnlyQuery(test.query); got != test.readOnly {
+			t.Errorf("isReadOnlyQuery(%q) = %v, expected %v", test.query, got, test.readOnly)
+		}
+	}
+}
+
+// startDatabase serves a logical database of primary and replica, in
+// transaction pooling mode, on a random port.
+func startDatabase(t *testing.T, primary, replica *fakeBackend, stickyPrimary time.Duration) (*Server, string) {
+	primaryBackend := transactionBackend(primary, 10)
+	primaryBackend.Name = "primary"
+	replicaBackend := transactionBackend(replica, 10)
+	replicaBackend.Name = "replica"
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{primaryBackend, replicaBackend},
+		Databases: []*config.DatabaseSetting{{
+			Name:          "app",
+			Primary:       "primary",
+			Replicas:      []string{"replica"},
+			StickyPrimary: stickyPrimary,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeDatabase(listener, "app")
+	return srv, listener.Addr().String()
+}
+
+// withoutChecks drops the queries rocky runs on its own from queries.
+func withoutChecks(queries []string) []string {
+	var client []string
+	for _, query := range queries {
+		if query != "DISCARD ALL" && query != "select 1" && query != "select pg_is_in_recovery()" &&
+			!strings.Contains(query, "pg_last_xact_replay_timestamp()") {
+			client = append(client, query)
+		}
+	}
+	return client
+}
+
+func TestReadWriteSplitting(t *testing.T) {
+	primary := newFakeBackend(t)
+	defer primary.Close()
+	replica := newFakeBackend(t)
+	defer replica.Close()
+
+	srv, addr := startDatabase(t, primary, replica, 0)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	query(t, client, "select * from users")
+	query(t, client, "insert into users values (1)")
+	query(t, client, "select nextval('seq') "+replicaHint)
+	query(t, client, "select * from users for update")
+	query(t, client, "begin read only")
+	query(t, client, "select * from users")
+	query(t, client, "commit")
+	query(t, client, "begin")
+	query(t, client, "select * from users")
+	query(t, client, "commit")
+
+	expectedPrimary := []string{
+		"insert into users values (1)",
+		"select * from users for update",
+		"begin",
+		"select * from users",
+		"commit",
+	}
+	if got := withoutChecks(primary.Queries()); !reflect.DeepEqual(got, expectedPrimary) {
+		t.Errorf("expected the primary to run %q, got %q", expectedPrimary, got)
+	}
+	expectedReplica := []string{
+		"select * from users",
+		"select nextval('seq') " + replicaHint,
+		"begin read only",
+		"select * from users",
+		"commit",
+	}
+	if got := withoutChecks(replica.Queries()); !reflect.DeepEqual(got, expectedReplica) {
+		t.Errorf("expected the replica to run %q, got %q", expectedReplica, got)
+	}
+}
+
+func TestReadWriteSplittingPreparedStatements(t *testing.T) {
+	primary := newFakeBackend(t)
+	defer primary.Close()
+	replica := newFakeBackend(t)
+	defer replica.Close()
+
+	srv, addr := startDatabase(t, primary, replica, 0)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	// a read-only statement is prepared wherever it runs, writes run on the
+	// primary
+	prepare(t, client, "s1")
+	client.Send((&protocol.Parse{Name: "w1", Query: "delete from users"}).Bytes(), protocol.NewSyncMessage())
+	expectMessage(t, client, protocol.ParseCompleteMessageType)
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+	if got := execute(t, client, "s1"); got != "select 's1'" {
+		t.Errorf("expected statement s1 to run, got %q", got)
+	}
+	if got := execute(t, client, "w1"); got != "delete from users" {
+		t.Errorf("expected statement w1 to run, got %q", got)
+	}
+
+	if stats := srv.current().pools["replica"].Stats(); stats.Idle != 1 {
+		t.Errorf("expected the replica to serve the reads, got %+v", stats)
+	}
+	if stats := srv.current().pools["primary"].Stats(); stats.Idle != 1 {
+		t.Errorf("expected the primary to serve the writes, got %+v", stats)
+	}
+}
+
+func TestStickyPrimary(t *testing.T) {
+	primary := newFakeBackend(t)
+	defer primary.Close()
+	replica := newFakeBackend(t)
+	defer replica.Close()
+
+	srv, addr := startDatabase(t, primary, replica, -1)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	// reads go to a replica until the session writes, then stay on the
+	// primary
+	query(t, client, "select 1 from users")
+	query(t, client, "insert into users values (1)")
+	query(t, client, "select 2 from users")
+
+	if got := withoutChecks(replica.Queries()); !reflect.DeepEqual(got, []string{"select 1 from users"}) {
+		t.Errorf("expected the replica to run the first read only, got %q", got)
+	}
+	expected := []string{"insert into users values (1)", "select 2 from users"}
+	if got := withoutChecks(primary.Queries()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the primary to run %q, got %q", expected, got)
+	}
+}
+
+func TestUnknownDatabaseBackend(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	_, err := New(config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{testBackend(fb)},
+		Databases:    []*config.DatabaseSetting{{Name: "app", Primary: "missing"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown primary")
+	}
+}
+
+func TestNoBackends(t *testing.T) {
+	if _, err := New(config.RockyProxySettings{}); err == nil {
+		t.Fatal("expected an error without backends")
+	}
+}
+
+func TestLaggingReplicasSkipped(t *testing.T) {
+	primary := newFakeBackend(t)
+	defer primary.Close()
+	var replicas []*fakeBackend
+	backends := []*config.BackendHostSetting{transactionBackend(primary, 10)}
+	backends[0].Name = "primary"
+	for _, name := range []string{"behind", "current"} {
+		fb := newFakeBackend(t)
+		defer fb.Close()
+		fb.SetInRecovery(true)
+		replicas = append(replicas, fb)
+		backend := candidateBackend(fb, name, config.TransactionPooling)
+		backends = append(backends, backend)
+	}
+	replicas[0].SetReplicaLag("30")
+	replicas[1].SetReplicaLag("1.5")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(config.RockyProxySettings{
+		BackendHosts: backends,
+		Databases: []*config.DatabaseSetting{{
+			Name:          "app",
+			Primary:       "primary",
+			Replicas:      []string{"behind", "current"},
+			MaxReplicaLag: 10 * time.Second,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go srv.ServeDatabase(listener, "app")
+
+	for _, name := range []string{"behind", "current"} {
+		health := waitForHealth(t, srv.current().pools[name], func(h pool.Health) bool { return h.ReplicaLag >= 0 })
+		if health.Role != pool.RoleReplica {
+			t.Errorf("expected %s to be a replica, got %+v", name, health)
+		}
+	}
+	if lag := srv.current().pools["current"].Health().ReplicaLag; lag != 1500*time.Millisecond {
+		t.Errorf("expected a lag of 1.5s, got %s", lag)
+	}
+
+	client := connectClient(t, listener.Addr().String())
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		query(t, client, "select * from users")
+	}
+	if got := withoutChecks(replicas[0].Queries()); len(got) != 0 {
+		t.Errorf("expected no reads on the lagging replica, got %q", got)
+	}
+	if got := withoutChecks(replicas[1].Queries()); len(got) != 3 {
+		t.Errorf("expected the reads on the current replica, got %q", got)
+	}
+
+	// with every replica behind reads go to the primary
+	replicas[1].SetReplicaLag("60")
+	waitForHealth(t, srv.current().pools["current"], func(h pool.Health) bool { return h.ReplicaLag > 10*time.Second })
+	query(t, client, "select * from users")
+	if got := withoutChecks(primary.Queries()); !reflect.DeepEqual(got, []string{"select * from users"}) {
+		t.Errorf("expected the read on the primary, got %q", got)
+	}
+}
+
+func TestDisconnectedReplicaSkipped(t *testing.T) {
+	primary := newFakeBackend(t)
+	defer primary.Close()
+	replica := newFakeBackend(t)
+	defer replica.Close()
+	replica.SetInRecovery(true)
+	// replayed everything it received, but receives nothing
+	replica.SetDisconnected(true)
+
+	primaryBackend := transactionBackend(primary, 10)
+	primaryBackend.Name = "primary"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{
+			primaryBackend,
+			candidateBackend(replica, "replica", config.TransactionPooling),
+		},
+		Databases: []*config.DatabaseSetting{{
+			Name:          "app",
+			Primary:       "primary",
+			Replicas:      []string{"replica"},
+			MaxReplicaLag: 10 * time.Second,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go srv.ServeDatabase(listener, "app")
+
+	health := waitForHealth(t, srv.current().pools["replica"], func(h pool.Health) bool { return h.Role == pool.RoleReplica })
+	if health.ReplicaLag >= 0 {
+		t.Errorf("expected an unknown lag, got %s", health.ReplicaLag)
+	}
+
+	client := connectClient(t, listener.Addr().String())
+	defer client.Close()
+	query(t, client, "select * from users")
+	if got := withoutChecks(replica.Queries()); len(got) != 0 {
+		t.Errorf("expected no reads on the disconnected replica, got %q", got)
+	}
+
+	// reads go back to the replica once it streams again
+	replica.SetDisconnected(false)
+	waitForHealth(t, srv.current().pools["replica"], func(h pool.Health) bool { return h.ReplicaLag >= 0 })
+	query(t, client, "select * from users")
+	if got := withoutChecks(replica.Queries()); len(got) != 1 {
+		t.Errorf("expected the read on the replica, got %q", got)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+)
+
+// how often databases with candidates check that their primary still is one
+var failoverInterval = time.Second
+
+// watchPrimaries moves the primary of databases with candidates to the one
+// health checks find writable, until the server is closed.
+func (s *Server) watchPrimaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for _, db := range s.current().databases {
+				if promoted := db.promoted(); promoted != nil {
+					s.failover(db, promoted)
+				}
+			}
+		}
+	}
+}
+
+// watchPrimariesIfNeeded starts watchPrimaries once a database of setup has
+// candidates.
+func (s *Server) watchPrimariesIfNeeded(setup *setup) {
+	for _, db := range setup.databases {
+		if len(db.candidates) > 0 {
+			s.watching.Do(func() {
+				go s.watchPrimaries(failoverInterval)
+			})
+			return
+		}
+	}
+}
+
+// promoted returns the candidate to take over as primary, nil while the
+// current primary is up and not known to be in recovery, or no other
+// candidate is found to be a primary.
+func (db *database) promoted() *pool.Pool {
+	current := db.primaryPool()
+	if health := current.Health(); health.Up && health.Role != pool.RoleReplica {
+		return nil
+	}
+	for _, candidate := range db.candidates {
+		if candidate == current {
+			continue
+		}
+		if health := candidate.Health(); health.Up && health.Role == pool.RolePrimary {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// failover re-points db's writes to promoted. Sessions holding a connection
+// to the old primary for good, in session mode, are closed, others move
+// over once their transaction ends. The old primary's idle connections are
+// closed as well.
+func (s *Server) failover(db *database, promoted *pool.Pool) {
+	db.mu.Lock()
+	old := db.primary
+	db.primary = promoted
+	db.mu.Unlock()
+	pLogger.Printf("database %s: primary moved from %s to %s\n", db.name, old.Name(), promoted.Name())
+	s.metrics.failovers.Inc(db.name)
+
+	for _, session := range s.sessionList() {
+		if session.target() == db && session.pinnedTo(old) {
+			session.Close()
+		}
+	}
+	old.CloseIdle()
+}
+
+// pinnedTo reports whether the session holds a connection of p for as long
+// as it lasts, in session mode.
+func (s *Session) pinnedTo(p *pool.Pool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server != nil && s.serverPool == p && s.mode == config.SessionPooling
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// candidateBackend is a backend whose role is health checked quickly.
+func candidateBackend(fb *fakeBackend, name string, mode config.PoolMode) *config.BackendHostSetting {
+	backend := testBackend(fb)
+	backend.Name = name
+	backend.Capacity = 2
+	backend.PoolMode = mode
+	backend.HealthCheckInterval = 5 * time.Millisecond
+	backend.HealthCheckRole = true
+	return backend
+}
+
+// startFailoverDatabase serves a logical database whose primary can move
+// between first and second, on a random port.
+func startFailoverDatabase(t *testing.T, first, second *fakeBackend, mode config.PoolMode) (*Server, string) {
+	defer func(interval time.Duration) { failoverInterval = interval }(failoverInterval)
+	failoverInterval = 5 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{
+			candidateBackend(first, "first", mode),
+			candidateBackend(second, "second", mode),
+		},
+		Databases: []*config.DatabaseSetting{{Name: "app", Candidates: []string{"first", "second"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeDatabase(listener, "app")
+	return srv, listener.Addr().String()
+}
+
+// waitForPrimary waits until the app database writes to the backend named
+// primary.
+func waitForPrimary(t *testing.T, srv *Server, primary string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.current().databases["app"].primaryPool().Name() != primary {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s to become the primary", primary)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	first := newFakeBackend(t)
+	defer first.Close()
+	second := newFakeBackend(t)
+	defer second.Close()
+	second.SetInRecovery(true)
+
+	srv, addr := startFailoverDatabase(t, first, second, config.TransactionPooling)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "insert into users values (1)")
+
+	// the second backend is promoted and the first one demoted
+	first.SetInRecovery(true)
+	second.SetInRecovery(false)
+	waitForPrimary(t, srv, "second")
+	query(t, client, "insert into users values (2)")
+
+	if got := withoutChecks(first.Queries()); !reflect.DeepEqual(got, []string{"insert into users values (1)"}) {
+		t.Errorf("expected the first write on the old primary, got %q", got)
+	}
+	if got := withoutChecks(second.Queries()); !reflect.DeepEqual(got, []string{"insert into users values (2)"}) {
+		t.Errorf("expected the second write on the new primary, got %q", got)
+	}
+	if got := srv.metrics.failovers.Value("app"); got != 1 {
+		t.Errorf("expected 1 failover, got %v", got)
+	}
+	if stats := srv.current().pools["first"].Stats(); stats.Idle != 0 {
+		t.Errorf("expected the old primary's idle connections to be closed, got %+v", stats)
+	}
+}
+
+func TestFailoverClosesSessionModeClients(t *testing.T) {
+	first := newFakeBackend(t)
+	defer first.Close()
+	second := newFakeBackend(t)
+	defer second.Close()
+	second.SetInRecovery(true)
+
+	srv, addr := startFailoverDatabase(t, first, second, config.SessionPooling)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+
+	// the old primary going down moves writes too
+	first.Close()
+	second.SetInRecovery(false)
+	waitForPrimary(t, srv, "second")
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if message, err := client.ReadMessage(); err == nil {
+		t.Fatalf("expected the client to be disconnected, got %v", message)
+	}
+
+	// new clients are served by the new primary
+	client = connectClient(t, addr)
+	defer client.Close()
+	if status := query(t, client, "select 1"); status != protocol.TransactionIdle {
+		t.Errorf("expected the query to succeed, got status %c", status)
+	}
+}
+
+func TestCandidatesNeedRoleChecks(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	_, err := New(config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{testBackend(fb)},
+		Databases:    []*config.DatabaseSetting{{Name: "app", Candidates: []string{"test"}}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for a candidate without role health checks")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// waitForHealth polls p until done reports true for its health.
+func waitForHealth(t *testing.T, p *pool.Pool, done func(pool.Health) bool) pool.Health {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		health := p.Health()
+		if done(health) {
+			return health
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for health checks, got %+v", health)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	fb := newFakeBackend(t)
+	fb.SetInRecovery(true)
+
+	backend := testBackend(fb)
+	backend.HealthCheckInterval = 5 * time.Millisecond
+	backend.HealthCheckQuery = "select 1"
+	backend.HealthCheckRole = true
+	backend.HealthCheckFall = 2
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+	p := srv.current().pools["test"]
+
+	health := waitForHealth(t, p, func(h pool.Health) bool { return !h.CheckedAt.IsZero() })
+	if !health.Up || health.Role != pool.RoleReplica {
+		t.Errorf("expected an up replica, got %+v", health)
+	}
+
+	// once the backend stops accepting connections it is taken out of
+	// service and clients are told right away
+	fb.Close()
+	health = waitForHealth(t, p, func(h pool.Health) bool { return !h.Up })
+	if health.Failures < 2 || health.LastError == "" {
+		t.Errorf("expected two failed checks before going down, got %+v", health)
+	}
+	if p.Healthy() {
+		t.Error("expected a down backend not to be healthy")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	defer client.Close()
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+	client.Flush()
+	expectMessage(t, client, protocol.ErrorMessageType)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// clientCounts are the clients counted against the connection limits, see
+// admit.
+type clientCounts struct {
+	total     int
+	users     map[string]int
+	databases map[string]int
+}
+
+// admission is what a session was counted as by admit.
+type admission struct {
+	user     string
+	database string
+}
+
+// limitError rejects a client over one of the connection limits.
+type limitError struct {
+	// the setting that was reached, as the rejection is labeled in metrics
+	limit   string
+	message string
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+// connectionMax returns the connection_max of the backend or logical database
+// called name, 0 if there is no limit.
+func (setup *setup) connectionMax(name string) int {
+	if setting := databaseSetting(setup.settings, name); setting != nil {
+		return setting.ConnectionMax
+	}
+	for _, backend := range setup.settings.BackendHosts {
+		if backend.Name == name {
+			return backend.ConnectionMax
+		}
+	}
+	return 0
+}
+
+// admit counts session's client, authenticated as user to the database called
+// database, against the connection limits. A client over one of them is not
+// counted and the error to reject it with is returned. The client is counted
+// until the session is removed.
+func (s *Server) admit(session *Session, user, database string) *limitError {
+	setup := s.current()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if max := setup.settings.ConnectionMax; max > 0 && s.clients.total >= max {
+		return &limitError{"connection_max", "sorry, too many clients already"}
+	}
+	if max := setup.settings.UserConnectionMax; max > 0 && s.clients.users[user] >= max {
+		return &limitError{"user_connection_max", fmt.Sprintf("too many connections for role \"%s\"", user)}
+	}
+	if max := setup.connectionMax(database); max > 0 && s.clients.databases[database] >= max {
+		return &limitError{"database_connection_max", fmt.Sprintf("too many connections for database \"%s\"", database)}
+	}
+
+	s.clients.total++
+	s.clients.users[user]++
+	s.clients.databases[database]++
+	s.admitted[session] = admission{user: user, database: database}
+	return nil
+}
+
+// releaseLocked stops counting the session's client, if it was admitted.
+// s.mu must be held.
+func (s *Server) releaseLocked(session *Session) {
+	admitted, ok := s.admitted[session]
+	if !ok {
+		return
+	}
+	delete(s.admitted, session)
+	s.clients.total--
+	decrement(s.clients.users, admitted.user)
+	decrement(s.clients.databases, admitted.database)
+}
+
+// decrement lowers the count of key, forgetting it at 0.
+func decrement(counts map[string]int, key string) {
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// clientCounts returns a copy of the counts of admitted clients.
+func (s *Server) clientCounts() clientCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := clientCounts{
+		total:     s.clients.total,
+		users:     make(map[string]int),
+		databases: make(map[string]int),
+	}
+	for user, n := range s.clients.users {
+		counts.users[user] = n
+	}
+	for database, n := range s.clients.databases {
+		counts.databases[database] = n
+	}
+	return counts
+}
+
+// showLimits lists the connection limits with the clients counted against
+// them: the global limit, every database, and every user with clients. A max
+// of 0 means no limit.
+func (s *Server) showLimits() [][]string {
+	setup := s.current()
+	counts := s.clientCounts()
+	rows := [][]string{
+		{"global", "", strconv.Itoa(counts.total), strconv.Itoa(setup.settings.ConnectionMax)},
+	}
+
+	var databases []string
+	for name := range setup.databases {
+		databases = append(databases, name)
+	}
+	sort.Strings(databases)
+	for _, name := range databases {
+		rows = append(rows, []string{
+			"database", name, strconv.Itoa(counts.databases[name]), strconv.Itoa(setup.connectionMax(name)),
+		})
+	}
+
+	var users []string
+	for user := range counts.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		rows = append(rows, []string{
+			"user", user, strconv.Itoa(counts.users[user]), strconv.Itoa(setup.settings.UserConnectionMax),
+		})
+	}
+	return rows
+}
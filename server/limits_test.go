@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// expectTooManyConnections checks that the client, whose first message was
+// message, is rejected with SQLSTATE 53300 after logging in, returning the
+// error.
+func expectTooManyConnections(t *testing.T, client *protocol.Conn, message []byte) []byte {
+	t.Helper()
+	if !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %q", message)
+	}
+	message = readMessage(t, client)
+	if protocol.GetMessageType(message) != protocol.ErrorMessageType ||
+		protocol.GetErrorCode(message) != protocol.SQLStateTooManyConnections {
+		t.Fatalf("expected a too many connections error, got %q", message)
+	}
+	return message
+}
+
+// waitForClients waits until total clients are counted against the limits.
+func waitForClients(t *testing.T, srv *Server, total int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.clientCounts().total != total {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, got %d", total, srv.clientCounts().total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionMax(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts:  []*config.BackendHostSetting{backend},
+		ConnectionMax: 2,
+	})
+	defer srv.Close()
+
+	first := connectClient(t, addr)
+	second := connectClient(t, addr)
+	defer second.Close()
+
+	third, message := startup(t, addr, "test", "test")
+	expectTooManyConnections(t, third, message)
+	third.Close()
+	if rejected := srv.metrics.clientsRejected.Value("connection_max"); rejected != 1 {
+		t.Errorf("expected 1 rejected client, got %v", rejected)
+	}
+
+	// a client leaving makes room for another
+	first.Close()
+	waitForClients(t, srv, 1)
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+}
+
+func TestUserConnectionMax(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts:      []*config.BackendHostSetting{backend},
+		UserConnectionMax: 1,
+	})
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	again, message := startup(t, addr, "test", "test")
+	defer again.Close()
+	message = expectTooManyConnections(t, again, message)
+	if text := string(message); !strings.Contains(text, `too many connections for role "test"`) {
+		t.Errorf("unexpected error %q", text)
+	}
+
+	// other users have limits of their own
+	other, message := startup(t, addr, "test", "other")
+	defer other.Close()
+	if !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk for another user, got %q", message)
+	}
+}
+
+func TestDatabaseConnectionMax(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	backend.ConnectionMax = 1
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	again, message := startup(t, addr, "test", "other")
+	defer again.Close()
+	message = expectTooManyConnections(t, again, message)
+	if text := string(message); !strings.Contains(text, `too many connections for database "test"`) {
+		t.Errorf("unexpected error %q", text)
+	}
+
+	// raising the limit applies to the database in use
+	raised := *backend
+	raised.ConnectionMax = 2
+	if err := srv.ReloadSettings(config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{&raised}}); err != nil {
+		t.Fatal(err)
+	}
+	second := connectClient(t, addr)
+	defer second.Close()
+	query(t, client, "select 1")
+}
+
+func TestUnauthenticatedClientNotCounted(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	authFile, err := ioutil.TempFile("", "userlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(authFile.Name())
+	authFile.WriteString(`"test" "secret"` + "\n")
+	authFile.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts:      []*config.BackendHostSetting{backend},
+		AuthType:          config.AuthMD5,
+		AuthFile:          authFile.Name(),
+		UserConnectionMax: 1,
+	})
+	defer srv.Close()
+
+	// a client claiming to be test that never answers the password request
+	stalled, message := startup(t, addr, "test", "test")
+	defer stalled.Close()
+	if protocol.GetMessageType(message) != protocol.AuthenticationMessageType || protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected a password request, got %q", message)
+	}
+	if counts := srv.clientCounts(); counts.total != 0 || counts.users["test"] != 0 {
+		t.Errorf("expected no clients counted, got %+v", counts)
+	}
+
+	// does not keep the real test from logging in
+	client, message := startup(t, addr, "test", "test")
+	defer client.Close()
+	salt := string(message[9:13])
+	client.Send(protocol.NewPasswordMessage(md5Password("test", "secret", salt)))
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %q", message)
+	}
+	finishStartup(t, client)
+	query(t, client, "select 1")
+	waitForClients(t, srv, 1)
+}
+
+// md5Password is the answer to an MD5 password request with salt.
+func md5Password(user, password, salt string) string {
+	inner := fmt.Sprintf("%x", md5.Sum([]byte(password+user)))
+	return fmt.Sprintf("md5%x", md5.Sum([]byte(inner+salt)))
+}
+
+func TestShowLimits(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	backend.ConnectionMax = 5
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts:      []*config.BackendHostSetting{backend},
+		ConnectionMax:     10,
+		UserConnectionMax: 3,
+		AdminUsers:        []string{"admin"},
+	})
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	admin := adminClient(t, addr)
+	defer admin.Close()
+
+	// admin console clients are not counted
+	expected := [][]string{
+		{"global", "", "1", "10"},
+		{"database", "test", "1", "5"},
+		{"user", "test", "1", "3"},
+	}
+	rows := adminQuery(t, admin, "SHOW LIMITS")
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, rows)
+	}
+	for i, row := range rows {
+		for j, value := range row {
+			if value != expected[i][j] {
+				t.Errorf("row %d: expected %v, got %v", i, expected[i], row)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/johnshiver/rocky/metrics"
+	"github.com/johnshiver/rocky/pool"
+)
+
+// serverMetrics are the metrics a Server exposes on its metrics address.
+// Every metric is labeled with the backend or database it concerns.
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	// how long clients waited for a backend connection
+	poolWait *metrics.HistogramVec
+	// message bytes received from and sent to clients
+	bytesReceived *metrics.CounterVec
+	bytesSent     *metrics.CounterVec
+	// commands and transactions completed by backends
+	queries      *metrics.CounterVec
+	transactions *metrics.CounterVec
+	// failed client logins by auth method
+	authFailures *metrics.CounterVec
+	// ErrorResponses sent by backends, by SQLSTATE
+	backendErrors *metrics.CounterVec
+	// times a logical database's primary moved, labeled by database
+	failovers *metrics.CounterVec
+	// clients turned away by a connection limit, labeled by the limit
+	clientsRejected *metrics.CounterVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: metrics.NewRegistry(),
+		poolWait: metrics.NewHistogramVec("rocky_pool_wait_seconds",
+			"Time clients waited for a backend connection.", metrics.DefaultBuckets, "backend"),
+		bytesReceived: metrics.NewCounterVec("rocky_client_received_bytes_total",
+			"Bytes received from clients.", "backend"),
+		bytesSent: metrics.NewCounterVec("rocky_client_sent_bytes_total",
+			"Bytes sent to clients.", "backend"),
+		queries: metrics.NewCounterVec("rocky_queries_total",
+			"Commands completed by backends.", "backend"),
+		transactions: metrics.NewCounterVec("rocky_transactions_total",
+			"Transactions completed by backends.", "backend"),
+		authFailures: metrics.NewCounterVec("rocky_auth_failures_total",
+			"Failed client logins.", "backend", "method"),
+		backendErrors: metrics.NewCounterVec("rocky_backend_errors_total",
+			"ErrorResponses sent by backends.", "backend", "sqlstate"),
+		failovers: metrics.NewCounterVec("rocky_failovers_total",
+			"Times the primary of a logical database moved to another backend.", "database"),
+		clientsRejected: metrics.NewCounterVec("rocky_clients_rejected_total",
+			"Clients turned away by a connection limit.", "limit"),
+	}
+
+	poolGauge := func(name, help string, value func(*pool.Pool) float64) *metrics.GaugeFunc {
+		return metrics.NewGaugeFunc(name, help, []string{"backend"}, func() []metrics.Sample {
+			setup := s.current()
+			var samples []metrics.Sample
+			for _, backend := range setup.poolNames() {
+				samples = append(samples, metrics.Sample{
+					LabelValues: []string{backend},
+					Value:       value(setup.pools[backend]),
+				})
+			}
+			return samples
+		})
+	}
+
+	countGauge := func(name, help, label string, counts func(clientCounts) map[string]int) *metrics.GaugeFunc {
+		return metrics.NewGaugeFunc(name, help, []string{label}, func() []metrics.Sample {
+			byValue := counts(s.clientCounts())
+			var values []string
+			for value := range byValue {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			var samples []metrics.Sample
+			for _, value := range values {
+				samples = append(samples, metrics.Sample{LabelValues: []string{value}, Value: float64(byValue[value])})
+			}
+			return samples
+		})
+	}
+
+	m.registry.Register(
+		metrics.NewGaugeFunc("rocky_clients", "Clients counted against connection_max.", nil,
+			func() []metrics.Sample {
+				return []metrics.Sample{{Value: float64(s.clientCounts().total)}}
+			}),
+		countGauge("rocky_database_clients", "Clients connected to each database.", "database",
+			func(counts clientCounts) map[string]int { return counts.databases }),
+		// only authenticated users are counted, so clients cannot make up
+		// labels, see admit
+		countGauge("rocky_user_clients", "Clients logged in as each user.", "user",
+			func(counts clientCounts) map[string]int { return counts.users }),
+		poolGauge("rocky_pool_active_connections", "Backend connections in use by clients.",
+			func(p *pool.Pool) float64 { return float64(p.Stats().Active) }),
+		poolGauge("rocky_pool_idle_connections", "Backend connections waiting in the pool.",
+			func(p *pool.Pool) float64 { return float64(p.Stats().Idle) }),
+		poolGauge("rocky_pool_waiting_clients", "Clients waiting for a backend connection.",
+			func(p *pool.Pool) float64 { return float64(p.Stats().Waiting) }),
+		poolGauge("rocky_backend_up", "Whether health checks find the backend up.",
+			func(p *pool.Pool) float64 { return boolValue(p.Health().Up) }),
+		poolGauge("rocky_backend_is_replica", "Whether health checks find the backend in recovery.",
+			func(p *pool.Pool) float64 { return boolValue(p.Health().Role == pool.RoleReplica) }),
+		poolGauge("rocky_backend_health_check_failures", "Health checks in a row the backend failed.",
+			func(p *pool.Pool) float64 { return float64(p.Health().Failures) }),
+		poolGauge("rocky_backend_replica_lag_seconds", "How far a replica is behind its primary, -1 while unknown.",
+			func(p *pool.Pool) float64 {
+				if lag := p.Health().ReplicaLag; lag >= 0 {
+					return lag.Seconds()
+				}
+				return -1
+			}),
+		m.poolWait,
+		m.bytesReceived,
+		m.bytesSent,
+		m.queries,
+		m.transactions,
+		m.authFailures,
+		m.backendErrors,
+		m.failovers,
+		m.clientsRejected,
+	)
+	return m
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ServeMetrics serves the /metrics endpoint on listener until the server is
+// closed, in which case nil is returned.
+func (s *Server) ServeMetrics(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry.Handler())
+	httpServer := &http.Server{Handler: mux}
+
+	if !s.addListener(listener) {
+		listener.Close()
+		return nil
+	}
+	pLogger.Printf("serving metrics on %s\n", listener.Addr())
+
+	err := httpServer.Serve(listener)
+	if s.isClosed() {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// scrape returns the metrics served at addr.
+func scrape(t *testing.T, addr string) string {
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, testBackend(fb))
+	defer srv.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeMetrics(listener)
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+	query(t, client, "begin")
+	query(t, client, "select 1")
+	query(t, client, "commit")
+
+	if got := srv.metrics.queries.Value("test"); got != 4 {
+		t.Errorf("expected 4 queries, got %v", got)
+	}
+	if got := srv.metrics.transactions.Value("test"); got != 2 {
+		t.Errorf("expected 2 transactions, got %v", got)
+	}
+
+	body := scrape(t, listener.Addr().String())
+	for _, line := range []string{
+		`rocky_pool_active_connections{backend="test"} 1`,
+		`rocky_queries_total{backend="test"} 4`,
+		`rocky_pool_wait_seconds_count{backend="test"} 1`,
+		`rocky_transactions_total{backend="test"} 2`,
+		`rocky_backend_up{backend="test"} 1`,
+		`rocky_clients 1`,
+		`rocky_database_clients{database="test"} 1`,
+		`rocky_user_clients{user="test"} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsOnlyLabelAuthenticatedUsers(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	authFile, err := ioutil.TempFile("", "userlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(authFile.Name())
+	authFile.WriteString(`"test" "secret"` + "\n")
+	authFile.Close()
+
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{testBackend(fb)},
+		AuthType:     config.AuthTrust,
+		AuthFile:     authFile.Name(),
+	})
+	defer srv.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeMetrics(listener)
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	stranger, message := startup(t, addr, "test", "stranger")
+	defer stranger.Close()
+	if protocol.GetMessageType(message) != protocol.ErrorMessageType {
+		t.Fatalf("expected the stranger to be turned away, got %q", message)
+	}
+
+	body := scrape(t, listener.Addr().String())
+	if !strings.Contains(body, `rocky_user_clients{user="test"} 1`) {
+		t.Errorf("expected a series for test in\n%s", body)
+	}
+	if strings.Contains(body, "stranger") {
+		t.Errorf("expected no series for stranger in\n%s", body)
+	}
+}
+
+func TestMetricsCountBackendErrors(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, _ := startServer(t, testBackend(fb))
+	defer srv.Close()
+
+	session := &Session{srv: srv, serverPool: srv.current().pools["test"]}
+	session.countServerMessage(protocol.NewErrorResponse("ERROR", "42P01", "relation does not exist"))
+	if got := srv.metrics.backendErrors.Value("test", "42P01"); got != 1 {
+		t.Errorf("expected 1 error for 42P01, got %v", got)
+	}
+}
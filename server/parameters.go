@@ -0,0 +1,89 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// Backend connections are opened by rocky with the backend's own startup
+// parameters and shared by clients, so the run-time parameters a client puts
+// in its startup message, like application_name or search_path, never reach
+// them on their own. Each session keeps its client's parameters and applies
+// them to every connection it attaches, see pool.ServerConn.ApplyParameters,
+// which resets them again for the next client that did not ask for them.
+
+// notParameters are startup message parameters that are not run-time
+// parameters to apply.
+var notParameters = map[string]bool{
+	"user":        true,
+	"database":    true,
+	"replication": true,
+	"options":     true,
+}
+
+// reportedParameters are the parameters a client can set that the backend
+// reports with ParameterStatus when they change. A client changing one with
+// SET keeps the new value on its next connection.
+var reportedParameters = map[string]bool{
+	"application_name":            true,
+	"client_encoding":             true,
+	"datestyle":                   true,
+	"intervalstyle":               true,
+	"search_path":                 true,
+	"standard_conforming_strings": true,
+	"timezone":                    true,
+}
+
+// clientParameters returns the run-time parameters set by a startup message,
+// by lowercase name. Like in postgres, parameters given on their own win
+// over those set by the options.
+func clientParameters(startup *protocol.Startup) (map[string]string, error) {
+	options, err := protocol.ParseStartupOptions(startup.Options)
+	if err != nil {
+		return nil, err
+	}
+	parameters := make(map[string]string)
+	for name, value := range options {
+		parameters[strings.ToLower(name)] = value
+	}
+	for name, value := range startup.Parameters {
+		name = strings.ToLower(name)
+		// _pq_ parameters are protocol extensions
+		if notParameters[name] || strings.HasPrefix(name, "_pq_.") {
+			continue
+		}
+		parameters[name] = value
+	}
+	return parameters, nil
+}
+
+// withClientParameters replaces the values of the ParameterStatus messages
+// among a backend connection's startup messages with the client's own.
+func (s *Session) withClientParameters(messages [][]byte) [][]byte {
+	replaced := make([][]byte, len(messages))
+	for i, message := range messages {
+		if protocol.GetMessageType(message) == protocol.ParameterStatusMessageType {
+			name, _, err := protocol.ParseParameterStatus(message)
+			if value, ok := s.parameters[strings.ToLower(name)]; err == nil && ok {
+				message = protocol.NewParameterStatusMessage(name, value)
+			}
+		}
+		replaced[i] = message
+	}
+	return replaced
+}
+
+// parameterChanged keeps a parameter the client changed on server, as the
+// backend reported with a ParameterStatus message.
+func (s *Session) parameterChanged(server *pool.ServerConn, message []byte) {
+	name, value, err := protocol.ParseParameterStatus(message)
+	if err != nil || !reportedParameters[strings.ToLower(name)] {
+		return
+	}
+	server.ParameterChanged(name, value)
+	s.mu.Lock()
+	s.parameters[strings.ToLower(name)] = value
+	s.mu.Unlock()
+}
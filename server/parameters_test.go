@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// connectWithParameters starts up a client sending parameters, returning
+// the startup messages it got after AuthenticationOk.
+func connectWithParameters(t *testing.T, addr string, parameters map[string]string) (*protocol.Conn, [][]byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", parameters))
+	client.Flush()
+
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %q", message)
+	}
+	var messages [][]byte
+	for {
+		message := readMessage(t, client)
+		messages = append(messages, message)
+		if protocol.GetMessageType(message) == protocol.ReadyForQueryMessageType {
+			return client, messages
+		}
+	}
+}
+
+// expectQueries checks the queries the backend received after the first
+// seen, returning how many it received in all.
+func expectQueries(t *testing.T, fb *fakeBackend, seen int, expected ...string) int {
+	t.Helper()
+	queries := withoutChecks(fb.Queries())
+	if !reflect.DeepEqual(queries[seen:], expected) {
+		t.Errorf("expected queries %q, got %q", expected, queries[seen:])
+	}
+	return len(queries)
+}
+
+func TestClientParameters(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	first, messages := connectWithParameters(t, addr, map[string]string{
+		"application_name": "first",
+		"options":          "-c search_path=app,public",
+	})
+	defer first.Close()
+	var reported string
+	for _, message := range messages {
+		if protocol.GetMessageType(message) == protocol.ParameterStatusMessageType {
+			_, reported, _ = protocol.ParseParameterStatus(message)
+		}
+	}
+	if reported != "first" {
+		t.Errorf("expected the client's application_name at startup, got %q", reported)
+	}
+
+	// the parameters are applied once on the connection
+	query(t, first, "query 1")
+	query(t, first, "query 2")
+	seen := expectQueries(t, fb, 0,
+		"SELECT set_config('application_name', 'first', false), set_config('search_path', 'app,public', false)",
+		"query 1", "query 2")
+
+	// and reset for a client without them
+	second := connectClient(t, addr)
+	defer second.Close()
+	query(t, second, "query 3")
+	seen = expectQueries(t, fb, seen, `RESET "application_name"; RESET "search_path"`, "query 3")
+
+	// a parameter the client sets follows it to its next connection
+	second.Send(queryMessage("set application_name = 'renamed'"))
+	expectMessage(t, second, protocol.ParameterStatusMessageType)
+	expectMessage(t, second, protocol.CommandCompleteMessageType)
+	expectMessage(t, second, protocol.ReadyForQueryMessageType)
+	query(t, first, "query 4")
+	query(t, second, "query 5")
+	expectQueries(t, fb, seen,
+		"set application_name = 'renamed'",
+		"SELECT set_config('application_name', 'first', false), set_config('search_path', 'app,public', false)",
+		"query 4",
+		`RESET "search_path"; SELECT set_config('application_name', 'renamed', false)`,
+		"query 5")
+}
+
+func TestBackendOptions(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.Options = map[string]string{"application_name": "rocky", "statement_timeout": "5s"}
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "query 1")
+
+	startups := fb.Startups()
+	last := startups[len(startups)-1]
+	if last["application_name"] != "rocky" || last["statement_timeout"] != "5s" {
+		t.Errorf("expected the backend's options in its startup message, got %v", last)
+	}
+	// nothing to apply for a client without parameters of its own
+	expectQueries(t, fb, 0, "query 1")
+}
+
+func TestUnsupportedStartupOption(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, testBackend(fb))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	defer client.Close()
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{"options": "-d 5"}))
+	client.Flush()
+
+	message := readMessage(t, client)
+	if protocol.GetMessageType(message) != protocol.ErrorMessageType ||
+		protocol.GetErrorCode(message) != protocol.SQLStateProtocolViolation {
+		t.Errorf("expected a protocol violation, got %q", message)
+	}
+}
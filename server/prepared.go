@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// Outside of session mode a client's next transaction can run on any backend
+// connection, but a statement prepared with Parse only exists on the
+// connection that parsed it. Sessions therefore remember their named
+// statements and, before a Bind or Describe uses one, parse it again on the
+// attached connection if it is missing there. The Parse is rocky's own, so
+// the ParseComplete answering it is not relayed.
+//
+// Statements are renamed on the backends so that two clients preparing the
+// same name do not collide, and each connection keeps at most
+// MaxPreparedStatements of them, closing the least recently used.
+
+// the most named statements a client may have prepared at once, a client
+// preparing more is disconnected rather than growing its session for ever
+var maxSessionStatements = 10000
+
+var errTooManyStatements = errors.New("too many prepared statements")
+
+// preparedStatement is a named statement prepared by a client.
+type preparedStatement struct {
+	// name on the backends
+	name  string
+	query string
+	// the client's Parse, renamed
+	parse []byte
+}
+
+// outgoing is a message to send a backend, see serverState.sent.
+type outgoing struct {
+	message []byte
+	// the statement a Parse prepares, by its backend name
+	statement string
+	// sent by rocky rather than the client
+	injected bool
+}
+
+// tracksStatements reports whether prepared statements are recreated on the
+// connections serving the session.
+func (s *Session) tracksStatements() bool {
+	return s.mode != config.SessionPooling && s.db.primaryPool().Config().MaxPreparedStatements > 0
+}
+
+// rewrite returns the messages to send the backend for a client message,
+// renaming prepared statements and parsing them first where needed. Messages
+// rocky cannot decode are left for the backend to reject. It fails with
+// errTooManyStatements for a Parse past maxSessionStatements. s.mu must be
+// held.
+func (s *Session) rewrite(server *pool.ServerConn, message []byte) ([]outgoing, error) {
+	unchanged := []outgoing{{message: message}}
+	if !s.tracksStatements() {
+		return unchanged, nil
+	}
+
+	switch protocol.GetMessageType(message) {
+	case protocol.ParseMessageType:
+		parse, err := protocol.DecodeParse(message)
+		if err != nil || parse.Name == "" {
+			return unchanged, nil
+		}
+		// a name reused without closing it first would be an error on a
+		// single connection, here the new statement simply replaces it
+		clientName := parse.Name
+		if _, ok := s.statements[clientName]; !ok && len(s.statements) >= maxSessionStatements {
+			return nil, errTooManyStatements
+		}
+		parse.Name = s.srv.nextStatementName()
+		statement := &preparedStatement{name: parse.Name, query: parse.Query, parse: parse.Bytes()}
+		if s.statements == nil {
+			s.statements = make(map[string]*preparedStatement)
+		}
+		s.statements[clientName] = statement
+
+		messages := closeEvicted(server.Statements.Add(statement.name))
+		return append(messages, outgoing{message: statement.parse, statement: statement.name}), nil
+
+	case protocol.BindMessageType:
+		bind, err := protocol.DecodeBind(message)
+		if err != nil {
+			return unchanged, nil
+		}
+		statement, ok := s.statements[bind.Statement]
+		if !ok {
+			return unchanged, nil
+		}
+		bind.Statement = statement.name
+		return append(s.ensurePrepared(server, statement), outgoing{message: bind.Bytes()}), nil
+
+	case protocol.DescribeMessageType:
+		describe, err := protocol.DecodeDescribe(message)
+		if err != nil || describe.Target != protocol.StatementTarget {
+			return unchanged, nil
+		}
+		statement, ok := s.statements[describe.Name]
+		if !ok {
+			return unchanged, nil
+		}
+		describe.Name = statement.name
+		return append(s.ensurePrepared(server, statement), outgoing{message: describe.Bytes()}), nil
+
+	case protocol.CloseMessageType:
+		closeMessage, err := protocol.DecodeClose(message)
+		if err != nil || closeMessage.Target != protocol.StatementTarget {
+			return unchanged, nil
+		}
+		statement, ok := s.statements[closeMessage.Name]
+		if !ok {
+			return unchanged, nil
+		}
+		delete(s.statements, closeMessage.Name)
+		// closing a statement the connection does not have is not an error,
+		// copies left on other connections are evicted in time
+		server.Statements.Remove(statement.name)
+		closeMessage.Name = statement.name
+		return []outgoing{{message: closeMessage.Bytes()}}, nil
+	}
+
+	return unchanged, nil
+}
+
+// statementsDropped forgets the client's prepared statements once a command
+// dropped them all, like DEALLOCATE ALL and DISCARD ALL do on a single
+// connection. Copies left on other connections are evicted in time.
+func (s *Session) statementsDropped(message []byte) {
+	switch protocol.GetCommandTag(message) {
+	case "DISCARD ALL", "DEALLOCATE ALL":
+		s.mu.Lock()
+		s.statements = nil
+		s.mu.Unlock()
+	}
+}
+
+// ensurePrepared returns the messages parsing statement on server if it is
+// not prepared there yet.
+func (s *Session) ensurePrepared(server *pool.ServerConn, statement *preparedStatement) []outgoing {
+	if server.Statements.Touch(statement.name) {
+		return nil
+	}
+	messages := closeEvicted(server.Statements.Add(statement.name))
+	return append(messages, outgoing{message: statement.parse, statement: statement.name, injected: true})
+}
+
+// closeEvicted returns the messages closing statements evicted from a
+// connection.
+func closeEvicted(names []string) []outgoing {
+	var messages []outgoing
+	for _, name := range names {
+		closeMessage := &protocol.Close{Target: protocol.StatementTarget, Name: name}
+		messages = append(messages, outgoing{message: closeMessage.Bytes(), injected: true})
+	}
+	return messages
+}
+
+// nextStatementName returns a prepared statement name unique to this
+// process, so statements of different clients never collide on a backend.
+func (s *Server) nextStatementName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements++
+	return "rocky_" + strconv.FormatUint(s.statements, 10)
+}
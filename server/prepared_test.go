@@ -0,0 +1,180 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// execute runs the prepared statement name and returns the row the fake
+// backend answers with, the query it ran.
+func execute(t *testing.T, client *protocol.Conn, name string) string {
+	client.Send(
+		(&protocol.Bind{Statement: name}).Bytes(),
+		(&protocol.Execute{}).Bytes(),
+		protocol.NewSyncMessage(),
+	)
+	expectMessage(t, client, protocol.BindCompleteMessageType)
+	row := expectMessage(t, client, protocol.DataRowMessageType)
+	expectMessage(t, client, protocol.CommandCompleteMessageType)
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+	// a single column, after the column count and value length
+	return string(row[11:])
+}
+
+func prepare(t *testing.T, client *protocol.Conn, names ...string) {
+	for _, name := range names {
+		client.Send((&protocol.Parse{Name: name, Query: "select '" + name + "'"}).Bytes())
+	}
+	client.Send(protocol.NewSyncMessage())
+	for range names {
+		expectMessage(t, client, protocol.ParseCompleteMessageType)
+	}
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+}
+
+func transactionBackend(fb *fakeBackend, maxPreparedStatements int) *config.BackendHostSetting {
+	backend := testBackend(fb)
+	backend.Capacity = 2
+	backend.PoolMode = config.TransactionPooling
+	backend.PoolTimeout = 5 * time.Second
+	backend.MaxPreparedStatements = maxPreparedStatements
+	return backend
+}
+
+func TestPreparedStatementsFollowClient(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, transactionBackend(fb, 10))
+	defer srv.Close()
+
+	first := connectClient(t, addr)
+	defer first.Close()
+	second := connectClient(t, addr)
+	defer second.Close()
+
+	// the first client holds a connection in a transaction so the second
+	// prepares its statement on the other one
+	query(t, first, "begin")
+	second.Send((&protocol.Parse{Name: "s1", Query: "select 2"}).Bytes(), protocol.NewSyncMessage())
+	expectMessage(t, second, protocol.ParseCompleteMessageType)
+	expectMessage(t, second, protocol.ReadyForQueryMessageType)
+
+	// the same name prepared by another client must not collide
+	first.Send((&protocol.Parse{Name: "s1", Query: "select 1"}).Bytes(), protocol.NewSyncMessage())
+	expectMessage(t, first, protocol.ParseCompleteMessageType)
+	expectMessage(t, first, protocol.ReadyForQueryMessageType)
+	query(t, first, "commit")
+
+	// the most recently released connection is the first client's, so the
+	// second client's statement has to be prepared on it again
+	if got := execute(t, second, "s1"); got != "select 2" {
+		t.Errorf("expected the second client's statement to run, got %q", got)
+	}
+	if got := execute(t, first, "s1"); got != "select 1" {
+		t.Errorf("expected the first client's statement to run, got %q", got)
+	}
+	if stats := srv.current().pools["test"].Stats(); stats.Idle != 2 {
+		t.Errorf("expected 2 idle backend connections, got %+v", stats)
+	}
+}
+
+func TestPreparedStatementsEvicted(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, transactionBackend(fb, 1))
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	// with room for a single statement per connection, each one closes the
+	// one before it and is prepared again when used
+	prepare(t, client, "s1", "s2")
+	for _, name := range []string{"s1", "s2", "s1"} {
+		if got := execute(t, client, name); got != "select '"+name+"'" {
+			t.Errorf("expected statement %s to run, got %q", name, got)
+		}
+	}
+
+	client.Send((&protocol.Close{Target: protocol.StatementTarget, Name: "s1"}).Bytes(), protocol.NewSyncMessage())
+	expectMessage(t, client, protocol.CloseCompleteMessageType)
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+
+	// a closed statement is gone like it would be on a single connection
+	client.Send((&protocol.Bind{Statement: "s1"}).Bytes(), protocol.NewSyncMessage())
+	expectMessage(t, client, protocol.ErrorMessageType)
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+}
+
+func TestPreparedStatementsUntrackedInSessionMode(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.MaxPreparedStatements = 10
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	prepare(t, client, "s1")
+	if got := execute(t, client, "s1"); got != "select 's1'" {
+		t.Errorf("expected statement s1 to run, got %q", got)
+	}
+	var session *Session
+	for _, s := range srv.sessionList() {
+		session = s
+	}
+	if len(session.statements) != 0 {
+		t.Errorf("expected no tracked statements in session mode, got %v", session.statements)
+	}
+}
+
+func TestPreparedStatementsDropped(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, transactionBackend(fb, 10))
+	defer srv.Close()
+
+	for _, command := range []string{"DEALLOCATE ALL", "DISCARD ALL"} {
+		client := connectClient(t, addr)
+		prepare(t, client, "s1")
+		query(t, client, command)
+
+		// gone like it would be on a single connection, not prepared again
+		client.Send((&protocol.Bind{Statement: "s1"}).Bytes(), protocol.NewSyncMessage())
+		expectMessage(t, client, protocol.ErrorMessageType)
+		expectMessage(t, client, protocol.ReadyForQueryMessageType)
+		client.Close()
+	}
+}
+
+func TestTooManyPreparedStatements(t *testing.T) {
+	defer func(max int) { maxSessionStatements = max }(maxSessionStatements)
+	maxSessionStatements = 2
+
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, transactionBackend(fb, 10))
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	prepare(t, client, "s1", "s2")
+	// preparing a name again replaces the statement
+	prepare(t, client, "s2")
+
+	client.Send((&protocol.Parse{Name: "s3", Query: "select 3"}).Bytes(), protocol.NewSyncMessage())
+	message := expectMessage(t, client, protocol.ErrorMessageType)
+	if code := protocol.GetErrorCode(message); code != protocol.SQLStateProgramLimitExceeded {
+		t.Errorf("expected SQLSTATE %s, got %s", protocol.SQLStateProgramLimitExceeded, code)
+	}
+}
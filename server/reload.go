@@ -0,0 +1,301 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// setup is everything a Server runs with that a reload replaces, the
+// settings and what was built from them. It is not changed once in use, a
+// reload swaps in a new one, see Server.current.
+type setup struct {
+	settings  config.RockyProxySettings
+	pools     map[string]*pool.Pool
+	databases map[string]*database
+	router    *router
+	// clients allowed to log in when rocky authenticates them itself
+	users protocol.Userlist
+	// nil unless TLS is offered to clients
+	tlsConfig *tls.Config
+}
+
+// newSetup builds the setup for settings, loading the auth file and client
+// TLS certificate. The pools and databases of old that the settings leave
+// unchanged are kept, the pool limits of the new settings are not applied to
+// them yet. If building fails the pools created so far are closed and old is
+// left as it was.
+func newSetup(settings config.RockyProxySettings, old *setup) (*setup, error) {
+	// admin logins fall back to the first backend
+	if len(settings.BackendHosts) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+
+	var users protocol.Userlist
+	if settings.AuthType != "" && settings.AuthType != config.AuthBackend {
+		var err error
+		if users, err = protocol.LoadUserlist(settings.AuthFile); err != nil {
+			return nil, fmt.Errorf("loading auth file: %s", err)
+		}
+	}
+
+	tlsConfig, err := newClientTLSConfig(settings.ClientTLS)
+	if err != nil {
+		return nil, fmt.Errorf("loading client TLS settings: %s", err)
+	}
+
+	next := &setup{
+		settings:  settings,
+		pools:     make(map[string]*pool.Pool),
+		users:     users,
+		tlsConfig: tlsConfig,
+	}
+	for _, backend := range settings.BackendHosts {
+		if p := old.reusablePool(backend, settings.MaxMessageSize); p != nil {
+			next.pools[backend.Name] = p
+			continue
+		}
+		backendPool, err := pool.New(backend, settings.MaxMessageSize)
+		if err != nil {
+			next.closeNewPools(old)
+			return nil, fmt.Errorf("backend %s: %s", backend.Name, err)
+		}
+		next.pools[backend.Name] = backendPool
+	}
+
+	databases, err := newDatabases(settings, next.pools)
+	if err == nil {
+		next.databases = old.keepDatabases(settings, databases, next.pools)
+		next.router, err = newRouter(settings, next.databases)
+	}
+	if err != nil {
+		next.closeNewPools(old)
+		return nil, err
+	}
+	return next, nil
+}
+
+// reusablePool returns the pool of old connecting to backend, nil if there is
+// none or the backend changed in more than its pool limits.
+func (old *setup) reusablePool(backend *config.BackendHostSetting, maxMessageSize int) *pool.Pool {
+	if old == nil || old.settings.MaxMessageSize != maxMessageSize {
+		return nil
+	}
+	p, ok := old.pools[backend.Name]
+	if !ok || !reflect.DeepEqual(withoutLimits(p.Config()), withoutLimits(backend)) {
+		return nil
+	}
+	return p
+}
+
+// withoutLimits returns backend without the settings that can change while
+// its pool is in use, see pool.Pool.SetLimits. The proxy port and
+// connection_max are left out as well, the pool does not use them.
+func withoutLimits(backend *config.BackendHostSetting) config.BackendHostSetting {
+	rest := *backend
+	rest.ProxyPort, rest.ConnectionMax = 0, 0
+	rest.Capacity, rest.MinIdle, rest.MaxIdle = 0, 0, 0
+	rest.IdleTimeout, rest.MaxLifetime, rest.PoolTimeout = 0, 0, 0
+	return rest
+}
+
+// keepDatabases replaces the databases that did not change since old with
+// those of old, so sessions stay connected to them and a logical database
+// keeps the primary a failover moved it to.
+func (old *setup) keepDatabases(settings config.RockyProxySettings, databases map[string]*database,
+	pools map[string]*pool.Pool) map[string]*database {
+	if old == nil {
+		return databases
+	}
+	for name, db := range databases {
+		previous, ok := old.databases[name]
+		if !ok || previous.proxyPort != db.proxyPort {
+			continue
+		}
+		setting := databaseSetting(settings, name)
+		if !reflect.DeepEqual(withoutConnectionMax(setting), withoutConnectionMax(databaseSetting(old.settings, name))) {
+			continue
+		}
+		unchanged := true
+		for _, backend := range databaseBackends(name, setting) {
+			if old.pools[backend] != pools[backend] {
+				unchanged = false
+			}
+		}
+		if unchanged {
+			databases[name] = previous
+		}
+	}
+	return databases
+}
+
+// databaseSetting returns the logical database called name, nil if there is
+// none.
+func databaseSetting(settings config.RockyProxySettings, name string) *config.DatabaseSetting {
+	for _, setting := range settings.Databases {
+		if setting.Name == name {
+			return setting
+		}
+	}
+	return nil
+}
+
+// withoutConnectionMax returns a copy of setting without its connection_max,
+// which applies to the database in use. nil stays nil.
+func withoutConnectionMax(setting *config.DatabaseSetting) *config.DatabaseSetting {
+	if setting == nil {
+		return nil
+	}
+	rest := *setting
+	rest.ConnectionMax = 0
+	return &rest
+}
+
+// databaseBackends names the backends a database called name uses, setting
+// is nil for a backend of that name.
+func databaseBackends(name string, setting *config.DatabaseSetting) []string {
+	if setting == nil {
+		return []string{name}
+	}
+	backends := append([]string{setting.Primary}, setting.Candidates...)
+	return append(backends, setting.Replicas...)
+}
+
+// closeNewPools closes the pools of the setup that old does not have.
+func (next *setup) closeNewPools(old *setup) {
+	for name, p := range next.pools {
+		if old == nil || old.pools[name] != p {
+			p.Close()
+		}
+	}
+}
+
+func (setup *setup) poolNames() []string {
+	var names []string
+	for name := range setup.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// current returns what the server runs with.
+func (s *Server) current() *setup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setup
+}
+
+// Reload re-reads the config file the server's settings were loaded from and
+// applies it with ReloadSettings, nothing changes if the file has any
+// problem. Settings not loaded from a file are applied again, which re-reads
+// the auth file and client TLS certificate.
+func (s *Server) Reload() error {
+	settings := s.current().settings
+	if settings.Path != "" {
+		loaded, err := config.Load(settings.Path)
+		if err != nil {
+			return err
+		}
+		settings = *loaded
+	}
+	return s.ReloadSettings(settings)
+}
+
+// ReloadSettings switches the server to new settings without disconnecting
+// clients. Pools are created for new backends and replace those of backends
+// that changed in more than their pool limits, which are applied to the pools
+// in use instead. Replaced and removed pools close their connections as
+// clients return them. Outside of session mode clients move to the new pools
+// with their next transaction, in session mode they keep their connection
+// until they leave.
+//
+// While ListenAndServe is running the proxy ports and host_port that changed
+// are bound and closed as well, a changed metrics_address needs a restart.
+// If anything cannot be set up, such as a port that cannot be bound, nothing
+// changes and the error is returned.
+func (s *Server) ReloadSettings(settings config.RockyProxySettings) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.current()
+	next, err := newSetup(settings, old)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	current := s.proxyListeners
+	s.mu.Unlock()
+	var opened map[string]*proxyListener
+	if current != nil {
+		if opened, err = bindListeners(listenAddresses(settings), current); err != nil {
+			next.closeNewPools(old)
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		closeProxyListeners(opened)
+		next.closeNewPools(old)
+		return errors.New("server closed")
+	}
+	s.setup = next
+	var stale []net.Listener
+	if current != nil {
+		addresses := listenAddresses(settings)
+		for name, l := range s.proxyListeners {
+			if addresses[name] != l.address {
+				delete(s.proxyListeners, name)
+				s.removeListenerLocked(l.listener)
+				stale = append(stale, l.listener)
+			}
+		}
+		for name, l := range opened {
+			s.proxyListeners[name] = l
+			s.serving.Add(1)
+			go s.serveListener(name, l.listener)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, listener := range stale {
+		listener.Close()
+	}
+	added, replaced, removed := 0, 0, 0
+	for _, backend := range settings.BackendHosts {
+		p := next.pools[backend.Name]
+		switch previous, ok := old.pools[backend.Name]; {
+		case !ok:
+			added++
+		case previous == p:
+			p.SetLimits(backend)
+		default:
+			replaced++
+		}
+	}
+	for name, p := range old.pools {
+		if next.pools[name] != p {
+			if _, ok := next.pools[name]; !ok {
+				removed++
+			}
+			p.Close()
+		}
+	}
+	if settings.MetricsAddress != old.settings.MetricsAddress {
+		pLogger.Printf("metrics_address changed to %q, it takes effect after a restart\n", settings.MetricsAddress)
+	}
+	s.watchPrimariesIfNeeded(next)
+
+	pLogger.Printf("reloaded settings: %d backends added, %d replaced, %d removed\n", added, replaced, removed)
+	return nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+)
+
+func TestReloadSettings(t *testing.T) {
+	first := newFakeBackend(t)
+	defer first.Close()
+	second := newFakeBackend(t)
+	defer second.Close()
+
+	backend := testBackend(first)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{backend}})
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+	old := srv.current().pools["test"]
+
+	// a new pool size applies to the pool in use
+	resized := *backend
+	resized.Capacity = 3
+	if err := srv.ReloadSettings(config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{&resized}}); err != nil {
+		t.Fatal(err)
+	}
+	if p := srv.current().pools["test"]; p != old || p.Config().Capacity != 3 {
+		t.Fatalf("expected the pool to be kept with capacity 3, got capacity %d", p.Config().Capacity)
+	}
+
+	// a backend moving elsewhere gets a new pool, the client follows it with
+	// its next transaction
+	moved := resized
+	moved.Port = second.listener.Addr().String()
+	if err := srv.ReloadSettings(config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{&moved}}); err != nil {
+		t.Fatal(err)
+	}
+	if srv.current().pools["test"] == old {
+		t.Fatal("expected the pool to be replaced")
+	}
+	if _, err := old.Get(); err != pool.ErrPoolClosed {
+		t.Errorf("expected the old pool to be closed, got %v", err)
+	}
+
+	query(t, client, "select 2")
+	if queries := withoutChecks(second.Queries()); len(queries) != 1 || queries[0] != "select 2" {
+		t.Errorf("expected the query on the new backend, got %v", queries)
+	}
+}
+
+func TestReloadSettingsRejectsBrokenSettings(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	srv, _ := startServer(t, backend)
+	defer srv.Close()
+	old := srv.current()
+
+	err := srv.ReloadSettings(config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{backend, {Name: "other", Port: fb.listener.Addr().String()}},
+		Routes:       []*config.RouteSetting{{Name: "broken", Database: "*", User: "*", Target: "nowhere"}},
+	})
+	if err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if srv.current() != old {
+		t.Error("expected the settings to stay as they were")
+	}
+}
+
+// writeConfig writes a config file for the backend at backendAddr with the
+// given capacity, returning its path.
+func writeConfig(t *testing.T, dir, backendAddr string, capacity int) string {
+	path := filepath.Join(dir, "config.toml")
+	contents := fmt.Sprintf(`
+[backend_test]
+host_port = %q
+username = "test"
+database = "test"
+capacity = %d
+health_check_interval = 0
+
+[rocky_proxy_settings]
+admin_users = ["admin"]
+`, backendAddr, capacity)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAdminReload(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+	dir, err := ioutil.TempDir("", "rocky-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	settings, err := config.Load(writeConfig(t, dir, fb.listener.Addr().String(), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, addr := startServerWith(t, *settings)
+	defer srv.Close()
+
+	admin := adminClient(t, addr)
+	defer admin.Close()
+
+	writeConfig(t, dir, fb.listener.Addr().String(), 4)
+	adminQuery(t, admin, "RELOAD")
+	if pools := adminQuery(t, admin, "SHOW POOLS"); pools[0][7] != "4" {
+		t.Errorf("expected capacity 4 after RELOAD, got %v", pools[0])
+	}
+
+	// a file with problems changes nothing
+	writeConfig(t, dir, fb.listener.Addr().String(), 0)
+	admin.Send(queryMessage("RELOAD"))
+	message := readMessage(t, admin)
+	if !strings.Contains(string(message), "capacity") {
+		t.Errorf("expected an error naming capacity, got %q", message)
+	}
+	readMessage(t, admin)
+	if pools := adminQuery(t, admin, "SHOW POOLS"); pools[0][7] != "4" {
+		t.Errorf("expected capacity 4 after a failed RELOAD, got %v", pools[0])
+	}
+}
+
+// freePort returns a port nothing is listening on.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitForListener waits until something listens on port, or stops listening.
+func waitForListener(t *testing.T, port int, listening bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) == listening {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("port %d: expected listening to be %v", port, listening)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadBindsProxyPorts(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.ProxyPort = freePort(t)
+	srv, err := New(config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{backend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	waitForListener(t, backend.ProxyPort, true)
+
+	other := testBackend(fb)
+	other.Name = "other"
+	other.ProxyPort = freePort(t)
+	if err := srv.ReloadSettings(config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{other}}); err != nil {
+		t.Fatal(err)
+	}
+	waitForListener(t, other.ProxyPort, true)
+	waitForListener(t, backend.ProxyPort, false)
+
+	client := connectClient(t, fmt.Sprintf("127.0.0.1:%d", other.ProxyPort))
+	query(t, client, "select 1")
+	client.Close()
+
+	srv.Close()
+	if err := <-served; err != nil {
+		t.Errorf("expected ListenAndServe to return nil after Close, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+)
+
+// waitForQuery waits until the fake backend received query, returning false
+// if it did not within a second.
+func waitForQuery(fb *fakeBackend, query string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, q := range fb.Queries() {
+			if q == query {
+				return true
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func countQuery(fb *fakeBackend, query string) int {
+	count := 0
+	for _, q := range fb.Queries() {
+		if q == query {
+			count++
+		}
+	}
+	return count
+}
+
+func TestResetQueryOnRelease(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.ServerResetQuery = "DISCARD ALL"
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	query(t, client, "select 1")
+	client.Close()
+
+	if !waitForQuery(fb, "DISCARD ALL") {
+		t.Fatalf("expected the reset query to run, got %v", fb.Queries())
+	}
+
+	// the connection is only reused once the reset is done
+	client = connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+	if got := srv.current().pools["test"].Stats(); got.Idle+got.Active != 1 {
+		t.Errorf("expected the connection to be reused, got %+v", got)
+	}
+}
+
+func TestResetQueryInTransactionMode(t *testing.T) {
+	for _, always := range []bool{false, true} {
+		fb := newFakeBackend(t)
+		backend := testBackend(fb)
+		backend.PoolMode = config.TransactionPooling
+		backend.ServerResetQuery = "DISCARD ALL"
+		backend.ServerResetQueryAlways = always
+		srv, addr := startServer(t, backend)
+
+		client := connectClient(t, addr)
+		query(t, client, "select 1")
+		query(t, client, "select 1")
+		if reset := waitForQuery(fb, "DISCARD ALL"); reset != always {
+			t.Errorf("with server_reset_query_always %v expected reset %v", always, always)
+		}
+
+		client.Close()
+		srv.Close()
+		fb.Close()
+	}
+}
+
+func TestCheckQueryOnIdleConnections(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	backend.ServerCheckQuery = "select 'check'"
+	backend.ServerCheckDelay = 20 * time.Millisecond
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+	query(t, client, "select 1")
+	if got := countQuery(fb, "select 'check'"); got != 0 {
+		t.Errorf("expected recently used connections not to be checked, got %d checks", got)
+	}
+
+	time.Sleep(2 * backend.ServerCheckDelay)
+	query(t, client, "select 1")
+	if got := countQuery(fb, "select 'check'"); got != 1 {
+		t.Errorf("expected 1 check, got %d", got)
+	}
+
+}
+
+func TestCheckQueryFailureReplacesConnection(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	backend.ServerCheckQuery = "fail"
+	backend.ServerCheckDelay = 20 * time.Millisecond
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+	before := fb.Connections()
+
+	time.Sleep(2 * backend.ServerCheckDelay)
+	query(t, client, "select 1")
+	if got := countQuery(fb, "fail"); got != 1 {
+		t.Errorf("expected 1 failed check, got %d", got)
+	}
+	if got := fb.Connections(); got != before+1 {
+		t.Errorf("expected the failed connection to be replaced, got %d new connections", got-before)
+	}
+	if got := srv.current().pools["test"].Stats(); got.Idle+got.Active != 1 {
+		t.Errorf("expected a single open connection, got %+v", got)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/johnshiver/rocky/config"
+)
+
+// route sends clients asking for a database as a user to a backend or
+// logical database, see config.RouteSetting.
+type route struct {
+	name     string
+	database string
+	user     string
+	target   *database
+	// made up for a backend or logical database of the same name
+	implicit bool
+}
+
+// router picks the database serving a client of the host_port listener.
+type router struct {
+	// most specific first, see newRouter
+	routes []*route
+}
+
+// newRouter returns a router with a route for every database by its own
+// name, and the configured ones.
+//
+// The most specific route matching a client wins: an exact database name
+// beats a pattern, then an exact user beats a pattern, then the longer
+// database pattern wins. Configured routes win over implicit ones otherwise
+// equal, and ties are broken by name.
+func newRouter(settings config.RockyProxySettings, databases map[string]*database) (*router, error) {
+	r := &router{}
+	for name, db := range databases {
+		r.routes = append(r.routes, &route{name: name, database: name, user: "*", target: db, implicit: true})
+	}
+	for _, setting := range settings.Routes {
+		target, ok := databases[setting.Target]
+		if !ok {
+			return nil, fmt.Errorf("route %s: unknown target %q", setting.Name, setting.Target)
+		}
+		for _, pattern := range []string{setting.Database, setting.User} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("route %s: bad pattern %q", setting.Name, pattern)
+			}
+		}
+		r.routes = append(r.routes, &route{
+			name:     setting.Name,
+			database: setting.Database,
+			user:     setting.User,
+			target:   target,
+		})
+	}
+
+	sort.Slice(r.routes, func(i, j int) bool {
+		a, b := r.routes[i], r.routes[j]
+		if a.rank() != b.rank() {
+			return a.rank() < b.rank()
+		}
+		if len(a.database) != len(b.database) {
+			return len(a.database) > len(b.database)
+		}
+		if a.implicit != b.implicit {
+			return !a.implicit
+		}
+		return a.name < b.name
+	})
+	return r, nil
+}
+
+// rank orders routes by how specific they are, lower first.
+func (rt *route) rank() int {
+	rank := 0
+	if isPattern(rt.database) {
+		rank += 2
+	}
+	if isPattern(rt.user) {
+		rank++
+	}
+	return rank
+}
+
+func (rt *route) matches(database, user string) bool {
+	databaseMatches, _ := path.Match(rt.database, database)
+	userMatches, _ := path.Match(rt.user, user)
+	return databaseMatches && userMatches
+}
+
+// resolve returns the database serving clients asking for database as user,
+// nil if no route matches.
+func (r *router) resolve(database, user string) *database {
+	for _, rt := range r.routes {
+		if rt.matches(database, user) {
+			return rt.target
+		}
+	}
+	return nil
+}
+
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+func TestRouterResolve(t *testing.T) {
+	databases := map[string]*database{
+		"sales":   {name: "sales"},
+		"hr":      {name: "hr"},
+		"reports": {name: "reports"},
+		"default": {name: "default"},
+	}
+	r, err := newRouter(config.RockyProxySettings{Routes: []*config.RouteSetting{
+		{Name: "analyst", Database: "*", User: "analyst", Target: "reports"},
+		{Name: "hr_reports", Database: "hr", User: "report_*", Target: "reports"},
+		{Name: "archive", Database: "sales_*", User: "*", Target: "sales"},
+		{Name: "fallback", Database: "*", User: "*", Target: "default"},
+	}}, databases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		database, user, expected string
+	}{
+		// databases are routed by their own name
+		{"sales", "alice", "sales"},
+		{"hr", "alice", "hr"},
+		// an exact database beats a pattern matching the user
+		{"sales", "analyst", "sales"},
+		{"hr", "report_bot", "reports"},
+		{"sales_2019", "alice", "sales"},
+		{"sales_2019", "analyst", "reports"},
+		{"unknown", "alice", "default"},
+	}
+	for _, test := range tests {
+		db := r.resolve(test.database, test.user)
+		if db == nil || db.name != test.expected {
+			t.Errorf("resolve(%q, %q) = %v, expected %s", test.database, test.user, db, test.expected)
+		}
+	}
+
+	r, err = newRouter(config.RockyProxySettings{}, databases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db := r.resolve("unknown", "alice"); db != nil {
+		t.Errorf("expected no route without a fallback, got %s", db.name)
+	}
+
+	for _, route := range []*config.RouteSetting{
+		{Name: "missing", Database: "*", User: "*", Target: "missing"},
+		{Name: "bad", Database: "[", User: "*", Target: "sales"},
+	} {
+		if _, err := newRouter(config.RockyProxySettings{Routes: []*config.RouteSetting{route}}, databases); err == nil {
+			t.Errorf("expected an error for route %+v", route)
+		}
+	}
+}
+
+// startRoutedServer serves settings on a random routed port.
+func startRoutedServer(t *testing.T, settings config.RockyProxySettings) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeRouted(listener)
+	return srv, listener.Addr().String()
+}
+
+// startup sends a startup message for database as user and returns the
+// first message answering it.
+func startup(t *testing.T, addr, database, user string) (*protocol.Conn, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	client.WriteStartupMessage(protocol.NewStartupMessage(user, database, map[string]string{}))
+	client.Flush()
+	return client, readMessage(t, client)
+}
+
+func TestRoutedListener(t *testing.T) {
+	sales := newFakeBackend(t)
+	defer sales.Close()
+	hr := newFakeBackend(t)
+	defer hr.Close()
+
+	salesBackend := testBackend(sales)
+	salesBackend.Name = "sales"
+	hrBackend := testBackend(hr)
+	hrBackend.Name = "hr"
+	srv, addr := startRoutedServer(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{salesBackend, hrBackend},
+		Routes: []*config.RouteSetting{
+			{Name: "payroll", Database: "payroll", User: "*", Target: "hr"},
+		},
+	})
+	defer srv.Close()
+
+	for _, test := range []struct {
+		database string
+		backend  *fakeBackend
+	}{
+		{"sales", sales},
+		{"hr", hr},
+		{"payroll", hr},
+	} {
+		client, message := startup(t, addr, test.database, "test")
+		if !protocol.IsAuthenticationOk(message) {
+			t.Fatalf("expected AuthenticationOk for %s, got %v", test.database, message)
+		}
+		finishStartup(t, client)
+		query(t, client, "select '"+test.database+"'")
+		client.Close()
+
+		found := false
+		for _, q := range test.backend.Queries() {
+			found = found || q == "select '"+test.database+"'"
+		}
+		if !found {
+			t.Errorf("expected database %s to be served by its backend", test.database)
+		}
+	}
+
+	client, message := startup(t, addr, "missing", "test")
+	defer client.Close()
+	if protocol.GetMessageType(message) != protocol.ErrorMessageType {
+		t.Fatalf("expected an ErrorResponse, got %v", message)
+	}
+	if pgErr, err := protocol.ParseErrorResponse(message); err != nil || pgErr.Code != protocol.SQLStateInvalidCatalogName {
+		t.Errorf("expected error %s, got %v", protocol.SQLStateInvalidCatalogName, pgErr)
+	}
+}
+
+func TestAdminOnRoutedListener(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startRoutedServer(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{testBackend(fb)},
+		AdminUsers:   []string{"admin"},
+	})
+	defer srv.Close()
+
+	admin := adminClient(t, addr)
+	defer admin.Close()
+	if pools := adminQuery(t, admin, "SHOW POOLS"); len(pools) != 1 {
+		t.Errorf("expected a row for the test pool, got %v", pools)
+	}
+}
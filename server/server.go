@@ -0,0 +1,410 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/logger"
+	"github.com/johnshiver/rocky/netcon"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+var pLogger *logger.PGLogger
+
+func init() {
+	pLogger = logger.GetLogInstance()
+}
+
+// Server accepts client connections on the proxy port of each backend and
+// logical database and relays every client to it in its own Session, using
+// connections from the backends' pools.
+type Server struct {
+	metrics *serverMetrics
+	// closed by Close
+	done chan struct{}
+	// held while the settings are being replaced, see ReloadSettings
+	reloadMu sync.Mutex
+	// starts watchPrimaries the first time a database has candidates
+	watching sync.Once
+
+	mu sync.Mutex
+	// what the server runs with, see current
+	setup     *setup
+	closed    bool
+	listeners []net.Listener
+	// listeners bound by ListenAndServe and reloads, by the name of the
+	// database they serve, "" for routed clients. nil unless ListenAndServe
+	// is running.
+	proxyListeners map[string]*proxyListener
+	// listeners that ListenAndServe waits for, and the first error one of
+	// them failed with
+	serving  sync.WaitGroup
+	serveErr error
+	sessions map[*Session]struct{}
+	// sessions by the key their client can cancel queries with
+	cancelKeys map[protocol.BackendKey]*Session
+	// clients counted against the connection limits, and what each session
+	// was counted as
+	clients  clientCounts
+	admitted map[*Session]admission
+	// prepared statement names handed out, see nextStatementName
+	statements uint64
+	wg         sync.WaitGroup
+}
+
+// proxyListener is a listener bound to address by ListenAndServe.
+type proxyListener struct {
+	address  string
+	listener net.Listener
+}
+
+// New creates a Server for the given settings along with a connection pool
+// for every backend, loading the auth file if clients are authenticated by
+// rocky. Nothing is bound until ListenAndServe is called.
+func New(settings config.RockyProxySettings) (*Server, error) {
+	setup, err := newSetup(settings, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		setup:      setup,
+		sessions:   make(map[*Session]struct{}),
+		cancelKeys: make(map[protocol.BackendKey]*Session),
+		clients: clientCounts{
+			users:     make(map[string]int),
+			databases: make(map[string]int),
+		},
+		admitted: make(map[*Session]admission),
+		done:     make(chan struct{}),
+	}
+	s.metrics = newServerMetrics(s)
+	s.watchPrimariesIfNeeded(setup)
+	return s, nil
+}
+
+// newClientTLSConfig builds the TLS config offered to clients, or returns nil
+// if client TLS is not configured.
+func newClientTLSConfig(settings config.ClientTLSSetting) (*tls.Config, error) {
+	if !settings.Enabled() {
+		if settings.Require {
+			return nil, errors.New("require_tls is set but no certificate is configured")
+		}
+		return nil, nil
+	}
+
+	clientAuth := tls.NoClientCert
+	switch settings.ClientCert {
+	case config.ClientCertOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case config.ClientCertRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if clientAuth != tls.NoClientCert && settings.CAFile == "" {
+		return nil, errors.New("verifying client certificates needs a CA file")
+	}
+
+	return netcon.NewServerTLSConfig(settings.CertFile, settings.KeyFile, settings.CAFile, clientAuth)
+}
+
+// ListenAndServe binds a listener to the ProxyPort of every configured backend
+// and logical database, and one to HostPort routing clients by database and
+// user, and serves clients until Close is called. Backends without a
+// ProxyPort are only reachable through a logical database or a route. Metrics
+// are served as well if a metrics address is configured. Reloads bind and
+// close listeners as the settings change.
+//
+// If any port cannot be bound the listeners already opened are closed and the
+// error is returned.
+func (s *Server) ListenAndServe() error {
+	s.reloadMu.Lock()
+	settings := s.current().settings
+	listeners, err := bindListeners(listenAddresses(settings), nil)
+	if err != nil {
+		s.reloadMu.Unlock()
+		return err
+	}
+	var metricsListener net.Listener
+	if settings.MetricsAddress != "" {
+		if metricsListener, err = netcon.ListenTCP(settings.MetricsAddress); err != nil {
+			s.reloadMu.Unlock()
+			closeProxyListeners(listeners)
+			return fmt.Errorf("metrics: %s", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.proxyListeners = listeners
+	for name, l := range listeners {
+		s.serving.Add(1)
+		go s.serveListener(name, l.listener)
+	}
+	if metricsListener != nil {
+		s.serving.Add(1)
+		go func() {
+			defer s.serving.Done()
+			s.serveFailed(s.ServeMetrics(metricsListener))
+		}()
+	}
+	s.mu.Unlock()
+	s.reloadMu.Unlock()
+
+	<-s.done
+	s.serving.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serveErr
+}
+
+// listenAddresses returns the addresses ListenAndServe binds by the name of
+// the database served on them, "" for routed clients.
+func listenAddresses(settings config.RockyProxySettings) map[string]string {
+	addresses := make(map[string]string)
+	for _, backend := range settings.BackendHosts {
+		if backend.ProxyPort != 0 {
+			addresses[backend.Name] = fmt.Sprintf(":%d", backend.ProxyPort)
+		}
+	}
+	for _, db := range settings.Databases {
+		if db.ProxyPort != 0 {
+			addresses[db.Name] = fmt.Sprintf(":%d", db.ProxyPort)
+		}
+	}
+	if settings.HostPort != "" {
+		addresses[""] = settings.HostPort
+	}
+	return addresses
+}
+
+// bindListeners binds the addresses that are not bound to the same name in
+// current already. If one cannot be bound, those opened are closed again.
+func bindListeners(addresses map[string]string, current map[string]*proxyListener) (map[string]*proxyListener, error) {
+	var names []string
+	for name := range addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	opened := make(map[string]*proxyListener)
+	for _, name := range names {
+		address := addresses[name]
+		if l, ok := current[name]; ok && l.address == address {
+			continue
+		}
+		listener, err := netcon.ListenTCP(address)
+		if err != nil {
+			closeProxyListeners(opened)
+			if name == "" {
+				return nil, fmt.Errorf("host_port: %s", err)
+			}
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		opened[name] = &proxyListener{address: address, listener: listener}
+	}
+	return opened, nil
+}
+
+func closeProxyListeners(listeners map[string]*proxyListener) {
+	for _, l := range listeners {
+		l.listener.Close()
+	}
+}
+
+// serveListener serves a listener bound by ListenAndServe or a reload for
+// the database called name, closing the server if it fails.
+func (s *Server) serveListener(name string, listener net.Listener) {
+	defer s.serving.Done()
+	s.serveFailed(s.serve(listener, name))
+}
+
+// serveFailed closes the server after a listener failed with err, which
+// ListenAndServe returns. A nil err is ignored.
+func (s *Server) serveFailed(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.serveErr == nil {
+		s.serveErr = err
+	}
+	s.mu.Unlock()
+	s.Close()
+}
+
+// Serve accepts clients on listener and relays them to backend. It blocks
+// until the listener fails or the server is closed, in which case nil is
+// returned.
+func (s *Server) Serve(listener net.Listener, backend *config.BackendHostSetting) error {
+	return s.ServeDatabase(listener, backend.Name)
+}
+
+// ServeDatabase is Serve for a backend or logical database by name.
+func (s *Server) ServeDatabase(listener net.Listener, name string) error {
+	if _, ok := s.current().databases[name]; !ok || name == "" {
+		listener.Close()
+		return fmt.Errorf("no backend or database %s", name)
+	}
+	return s.serve(listener, name)
+}
+
+// ServeRouted is Serve for clients routed by the database and user they
+// ask for.
+func (s *Server) ServeRouted(listener net.Listener) error {
+	return s.serve(listener, "")
+}
+
+// serve accepts clients for the database called name on listener, or routes
+// them if name is empty. Clients are given the database of that name in
+// effect when they connect.
+func (s *Server) serve(listener net.Listener, name string) error {
+	if !s.addListener(listener) {
+		listener.Close()
+		return nil
+	}
+	served := name
+	if name == "" {
+		served = "routed databases"
+	}
+	pLogger.Printf("accepting clients for %s on %s\n", served, listener.Addr())
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			// the listener was closed by Close or a reload
+			if s.isClosed() || !s.isListening(listener) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				pLogger.Printf("accept error: %s\n", err.Error())
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		var db *database
+		if name != "" {
+			if db = s.current().databases[name]; db == nil {
+				// removed by a reload that is closing the listener
+				client.Close()
+				continue
+			}
+		}
+		session := newSession(client, s, db)
+		if !s.addSession(session) {
+			session.Close()
+			return nil
+		}
+		go func() {
+			defer s.removeSession(session)
+			session.Run()
+		}()
+	}
+}
+
+// Close stops accepting clients, closes every open session and pool and
+// waits for the sessions to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for session := range s.sessions {
+		session.Close()
+	}
+	setup := s.setup
+	s.mu.Unlock()
+
+	for _, serverPool := range setup.pools {
+		serverPool.Close()
+	}
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) userlist() protocol.Userlist {
+	return s.current().users
+}
+
+// sessionList returns the open sessions.
+func (s *Server) sessionList() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) addListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners = append(s.listeners, listener)
+	return true
+}
+
+func (s *Server) isListening(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// removeListenerLocked forgets a listener about to be closed. s.mu must be
+// held.
+func (s *Server) removeListenerLocked(listener net.Listener) {
+	for i, l := range s.listeners {
+		if l == listener {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) addSession(session *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.sessions[session] = struct{}{}
+	session.key = s.newCancelKeyLocked()
+	s.cancelKeys[session.key] = session
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) removeSession(session *Session) {
+	s.mu.Lock()
+	delete(s.sessions, session)
+	delete(s.cancelKeys, session.key)
+	s.releaseLocked(session)
+	s.mu.Unlock()
+	s.wg.Done()
+}
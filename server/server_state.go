@@ -0,0 +1,132 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// serverState follows the messages relayed over a backend connection to
+// tell when the connection is idle: every request the client made has been
+// answered with ReadyForQuery and no transaction is open. Only an idle
+// connection can be handed to another client.
+type serverState struct {
+	mu sync.Mutex
+
+	// Query, Sync and FunctionCall messages still waiting for ReadyForQuery
+	pending int
+	// extended query messages were sent without a Sync after them
+	unsynced bool
+	// status from the last ReadyForQuery
+	txStatus byte
+	// Parse and Close messages waiting for their completion message, along
+	// with the messages answered by ReadyForQuery, in the order they were
+	// sent
+	expected []expectedResponse
+}
+
+// expectedResponse is a message the backend has yet to answer.
+type expectedResponse struct {
+	messageType byte
+	// backend name of the statement a Parse prepares
+	statement string
+	// the answer to a message sent by rocky is not relayed to the client
+	injected bool
+}
+
+func newServerState() *serverState {
+	return &serverState{txStatus: protocol.TransactionIdle}
+}
+
+// sent records a message sent to the backend, forwarded from the client or
+// injected by rocky. statement is the backend name of the statement a Parse
+// prepares.
+func (s *serverState) sent(messageType byte, statement string, injected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch messageType {
+	case protocol.QueryMessageType, protocol.FunctionCallMessageType:
+		s.pending++
+		s.expected = append(s.expected, expectedResponse{messageType: messageType})
+	case protocol.SyncMessageType:
+		s.pending++
+		s.unsynced = false
+		s.expected = append(s.expected, expectedResponse{messageType: messageType})
+	case protocol.ParseMessageType, protocol.CloseMessageType:
+		s.unsynced = true
+		s.expected = append(s.expected, expectedResponse{messageType, statement, injected})
+	case protocol.CopyDataMessageType, protocol.CopyDoneMessageType, protocol.CopyFailMessageType:
+		// part of a COPY started by a Query that is already pending
+	default:
+		s.unsynced = true
+	}
+}
+
+// received matches a backend message against the messages waiting for an
+// answer. It returns whether the message should be relayed to the client and
+// the statements that an error kept from being prepared.
+func (s *serverState) received(message []byte) (relay bool, unprepared []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch protocol.GetMessageType(message) {
+	case protocol.ParseCompleteMessageType, protocol.CloseCompleteMessageType:
+		if len(s.expected) == 0 || s.expected[0].answeredByReadyForQuery() {
+			return true, nil
+		}
+		response := s.expected[0]
+		s.expected = s.expected[1:]
+		return !response.injected, nil
+	case protocol.ErrorMessageType:
+		// the backend skips every message up to the next Sync
+		for len(s.expected) > 0 && !s.expected[0].answeredByReadyForQuery() {
+			if s.expected[0].messageType == protocol.ParseMessageType && s.expected[0].statement != "" {
+				unprepared = append(unprepared, s.expected[0].statement)
+			}
+			s.expected = s.expected[1:]
+		}
+	case protocol.ReadyForQueryMessageType:
+		for len(s.expected) > 0 {
+			response := s.expected[0]
+			s.expected = s.expected[1:]
+			if response.answeredByReadyForQuery() {
+				break
+			}
+		}
+	}
+	return true, unprepared
+}
+
+func (r expectedResponse) answeredByReadyForQuery() bool {
+	return r.messageType != protocol.ParseMessageType && r.messageType != protocol.CloseMessageType
+}
+
+// serverMessage records a message forwarded from the backend to the client.
+// It returns true if the message left the connection idle.
+func (s *serverState) serverMessage(message []byte) bool {
+	if protocol.GetMessageType(message) != protocol.ReadyForQueryMessageType {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending > 0 {
+		s.pending--
+	}
+	s.txStatus = message[5]
+	return s.idleLocked()
+}
+
+// idle reports whether the backend has answered everything and is outside a
+// transaction.
+func (s *serverState) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idleLocked()
+}
+
+func (s *serverState) idleLocked() bool {
+	return s.pending == 0 && !s.unsynced && s.txStatus == protocol.TransactionIdle
+}
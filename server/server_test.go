@@ -0,0 +1,690 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/msgbuf"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// fakeBackend is a trust-auth postgres stand in. Every connection gets
+// AuthenticationOk, a BackendKeyData with its connection number as process
+// ID and ReadyForQuery after its startup message, then each Query is
+// answered with CommandComplete and ReadyForQuery. "begin" and "commit" move
+// the connection in and out of a transaction and "fail" gets an
+// ErrorResponse. Only the "test" database exists, as in testBackend, others
+// are refused at startup. application_name is reported with ParameterStatus at startup
+// and when set with "set application_name = 'name'". Extended query messages are answered like postgres would,
+// with Execute returning the query as its only row.
+type fakeBackend struct {
+	listener net.Listener
+	// SSLRequest is refused when nil
+	tlsConfig *tls.Config
+
+	mu             sync.Mutex
+	connections    int
+	tlsConnections int
+	// keys of the CancelRequests received
+	cancels []protocol.BackendKey
+	// simple queries received, on any connection
+	queries []string
+	// parameters of the startup messages received
+	startups []map[string]string
+	// answer to pg_is_in_recovery()
+	inRecovery bool
+	// seconds behind the primary, 0 if empty
+	replicaLag string
+	// the replica's WAL receiver lost the primary
+	disconnected bool
+}
+
+func newFakeBackend(t *testing.T) *fakeBackend {
+	return newTLSFakeBackend(t, nil)
+}
+
+func newTLSFakeBackend(t *testing.T, tlsConfig *tls.Config) *fakeBackend {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := &fakeBackend{listener: listener, tlsConfig: tlsConfig}
+	go fb.serve()
+	return fb
+}
+
+func (fb *fakeBackend) serve() {
+	for {
+		conn, err := fb.listener.Accept()
+		if err != nil {
+			return
+		}
+		fb.mu.Lock()
+		fb.connections++
+		key := protocol.BackendKey{ProcessID: int32(fb.connections), SecretKey: 42}
+		fb.mu.Unlock()
+		go fb.handle(protocol.NewConn(conn), key)
+	}
+}
+
+func (fb *fakeBackend) handle(conn *protocol.Conn, key protocol.BackendKey) {
+	defer conn.Close()
+	startupMessage, err := conn.ReadStartupMessage()
+	if err != nil {
+		return
+	}
+	if protocol.IsSSLRequest(startupMessage) {
+		if fb.tlsConfig == nil {
+			conn.Write([]byte{protocol.SSLNotAllowed})
+		} else {
+			conn.Write([]byte{protocol.SSLAllowed})
+			tlsConn := tls.Server(conn.Conn, fb.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = protocol.NewConn(tlsConn)
+			fb.mu.Lock()
+			fb.tlsConnections++
+			fb.mu.Unlock()
+		}
+		if startupMessage, err = conn.ReadStartupMessage(); err != nil {
+			return
+		}
+	}
+	if protocol.IsCancelRequest(startupMessage) {
+		cancelKey, _ := protocol.ParseCancelRequest(startupMessage)
+		fb.mu.Lock()
+		fb.cancels = append(fb.cancels, cancelKey)
+		fb.mu.Unlock()
+		return
+	}
+	parameters := protocol.GetStartupParameters(startupMessage)
+	fb.mu.Lock()
+	fb.startups = append(fb.startups, parameters)
+	fb.mu.Unlock()
+	if database := parameters["database"]; database != "test" {
+		conn.Send(protocol.NewErrorResponse(protocol.SeverityFatal, protocol.SQLStateInvalidCatalogName,
+			fmt.Sprintf("database \"%s\" does not exist", database)))
+		return
+	}
+	conn.Send(authenticationOk(), protocol.NewParameterStatusMessage("application_name", parameters["application_name"]),
+		protocol.NewBackendKeyDataMessage(key), readyForQuery(protocol.TransactionIdle))
+
+	txStatus := protocol.TransactionIdle
+	// queries of the prepared statements and portals on this connection
+	statements := make(map[string]string)
+	portals := make(map[string]string)
+	// after an error extended query messages are skipped up to Sync
+	failed := false
+	fail := func(code, message string) {
+		conn.Send(protocol.NewErrorResponse(protocol.SeverityError, code, message))
+		failed = true
+	}
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		messageType := protocol.GetMessageType(message)
+		if failed && messageType != protocol.SyncMessageType {
+			continue
+		}
+		switch messageType {
+		case protocol.TerminateMessageType:
+			return
+		case protocol.QueryMessageType:
+			query := string(message[5 : len(message)-1])
+			fb.mu.Lock()
+			fb.queries = append(fb.queries, query)
+			fb.mu.Unlock()
+
+			tag := "SELECT 1"
+			switch query {
+			case "begin", "begin read only":
+				tag, txStatus = "BEGIN", protocol.TransactionActive
+			case "commit":
+				tag, txStatus = "COMMIT", protocol.TransactionIdle
+			case "DISCARD ALL", "DEALLOCATE ALL":
+				tag, statements = query, make(map[string]string)
+			case "fail":
+				conn.Send(protocol.NewErrorResponse(protocol.SeverityError, "XX000", "failed"), readyForQuery(txStatus))
+				continue
+			case "select pg_is_in_recovery()":
+				fb.mu.Lock()
+				inRecovery := "f"
+				if fb.inRecovery {
+					inRecovery = "t"
+				}
+				fb.mu.Unlock()
+				conn.Send(protocol.NewDataRowMessage([]string{inRecovery}))
+			default:
+				if strings.HasPrefix(query, "set application_name = ") {
+					name := strings.Trim(strings.TrimPrefix(query, "set application_name = "), "'")
+					conn.Send(protocol.NewParameterStatusMessage("application_name", name))
+				}
+				if strings.Contains(query, "pg_last_xact_replay_timestamp()") {
+					fb.mu.Lock()
+					lag := fb.replicaLag
+					streaming := "t"
+					if fb.disconnected {
+						streaming = "f"
+					}
+					fb.mu.Unlock()
+					if lag == "" {
+						lag = "0"
+					}
+					conn.Send(protocol.NewDataRowMessage([]string{streaming, lag}))
+				}
+			}
+			conn.Send(commandComplete(tag), readyForQuery(txStatus))
+		case protocol.ParseMessageType:
+			parse, _ := protocol.DecodeParse(message)
+			if _, ok := statements[parse.Name]; ok && parse.Name != "" {
+				fail("42P05", "prepared statement \""+parse.Name+"\" already exists")
+				continue
+			}
+			statements[parse.Name] = parse.Query
+			conn.Send(protocol.NewParseCompleteMessage())
+		case protocol.BindMessageType:
+			bind, _ := protocol.DecodeBind(message)
+			query, ok := statements[bind.Statement]
+			if !ok {
+				fail("26000", "prepared statement \""+bind.Statement+"\" does not exist")
+				continue
+			}
+			portals[bind.Portal] = query
+			conn.Send(protocol.NewBindCompleteMessage())
+		case protocol.DescribeMessageType:
+			conn.Send(protocol.NewNoDataMessage())
+		case protocol.ExecuteMessageType:
+			// the row is the query that was run
+			execute, _ := protocol.DecodeExecute(message)
+			conn.Send(protocol.NewDataRowMessage([]string{portals[execute.Portal]}), commandComplete("SELECT 1"))
+		case protocol.CloseMessageType:
+			closeMessage, _ := protocol.DecodeClose(message)
+			if closeMessage.Target == protocol.StatementTarget {
+				delete(statements, closeMessage.Name)
+			}
+			conn.Send(protocol.NewCloseCompleteMessage())
+		case protocol.SyncMessageType:
+			failed = false
+			conn.Send(readyForQuery(txStatus))
+		}
+	}
+}
+
+// Connections returns how many connections the backend has accepted.
+func (fb *fakeBackend) Connections() int {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.connections
+}
+
+// TLSConnections returns how many connections were upgraded to TLS.
+func (fb *fakeBackend) TLSConnections() int {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.tlsConnections
+}
+
+// Cancels returns the keys of the CancelRequests received so far.
+func (fb *fakeBackend) Cancels() []protocol.BackendKey {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]protocol.BackendKey(nil), fb.cancels...)
+}
+
+// Queries returns the simple queries received so far.
+func (fb *fakeBackend) Queries() []string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]string(nil), fb.queries...)
+}
+
+// Startups returns the parameters of the startup messages received so far.
+func (fb *fakeBackend) Startups() []map[string]string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]map[string]string(nil), fb.startups...)
+}
+
+func (fb *fakeBackend) SetInRecovery(inRecovery bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.inRecovery = inRecovery
+}
+
+func (fb *fakeBackend) SetReplicaLag(seconds string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.replicaLag = seconds
+}
+
+func (fb *fakeBackend) SetDisconnected(disconnected bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.disconnected = disconnected
+}
+
+func (fb *fakeBackend) Close() {
+	fb.listener.Close()
+}
+
+func authenticationOk() []byte {
+	message := msgbuf.New([]byte{})
+	message.WriteByte(protocol.AuthenticationMessageType)
+	message.WriteInt32(0)
+	message.WriteInt32(protocol.AuthenticationOk)
+	message.ResetLength(protocol.PGMessageLengthOffset)
+	return message.Bytes()
+}
+
+func readyForQuery(status byte) []byte {
+	message := msgbuf.New([]byte{})
+	message.WriteByte(protocol.ReadyForQueryMessageType)
+	message.WriteInt32(0)
+	message.WriteByte(status)
+	message.ResetLength(protocol.PGMessageLengthOffset)
+	return message.Bytes()
+}
+
+func commandComplete(tag string) []byte {
+	message := msgbuf.New([]byte{})
+	message.WriteByte(protocol.CommandCompleteMessageType)
+	message.WriteInt32(0)
+	message.WriteString(tag)
+	message.ResetLength(protocol.PGMessageLengthOffset)
+	return message.Bytes()
+}
+
+func queryMessage(query string) []byte {
+	message := msgbuf.New([]byte{})
+	message.WriteByte(protocol.QueryMessageType)
+	message.WriteInt32(0)
+	message.WriteString(query)
+	message.ResetLength(protocol.PGMessageLengthOffset)
+	return message.Bytes()
+}
+
+// readMessage reads the next message the proxy sent to client or fails the
+// test.
+func readMessage(t *testing.T, client *protocol.Conn) []byte {
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// expectMessage reads the next message and checks its type.
+func expectMessage(t *testing.T, client *protocol.Conn, messageType byte) []byte {
+	message := readMessage(t, client)
+	if protocol.GetMessageType(message) != messageType {
+		t.Fatalf("expected message type %q, got %q", messageType, protocol.GetMessageType(message))
+	}
+	return message
+}
+
+// connectClient opens a client connection through the proxy and completes
+// its startup.
+func connectClient(t *testing.T, addr string) *protocol.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+	client.Flush()
+
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %v", message)
+	}
+	finishStartup(t, client)
+	return client
+}
+
+// finishStartup reads the messages after AuthenticationOk up to
+// ReadyForQuery and returns the key from BackendKeyData.
+func finishStartup(t *testing.T, client *protocol.Conn) protocol.BackendKey {
+	var key protocol.BackendKey
+	for {
+		message := readMessage(t, client)
+		switch protocol.GetMessageType(message) {
+		case protocol.BackendKeyDataMessageType:
+			var err error
+			if key, err = protocol.ParseBackendKeyData(message); err != nil {
+				t.Fatal(err)
+			}
+		case protocol.ReadyForQueryMessageType:
+			return key
+		case protocol.ErrorMessageType:
+			t.Fatalf("startup failed: %v", message)
+		}
+	}
+}
+
+func testBackend(fb *fakeBackend) *config.BackendHostSetting {
+	return &config.BackendHostSetting{
+		Name:     "test",
+		Port:     fb.listener.Addr().String(),
+		Username: "test",
+		Database: "test",
+		Capacity: 1,
+	}
+}
+
+func startServer(t *testing.T, backend *config.BackendHostSetting) (*Server, string) {
+	return startServerWith(t, config.RockyProxySettings{BackendHosts: []*config.BackendHostSetting{backend}})
+}
+
+// startServerWith serves the first backend in settings on a random port.
+func startServerWith(t *testing.T, settings config.RockyProxySettings) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener, settings.BackendHosts[0])
+	return srv, listener.Addr().String()
+}
+
+func TestSessionRelay(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, testBackend(fb))
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	client.Send(queryMessage("select 1"))
+	complete := expectMessage(t, client, protocol.CommandCompleteMessageType)
+	if !bytes.Equal(complete, commandComplete("SELECT 1")) {
+		t.Errorf("unexpected CommandComplete %v", complete)
+	}
+	expectMessage(t, client, protocol.ReadyForQueryMessageType)
+}
+
+func TestSessionReusesPooledConnection(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, testBackend(fb))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		client := connectClient(t, addr)
+		query(t, client, "select 1")
+		client.Send(protocol.NewTerminateMessage())
+		client.Close()
+
+		// wait for the session to hand its connection back
+		for srv.current().pools["test"].Stats().Active > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// one connection per client to authenticate it, plus the pooled one
+	if got := fb.Connections(); got != 4 {
+		t.Errorf("expected 4 backend connections, got %d", got)
+	}
+}
+
+// query sends a simple query and returns the transaction status from the
+// ReadyForQuery that ends the response.
+func query(t *testing.T, client *protocol.Conn, sql string) byte {
+	client.Send(queryMessage(sql))
+	expectMessage(t, client, protocol.CommandCompleteMessageType)
+	return expectMessage(t, client, protocol.ReadyForQueryMessageType)[5]
+}
+
+func TestTransactionPoolingSharesConnection(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	backend.PoolTimeout = 5 * time.Second
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	first := connectClient(t, addr)
+	defer first.Close()
+	second := connectClient(t, addr)
+	defer second.Close()
+
+	// with a capacity of 1 both clients can only run if the connection is
+	// released between transactions
+	query(t, first, "select 1")
+	query(t, second, "select 1")
+
+	if status := query(t, first, "begin"); status != protocol.TransactionActive {
+		t.Fatalf("expected transaction status T, got %q", status)
+	}
+
+	done := make(chan byte)
+	go func() {
+		second.Send(queryMessage("select 1"))
+		second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		second.ReadMessage()
+		message, _ := second.ReadMessage()
+		done <- message[5]
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second client ran while the first was in a transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	query(t, first, "commit")
+	if status := <-done; status != protocol.TransactionIdle {
+		t.Errorf("expected transaction status I, got %q", status)
+	}
+}
+
+func TestExtendedQueryRelay(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	backend.PoolTimeout = 5 * time.Second
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	first := connectClient(t, addr)
+	defer first.Close()
+	second := connectClient(t, addr)
+	defer second.Close()
+
+	// the connection is only released at the ReadyForQuery answering Sync, so
+	// both clients get their whole pipeline answered in order
+	for _, client := range []*protocol.Conn{first, second, first} {
+		client.Send(
+			(&protocol.Parse{Query: "select $1", ParameterTypes: []int32{protocol.TextOID}}).Bytes(),
+			(&protocol.Bind{Parameters: [][]byte{[]byte("1")}}).Bytes(),
+			(&protocol.Describe{Target: protocol.PortalTarget}).Bytes(),
+			(&protocol.Execute{}).Bytes(),
+			protocol.NewSyncMessage(),
+		)
+		for _, messageType := range []byte{
+			protocol.ParseCompleteMessageType,
+			protocol.BindCompleteMessageType,
+			protocol.NoDataMessageType,
+			protocol.DataRowMessageType,
+			protocol.CommandCompleteMessageType,
+			protocol.ReadyForQueryMessageType,
+		} {
+			expectMessage(t, client, messageType)
+		}
+	}
+}
+
+func TestStatementPoolingRejectsTransactions(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.StatementPooling
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	query(t, client, "select 1")
+
+	client.Send(queryMessage("begin"))
+	expectMessage(t, client, protocol.CommandCompleteMessageType)
+	expectMessage(t, client, protocol.ErrorMessageType)
+}
+
+func TestLocalAuthentication(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	authFile, err := ioutil.TempFile("", "userlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(authFile.Name())
+	authFile.WriteString(`"test" "secret"` + "\n")
+	authFile.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{backend},
+		AuthType:     config.AuthTrust,
+		AuthFile:     authFile.Name(),
+	})
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		client := connectClient(t, addr)
+		query(t, client, "select 1")
+		client.Close()
+	}
+
+	// clients never log in to the backend, only the pooled connection does
+	if got := fb.Connections(); got != 1 {
+		t.Errorf("expected 1 backend connection, got %d", got)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger := protocol.NewConn(conn)
+	defer stranger.Close()
+	stranger.WriteStartupMessage(protocol.NewStartupMessage("stranger", "test", map[string]string{}))
+	stranger.Flush()
+	expectMessage(t, stranger, protocol.ErrorMessageType)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.metrics.authFailures.Value("test", string(config.AuthTrust)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the failed login to be counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageSizeBeforeAuthentication(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	authFile, err := ioutil.TempFile("", "userlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(authFile.Name())
+	authFile.WriteString(`"test" "secret"` + "\n")
+	authFile.Close()
+
+	backend := testBackend(fb)
+	backend.PoolMode = config.TransactionPooling
+	srv, addr := startServerWith(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{backend},
+		AuthType:     config.AuthMD5,
+		AuthFile:     authFile.Name(),
+	})
+	defer srv.Close()
+
+	large := strings.Repeat("x", protocol.MaxAuthMessageSize)
+
+	stranger, _ := startup(t, addr, "test", "test")
+	defer stranger.Close()
+	stranger.Send(protocol.NewPasswordMessage(large))
+	expectMessage(t, stranger, protocol.ErrorMessageType)
+
+	// once logged in the client gets the configured limit
+	client, message := startup(t, addr, "test", "test")
+	defer client.Close()
+	client.Send(protocol.NewPasswordMessage(md5Password("test", "secret", string(message[9:13]))))
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %q", message)
+	}
+	finishStartup(t, client)
+	query(t, client, "select '"+large+"'")
+}
+
+func TestPoolExhaustedSendsError(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.PoolTimeout = 20 * time.Millisecond
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	first := connectClient(t, addr)
+	defer first.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := protocol.NewConn(conn)
+	defer second.Close()
+	second.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+	second.Flush()
+
+	if message := readMessage(t, second); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %v", message)
+	}
+	expectMessage(t, second, protocol.ErrorMessageType)
+}
+
+func TestCloseEndsSessions(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, testBackend(fb))
+
+	client := connectClient(t, addr)
+	defer client.Close()
+
+	srv.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.ReadMessage(); err != io.EOF {
+		t.Errorf("expected client to be disconnected, got %v", err)
+	}
+}
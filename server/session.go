@@ -0,0 +1,643 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/pool"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// Session is a single client connection and the pooled backend connection
+// serving it.
+//
+// In session pooling mode the backend connection is held until the client
+// leaves. In transaction and statement mode it is checked out when the client
+// sends a message and returned as soon as ReadyForQuery shows the connection
+// is idle, so many clients can share a few backend connections.
+type Session struct {
+	client *protocol.Conn
+	srv    *Server
+	// handed to the client in place of the backend's BackendKeyData
+	key protocol.BackendKey
+
+	// mu guards the fields below up to statements: what the session is
+	// connected to, the attached backend connection and its state, and what
+	// the client set up to use on any connection. It is not held while
+	// relaying messages, so neither relay waits on the other's writes. The
+	// client relay reads db and mode without it since it is the one setting
+	// them, see setDatabase.
+	mu sync.Mutex
+	// what the client is connected to, nil on a routed listener until
+	// startup
+	db     *database
+	mode   config.PoolMode
+	server *pool.ServerConn
+	// pool of the attached connection, or the one last attached
+	serverPool *pool.Pool
+	state      *serverState
+	serverDone chan struct{}
+	ending     bool
+	// run-time parameters of the client, applied to every backend
+	// connection attached, see clientParameters
+	parameters map[string]string
+	// named prepared statements of the client, see rewrite
+	statements map[string]*preparedStatement
+
+	// commands completed since the backend was last idle, only used by the
+	// backend relay
+	completed bool
+
+	// when a transaction last went to the primary, only used by the client
+	// relay, see route
+	wroteAt time.Time
+
+	// closeMu guards replacing client when it is upgraded to TLS, and the
+	// details shown by SHOW CLIENTS
+	closeMu     sync.Mutex
+	closed      bool
+	tls         bool
+	user        string
+	database    string
+	connectedAt time.Time
+
+	// the client is using the admin console instead of a backend
+	admin bool
+}
+
+func newSession(client net.Conn, srv *Server, db *database) *Session {
+	clientConn := protocol.NewConn(client)
+	clientConn.SetMaxMessageSize(authMessageSize(srv.current().settings))
+
+	s := &Session{
+		client:      clientConn,
+		srv:         srv,
+		connectedAt: time.Now(),
+	}
+	if db != nil {
+		s.setDatabase(db)
+	}
+	return s
+}
+
+// setDatabase connects the session to db.
+func (s *Session) setDatabase(db *database) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setDatabaseLocked(db)
+}
+
+func (s *Session) setDatabaseLocked(db *database) {
+	primary := db.primaryPool()
+	s.db = db
+	s.serverPool = primary
+	s.mode = poolMode(primary.Config())
+}
+
+// followReloadLocked connects the session to the database a reload put in
+// place of its own, returning whether there was one. Only called between
+// transactions, while no backend connection is attached. s.mu must be held.
+func (s *Session) followReloadLocked() bool {
+	db, ok := s.srv.current().databases[s.db.name]
+	if !ok || db == s.db {
+		return false
+	}
+	s.setDatabaseLocked(db)
+	return true
+}
+
+// target returns what the session is connected to, nil if it is not yet.
+func (s *Session) target() *database {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db
+}
+
+// Run authenticates the client and relays its messages to backend
+// connections from the pool until the client disconnects.
+func (s *Session) Run() {
+	defer s.Close()
+
+	if err := s.startup(); err != nil {
+		if err == errCancelRequest {
+			return
+		}
+		pLogger.Printf("session %s: startup failed: %s\n", s.client.RemoteAddr(), err.Error())
+		return
+	}
+
+	var err error
+	if s.admin {
+		err = s.serveAdmin()
+	} else {
+		err = s.relayClient()
+		s.finish()
+	}
+	if err != nil && err != io.EOF {
+		pLogger.Printf("session %s: %s\n", s.client.RemoteAddr(), err.Error())
+	}
+}
+
+// startup authenticates the client and finishes its startup with the
+// startup messages of a pooled backend connection, or sets up the admin
+// console if the client asked for the admin database.
+func (s *Session) startup() error {
+	message, err := s.readStartupMessage()
+	if err != nil {
+		return err
+	}
+	if protocol.IsCancelRequest(message) {
+		key, err := protocol.ParseCancelRequest(message)
+		if err != nil {
+			return err
+		}
+		s.srv.cancel(key)
+		return errCancelRequest
+	}
+
+	if s.srv.current().settings.ClientTLS.Require && !s.tls {
+		s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal, protocol.SQLStateInvalidAuthorization,
+			"rocky requires an SSL connection"))
+		return errors.New("client did not use TLS")
+	}
+
+	startup, err := protocol.ParseStartupMessage(message)
+	if err != nil {
+		code := protocol.SQLStateProtocolViolation
+		if err == protocol.ErrNoStartupUser {
+			code = protocol.SQLStateInvalidAuthorization
+		}
+		s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal, code, err.Error()))
+		return err
+	}
+	s.closeMu.Lock()
+	s.user = startup.User
+	s.database = startup.Database
+	s.admin = startup.Database == AdminDatabase
+	s.closeMu.Unlock()
+
+	if s.admin {
+		return s.startAdmin(message)
+	}
+	parameters, err := clientParameters(startup)
+	if err != nil {
+		s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal, protocol.SQLStateProtocolViolation, err.Error()))
+		return err
+	}
+	s.mu.Lock()
+	s.parameters = parameters
+	s.mu.Unlock()
+
+	if s.db == nil {
+		db := s.srv.current().router.resolve(startup.Database, startup.User)
+		if db == nil {
+			s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal, protocol.SQLStateInvalidCatalogName,
+				fmt.Sprintf("database \"%s\" does not exist", startup.Database)))
+			return fmt.Errorf("no route for database %q and user %q", startup.Database, startup.User)
+		}
+		s.setDatabase(db)
+	}
+
+	if err := s.authenticate(message); err != nil {
+		return err
+	}
+	// only clients that logged in are counted, like in postgres a client
+	// over a limit is turned away after AuthenticationOk
+	if err := s.srv.admit(s, startup.User, s.db.name); err != nil {
+		s.srv.metrics.clientsRejected.Inc(err.limit)
+		s.client.Send(protocol.NewTooManyConnectionsError(err.message).Bytes())
+		return err
+	}
+
+	// outside of session mode the client does not need a connection of its
+	// own yet, any connection's startup messages will do
+	if s.mode != config.SessionPooling {
+		if messages := s.db.primaryPool().StartupMessages(); messages != nil {
+			return s.client.Send(s.withClientKey(s.withClientParameters(messages))...)
+		}
+	}
+
+	s.mu.Lock()
+	server, err := s.attachLocked(s.db.primaryPool())
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// ParameterStatus, BackendKeyData and ReadyForQuery finish the client's
+	// startup
+	err = s.client.Send(s.withClientKey(s.withClientParameters(server.StartupMessages))...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil || s.mode != config.SessionPooling {
+		s.detachLocked(server)
+		return err
+	}
+	go s.relayServer(server, s.serverDone)
+	return nil
+}
+
+// readStartupMessage reads the client's startup message, or CancelRequest,
+// first answering any SSLRequest or GSSENCRequest that comes before it.
+func (s *Session) readStartupMessage() ([]byte, error) {
+	for {
+		message, err := s.client.ReadStartupMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case protocol.IsSSLRequest(message):
+			if err := s.upgradeTLS(); err != nil {
+				return nil, err
+			}
+		case protocol.IsGSSENCRequest(message):
+			if _, err := s.client.Write([]byte{protocol.SSLNotAllowed}); err != nil {
+				return nil, err
+			}
+		default:
+			return message, nil
+		}
+	}
+}
+
+// upgradeTLS answers an SSLRequest. When TLS is configured the client is told
+// to go ahead and the handshake replaces the client connection, otherwise
+// the client is told to carry on in plaintext.
+func (s *Session) upgradeTLS() error {
+	if s.tls {
+		return errors.New("client sent SSLRequest over TLS")
+	}
+	setup := s.srv.current()
+	if setup.tlsConfig == nil {
+		_, err := s.client.Write([]byte{protocol.SSLNotAllowed})
+		return err
+	}
+
+	// anything sent after the SSLRequest but before the handshake could have
+	// been injected by a man in the middle
+	if s.client.Buffered() > 0 {
+		return errors.New("client sent unencrypted data after SSLRequest")
+	}
+	if _, err := s.client.Write([]byte{protocol.SSLAllowed}); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(s.client.Conn, setup.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	client := protocol.NewConn(tlsConn)
+	client.SetMaxMessageSize(authMessageSize(setup.settings))
+
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		tlsConn.Close()
+		return errors.New("session closed")
+	}
+	s.client = client
+	s.tls = true
+	return nil
+}
+
+// authenticate checks the client's credentials, either against the userlist
+// or by relaying its login to the backend.
+func (s *Session) authenticate(startupMessage []byte) error {
+	authType := s.srv.current().settings.AuthType
+	if authType == "" {
+		authType = config.AuthBackend
+	}
+
+	err := s.checkCredentials(authType, startupMessage)
+	if err == protocol.ErrClientAuthFailed {
+		s.srv.metrics.authFailures.Inc(s.db.primaryPool().Name(), string(authType))
+	}
+	if err == nil {
+		s.client.SetMaxMessageSize(s.srv.current().settings.MaxMessageSize)
+	}
+	return err
+}
+
+// authMessageSize is the largest message a client may send before it has
+// authenticated. Like in postgres it is much smaller than afterwards, so a
+// client nobody knows cannot make rocky allocate much.
+func authMessageSize(settings config.RockyProxySettings) int {
+	if settings.MaxMessageSize > 0 && settings.MaxMessageSize < protocol.MaxAuthMessageSize {
+		return settings.MaxMessageSize
+	}
+	return protocol.MaxAuthMessageSize
+}
+
+func (s *Session) checkCredentials(authType config.AuthType, startupMessage []byte) error {
+	if authType == config.AuthBackend {
+		backend, err := s.db.primaryPool().Dial()
+		if err != nil {
+			s.client.Send(protocol.NewConnectionFailureError(
+				"could not connect to backend " + s.db.primaryPool().Name()).Bytes())
+			return err
+		}
+		ok, err := protocol.AuthenticateClient(s.client, backend, s.backendStartupMessage(startupMessage))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return protocol.ErrClientAuthFailed
+		}
+		return nil
+	}
+
+	user := protocol.GetStartupParameters(startupMessage)["user"]
+	return protocol.AuthenticateLocalClient(s.client, authType, s.srv.userlist(), user)
+}
+
+// backendStartupMessage is the client's startup message asking for the
+// backend's own database. The client may have asked for a logical database,
+// a routed name or the admin database, none of which the backend knows.
+func (s *Session) backendStartupMessage(startupMessage []byte) []byte {
+	params := protocol.GetStartupParameters(startupMessage)
+	user := params["user"]
+	delete(params, "user")
+	delete(params, "database")
+	return protocol.NewStartupMessage(user, s.db.primaryPool().Config().Database, params)
+}
+
+// attachLocked checks a backend connection out of serverPool for the
+// session. If none is available the client is sent an ErrorResponse. s.mu
+// must be held.
+func (s *Session) attachLocked(serverPool *pool.Pool) (*pool.ServerConn, error) {
+	start := time.Now()
+	server, err := serverPool.Get()
+	s.srv.metrics.poolWait.Observe(time.Since(start).Seconds(), serverPool.Name())
+	if err == pool.ErrPoolClosed && s.followReloadLocked() {
+		// a reload replaced the pool after it was picked
+		return s.attachLocked(s.db.primaryPool())
+	}
+	if err == pool.ErrPoolExhausted {
+		s.client.Send(protocol.NewTooManyConnectionsError(
+			"no connection to backend " + serverPool.Name() + " became available").Bytes())
+		return nil, err
+	}
+	if err != nil {
+		s.client.Send(protocol.NewConnectionFailureError(
+			"could not connect to backend " + serverPool.Name()).Bytes())
+		return nil, err
+	}
+	if err := server.ApplyParameters(s.parameters); err != nil {
+		// as postgres does with a bad parameter in the startup message
+		serverPool.Discard(server)
+		code, text := protocol.SQLStateConnectionFailure, err.Error()
+		if backendErr, ok := err.(*protocol.ErrorResponse); ok {
+			code, text = backendErr.Code, backendErr.Message
+		}
+		s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal, code, text))
+		return nil, err
+	}
+
+	s.server = server
+	s.serverPool = serverPool
+	s.state = newServerState()
+	s.serverDone = make(chan struct{})
+	return server, nil
+}
+
+// detachLocked returns the attached backend connection to the pool if it is
+// idle, otherwise it is closed. s.mu must be held.
+func (s *Session) detachLocked(server *pool.ServerConn) {
+	if s.state.idle() {
+		s.serverPool.Put(server)
+	} else {
+		s.serverPool.Discard(server)
+	}
+	s.server = nil
+}
+
+// relayClient forwards client messages to the attached backend connection,
+// attaching one first if needed, until the client sends Terminate or
+// disconnects. Terminate is not forwarded since backend connections outlive
+// their clients.
+func (s *Session) relayClient() error {
+	for {
+		message, err := s.client.ReadMessage()
+		if err != nil {
+			return err
+		}
+		messageType := protocol.GetMessageType(message)
+		if messageType == protocol.TerminateMessageType {
+			return nil
+		}
+
+		s.mu.Lock()
+		server := s.server
+		if server == nil {
+			s.followReloadLocked()
+			if server, err = s.attachLocked(s.route(message)); err != nil {
+				s.mu.Unlock()
+				return err
+			}
+			go s.relayServer(server, s.serverDone)
+		}
+		s.srv.metrics.bytesReceived.Add(float64(len(message)), s.serverPool.Name())
+		messages, err := s.rewrite(server, message)
+		if err != nil {
+			s.mu.Unlock()
+			s.client.Send(protocol.NewErrorResponse(protocol.SeverityFatal,
+				protocol.SQLStateProgramLimitExceeded, err.Error()))
+			return err
+		}
+		// counted before the write so the backend cannot be released
+		// before answering it
+		for _, m := range messages {
+			s.state.sent(protocol.GetMessageType(m.message), m.statement, m.injected)
+		}
+		s.mu.Unlock()
+
+		for _, m := range messages {
+			if err := server.WriteMessage(m.message); err != nil {
+				return err
+			}
+		}
+		if s.client.Buffered() == 0 {
+			if err := server.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// relayServer forwards messages from an attached backend connection to the
+// client. Outside of session mode it detaches the connection as soon as it
+// is idle.
+func (s *Session) relayServer(server *pool.ServerConn, done chan struct{}) {
+	defer close(done)
+
+	for {
+		message, err := server.ReadMessage()
+		if err != nil {
+			s.serverFailed(server, err)
+			return
+		}
+		s.countServerMessage(message)
+		switch protocol.GetMessageType(message) {
+		case protocol.CommandCompleteMessageType:
+			server.CommandCompleted(message)
+			s.statementsDropped(message)
+		case protocol.ParameterStatusMessageType:
+			s.parameterChanged(server, message)
+		}
+
+		if s.mode == config.StatementPooling && !statementModeAllows(message) {
+			s.client.Send(protocol.NewProtocolViolationError(
+				"transaction blocks not allowed in statement pooling mode").Bytes())
+			s.serverFailed(server, errors.New("transaction started in statement pooling mode"))
+			return
+		}
+
+		relay, unprepared := s.state.received(message)
+		for _, name := range unprepared {
+			server.Statements.Remove(name)
+		}
+		if relay {
+			if err := s.client.WriteMessage(message); err != nil {
+				s.serverFailed(server, err)
+				return
+			}
+			s.srv.metrics.bytesSent.Add(float64(len(message)), s.serverPool.Name())
+		}
+		if server.Buffered() == 0 {
+			if err := s.client.Flush(); err != nil {
+				s.serverFailed(server, err)
+				return
+			}
+		}
+
+		s.mu.Lock()
+		if s.state.serverMessage(message) && s.mode != config.SessionPooling {
+			s.detachLocked(server)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// countServerMessage updates the query, transaction and error metrics. A
+// transaction is counted when the backend is idle again after completing
+// commands, which covers both explicit and implicit transactions.
+func (s *Session) countServerMessage(message []byte) {
+	backend := s.serverPool.Name()
+	switch protocol.GetMessageType(message) {
+	case protocol.CommandCompleteMessageType:
+		s.srv.metrics.queries.Inc(backend)
+		s.completed = true
+	case protocol.ErrorMessageType:
+		s.srv.metrics.backendErrors.Inc(backend, protocol.GetErrorCode(message))
+	case protocol.ReadyForQueryMessageType:
+		if message[5] == protocol.TransactionIdle && s.completed {
+			s.srv.metrics.transactions.Inc(backend)
+			s.completed = false
+		}
+	}
+}
+
+// statementModeAllows rejects a ReadyForQuery that shows a transaction was
+// left open.
+func statementModeAllows(message []byte) bool {
+	if protocol.GetMessageType(message) != protocol.ReadyForQueryMessageType {
+		return true
+	}
+	return message[5] == protocol.TransactionIdle
+}
+
+// serverFailed handles the end of relayServer on an error. When the session
+// is ending this is how the relay is interrupted and the connection can be
+// reused if idle. Otherwise the backend connection is lost and since the
+// client's state went with it, the client is disconnected.
+func (s *Session) serverFailed(server *pool.ServerConn, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server != server {
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && s.ending {
+		s.detachLocked(server)
+		return
+	}
+	if s.ending {
+		s.serverPool.Discard(server)
+		s.server = nil
+		return
+	}
+
+	pLogger.Printf("session %s: backend %s: %s\n", s.client.RemoteAddr(), s.serverPool.Name(), err.Error())
+	s.serverPool.Discard(server)
+	s.server = nil
+	s.Close()
+}
+
+// finish releases the attached backend connection once the client is gone.
+// The backend relay is stopped with a read deadline so it returns between
+// messages, leaving an idle connection fit for the pool.
+func (s *Session) finish() {
+	s.mu.Lock()
+	s.ending = true
+	server := s.server
+	done := s.serverDone
+	if server != nil {
+		server.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	if server != nil {
+		<-done
+	}
+}
+
+// info describes the session for SHOW CLIENTS.
+func (s *Session) info() clientInfo {
+	s.mu.Lock()
+	active := s.server != nil
+	backend := ""
+	if s.db != nil {
+		backend = s.db.name
+	}
+	s.mu.Unlock()
+
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	state := "idle"
+	if active {
+		state = "active"
+	}
+	return clientInfo{
+		user:        s.user,
+		database:    s.database,
+		backend:     backend,
+		state:       state,
+		addr:        s.client.RemoteAddr().String(),
+		tls:         s.tls,
+		admin:       s.admin,
+		connectedAt: s.connectedAt,
+	}
+}
+
+// Close disconnects the client. Any backend connection is released by Run
+// once relaying stops.
+func (s *Session) Close() {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.client.Close()
+}
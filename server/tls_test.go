@@ -0,0 +1,284 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnshiver/rocky/config"
+	"github.com/johnshiver/rocky/protocol"
+)
+
+// writeTestCertificate writes a self-signed certificate for localhost and its
+// key to dir, returning their paths.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// sslRequest sends an SSLRequest and returns the single byte answer.
+func sslRequest(t *testing.T, conn net.Conn) byte {
+	conn.Write(protocol.NewSSLRequestMessage())
+
+	answer := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(answer); err != nil {
+		t.Fatal(err)
+	}
+	return answer[0]
+}
+
+func startTLSServer(t *testing.T, fb *fakeBackend, clientTLS config.ClientTLSSetting) (*Server, string) {
+	return startServerWith(t, config.RockyProxySettings{
+		BackendHosts: []*config.BackendHostSetting{testBackend(fb)},
+		ClientTLS:    clientTLS,
+	})
+}
+
+func TestClientTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocky-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startTLSServer(t, fb, config.ClientTLSSetting{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Require:  true,
+	})
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if answer := sslRequest(t, conn); answer != protocol.SSLAllowed {
+		t.Fatalf("expected SSLRequest to be accepted, got %q", answer)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	client := protocol.NewConn(tlsConn)
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+	client.Flush()
+
+	if message := readMessage(t, client); !protocol.IsAuthenticationOk(message) {
+		t.Fatalf("expected AuthenticationOk, got %v", message)
+	}
+	finishStartup(t, client)
+	query(t, client, "select 1")
+}
+
+func TestClientTLSRequired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocky-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startTLSServer(t, fb, config.ClientTLSSetting{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Require:  true,
+	})
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := protocol.NewConn(conn)
+	defer client.Close()
+	client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+	client.Flush()
+
+	expectMessage(t, client, protocol.ErrorMessageType)
+}
+
+func TestClientTLSNotConfigured(t *testing.T) {
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startServer(t, testBackend(fb))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if answer := sslRequest(t, conn); answer != protocol.SSLNotAllowed {
+		t.Fatalf("expected SSLRequest to be refused, got %q", answer)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocky-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	srv, addr := startTLSServer(t, fb, config.ClientTLSSetting{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFile:     certFile,
+		ClientCert: config.ClientCertRequire,
+	})
+	defer srv.Close()
+
+	handshake := func(certificates []tls.Certificate) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sslRequest(t, conn)
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, Certificates: certificates})
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		// TLS 1.3 reports a rejected certificate on the first read
+		tlsConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = tlsConn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	if err := handshake(nil); err == nil {
+		t.Error("expected handshake without a client certificate to fail")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake([]tls.Certificate{cert}); err != nil {
+		t.Errorf("handshake with a client certificate failed: %s", err)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocky-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb := newTLSFakeBackend(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer fb.Close()
+
+	backend := testBackend(fb)
+	backend.SSLMode = config.SSLVerifyFull
+	backend.SSLRootCert = certFile
+	srv, addr := startServer(t, backend)
+	defer srv.Close()
+
+	client := connectClient(t, addr)
+	defer client.Close()
+	query(t, client, "select 1")
+
+	if fb.TLSConnections() == 0 || fb.TLSConnections() != fb.Connections() {
+		t.Errorf("expected every backend connection to use TLS, got %d of %d",
+			fb.TLSConnections(), fb.Connections())
+	}
+}
+
+func TestBackendTLSModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocky-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeTestCertificate(t, dir)
+
+	// a backend without TLS is only acceptable for prefer
+	fb := newFakeBackend(t)
+	defer fb.Close()
+
+	for _, mode := range []config.SSLMode{config.SSLPrefer, config.SSLRequire, config.SSLVerifyCA} {
+		backend := testBackend(fb)
+		backend.SSLMode = mode
+		backend.SSLRootCert = certFile
+		srv, addr := startServer(t, backend)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := protocol.NewConn(conn)
+		client.WriteStartupMessage(protocol.NewStartupMessage("test", "test", map[string]string{}))
+		client.Flush()
+
+		message := readMessage(t, client)
+		if mode == config.SSLPrefer && !protocol.IsAuthenticationOk(message) {
+			t.Errorf("sslmode %s: expected AuthenticationOk, got %v", mode, message)
+		}
+		if mode != config.SSLPrefer && protocol.GetMessageType(message) != protocol.ErrorMessageType {
+			t.Errorf("sslmode %s: expected ErrorResponse, got %v", mode, message)
+		}
+		client.Close()
+		srv.Close()
+	}
+}